@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `Usage: fundgrube-backup <command> [arguments]
+
+Commands:
+  backup <file>             write all collections into a zip archive
+  restore [-replace] <file> restore the archive into the configured MongoDB and verify it, -replace deletes existing documents
+  verify [-storage] <file>  check the archive, -storage also compares it with the configured MongoDB
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	replace := flags.Bool("replace", false, "delete existing documents before restoring")
+	storage := flags.Bool("storage", false, "compare the archive with the configured MongoDB")
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "backup":
+		err = crawler.Backup(ctx, path)
+	case "restore":
+		err = crawler.Restore(ctx, path, *replace)
+	case "verify":
+		err = crawler.VerifyBackup(ctx, path, *storage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", command, err)
+	}
+}
@@ -1,44 +1,187 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"fundgrube-crawler/alert"
 	"fundgrube-crawler/crawler"
 	log "github.com/sirupsen/logrus"
 	easy "github.com/t-tomalak/logrus-easy-formatter"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var LOG_FILE = fmt.Sprintf("/tmp/fundgrube-%s.txt", time.Now().Format("2006-01-02T15-04-05"))
 
 func main() {
-	start := time.Now()
-
 	configureLogger()
 	if envBool("LOG_TO_FILE") {
 		defer mailAlertOnPanic()
 	}
 
-	crawler.CONFIG = crawler.GetConfigFromFile(env("SEARCH_REQUEST_YAML", "./bin_pi/config.yml"))
+	config, err := crawler.GetConfigFromFile(env("SEARCH_REQUEST_YAML", "./bin_pi/config.yml"))
+	if err != nil {
+		panic(err)
+	}
+	crawler.CONFIG = config
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	interval, err := time.ParseDuration(env("DAEMON_INTERVAL", "0s"))
+	if err != nil {
+		panic(err)
+	}
+	if interval > 0 {
+		runDaemon(ctx, interval)
+		return
+	}
+	if url := env("PUSHGATEWAY_URL", ""); url != "" {
+		defer pushMetrics(url)
+	}
+	if err := run(ctx); err != nil {
+		panic(err)
+	}
+}
+
+// runDaemon runs every interval until ctx is done and serves the metrics meanwhile. A failed run is logged and
+// recorded, the next run starts after the interval anyway.
+func runDaemon(ctx context.Context, interval time.Duration) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", crawler.NewMetricsHandler())
+	server := &http.Server{
+		Addr:              env("METRICS_ADDR", ":9090"),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Infof("Serving metrics on %s", server.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Metrics server failed: %s", err)
+		}
+	}()
+	defer server.Close()
+
+	for {
+		if err := run(ctx); err != nil {
+			log.Errorf("Run failed: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// run crawls and searches deals once and saves the run. The error that failed the run is returned, a panic is recovered
+// and returned as error as well. An interrupted run is no error.
+func run(ctx context.Context) (err error) {
+	runReport := crawler.RunReport{Start: time.Now(), Mode: runMode()}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			runReport.Err = err
+		}
+		if _, saveErr := crawler.SaveRun(ctx, runReport); saveErr != nil {
+			log.Errorf("Could not save run: %s", saveErr)
+		}
+	}()
 
 	if !envBool("SKIP_CRAWLING") {
-		if envBool("FAST_CRAWLING") {
-			err := crawler.RefreshOnlyNewPostings()
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			err := crawler.RefreshAllPostings(envBool("MOCKED_POSTINGS"))
-			if err != nil {
-				panic(err)
-			}
+		if err := crawl(ctx, &runReport); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		log.Warnf("Interrupted after %fs. Skipping search for deals.", time.Since(runReport.Start).Seconds())
+		runReport.Err = ctx.Err()
+		return nil
+	}
+
+	searchReport, err := crawler.SearchDeals(ctx)
+	runReport.Search = searchReport
+	if errors.Is(err, context.Canceled) {
+		log.Warnf("Interrupted search for deals: %s", err)
+		runReport.Err = err
+	} else if err != nil {
+		return err
+	}
+
+	if dir := env("REPORT_DIR", ""); dir != "" && ctx.Err() == nil {
+		if err := crawler.WriteReport(ctx, dir); err != nil {
+			log.Errorf("Could not write report to '%s': %s", dir, err)
+		}
+	}
+	runReport.Success = ctx.Err() == nil && runReport.Err == nil
+	log.Infof("Finished in %fs", time.Since(runReport.Start).Seconds())
+	return nil
+}
+
+func runMode() string {
+	if envBool("SKIP_CRAWLING") {
+		return crawler.RunModeSearch
+	}
+	if envBool("FAST_CRAWLING") {
+		return crawler.RunModeFast
+	}
+	return crawler.RunModeFull
+}
+
+func pushMetrics(url string) {
+	if err := crawler.PushMetrics(url, env("PUSHGATEWAY_JOB", "fundgrube_crawler")); err != nil {
+		log.Errorf("Could not push metrics to '%s': %s", url, err)
+	}
+}
+
+// crawl sets the crawl report of runReport. Only errors that fail the run are returned, an unfinished crawl is recorded
+// in runReport.
+func crawl(ctx context.Context, runReport *crawler.RunReport) error {
+	crawlTimeout, err := time.ParseDuration(env("CRAWL_TIMEOUT", "0s"))
+	if err != nil {
+		return err
+	}
+	if crawlTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, crawlTimeout)
+		defer cancel()
+	}
+
+	if envBool("FAST_CRAWLING") {
+		report, err := crawler.RefreshOnlyNewPostings(ctx)
+		runReport.Crawl = report
+		if report.HasErrors() {
+			alertAboutCrawlErrors(report)
 		}
+		if ctx.Err() != nil {
+			log.Warnf("Fast crawling did not finish: %s", err)
+			runReport.Err = err
+			return nil
+		}
+		return err
 	}
 
-	crawler.SearchDeals()
-	log.Infof("Finished in %fs", time.Since(start).Seconds())
+	report, err := crawler.RefreshAllPostings(ctx, envBool("MOCKED_POSTINGS"))
+	runReport.Crawl = report
+	if report.HasErrors() {
+		alertAboutCrawlErrors(report)
+	}
+	var storageErr *crawler.ErrStorageUnavailable
+	if errors.As(err, &storageErr) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Warnf("Crawling did not finish within %s. %s", crawlTimeout, report.String())
+		runReport.Err = err
+	}
+	return nil
 }
 
 func configureLogger() {
@@ -65,6 +208,19 @@ func configureLogger() {
 	}
 }
 
+func alertAboutCrawlErrors(report *crawler.CrawlReport) {
+	log.Warnf("Crawling finished with %d failed categories.", len(report.Errors))
+	if !envBool("ALERT_ON_CRAWL_ERRORS") {
+		return
+	}
+
+	subject := fmt.Sprintf("⚠️Crawling finished with %d failed categories", len(report.Errors))
+	err := alert.SendAlertMail(subject, report.String())
+	if err != nil {
+		log.Errorf("Failed to alert about crawl errors via mail: %s", err)
+	}
+}
+
 func mailAlertOnPanic() {
 	if r := recover(); r != nil {
 		var errorString string
@@ -81,7 +237,7 @@ func mailAlertOnPanic() {
 		contentBytes := getContentBytes()
 		err := alert.SendAlertMailBytes(subject, contentBytes)
 		if err != nil {
-			log.Fatalf("Failed to alert abount panic '%s' via mail. Send error '%s'", r.(string), err.Error())
+			log.Fatalf("Failed to alert abount panic '%s' via mail. Send error '%s'", errorString, err.Error())
 		}
 		log.Errorln("💥Panic occurred. Send alert mail.", r)
 	}
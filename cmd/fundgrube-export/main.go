@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	format := flag.String("format", "csv", "csv, jsonl or columns")
+	fields := flag.String("fields", "", "comma separated fields to export, all by default")
+	queryPath := flag.String("query", "", "yaml file with a query to filter postings, - reads stdin, all active postings by default")
+	outPath := flag.String("o", "-", "file to write to, - writes to stdout")
+	flag.Parse()
+
+	config, err := crawler.GetConfigFromFile(env("SEARCH_REQUEST_YAML", "./bin_pi/config.yml"))
+	if err != nil {
+		log.Fatalf("Could not read config: %s", err)
+	}
+	crawler.CONFIG = config
+
+	yamlQuery := []byte("{}")
+	if *queryPath != "" {
+		yamlQuery, err = readFile(*queryPath)
+		if err != nil {
+			log.Fatalf("Could not read query: %s", err)
+		}
+	}
+	fieldNames := []string{}
+	if *fields != "" {
+		fieldNames = strings.Split(*fields, ",")
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "-" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatalf("Could not create '%s': %s", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	count, err := crawler.Export(ctx, out, *format, fieldNames, yamlQuery)
+	if err != nil {
+		log.Fatalf("Export failed after %d postings: %s", count, err)
+	}
+	log.Infof("Exported %d postings.", count)
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func env(key string, defaultValue string) string {
+	value, present := os.LookupEnv(key)
+	if present {
+		return value
+	}
+	return defaultValue
+}
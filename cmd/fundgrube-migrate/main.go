@@ -1,18 +1,43 @@
 package main
 
 import (
+	"context"
 	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	migrate()
+	err := migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Migration failed: %s", err)
+	}
 }
 
-func migrate() {
+func migrate(ctx context.Context) error {
 	// migrate schema
-	crawler.Migrate(`{"outlet.outletid": {"$exists": 1}}`, `{"$rename": {"outlet.outletid": "outlet.id"}}`)
-	crawler.Migrate(`{"brand.brandid": {"$exists": 1}}`, `{"$rename": {"brand.brandid": "brand.id"}}`)
+	if _, err := crawler.Migrate(ctx, `{"outlet.outletid": {"$exists": 1}}`, `{"$rename": {"outlet.outletid": "outlet.id"}}`); err != nil {
+		return err
+	}
+	if _, err := crawler.Migrate(ctx, `{"brand.brandid": {"$exists": 1}}`, `{"$rename": {"brand.brandid": "brand.id"}}`); err != nil {
+		return err
+	}
+	if _, err := crawler.Migrate(ctx, `{"currency": {"$exists": 0}}`, `{"$set": {"currency": "EUR"}}`); err != nil {
+		return err
+	}
+	if _, err := crawler.ClassifyConditions(ctx); err != nil {
+		return err
+	}
+	if _, err := crawler.FillCategoryNames(ctx); err != nil {
+		return err
+	}
+	if _, err := crawler.ComputePrices(ctx); err != nil {
+		return err
+	}
+	if _, err := crawler.RescorePostings(ctx); err != nil {
+		return err
+	}
 
 	// clean up after bug
-	crawler.CleanUp(`{"cre_dat": {"$eq": null}}`)
+	_, err := crawler.CleanUp(ctx, `{"cre_dat": {"$eq": null}}`)
+	return err
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+const usage = `Usage: fundgrube-queries <command> [arguments]
+
+Commands:
+  list [-owner name]                   list stored queries and queries of the config file
+  show <id>                            print a query as yaml
+  add [-owner name] [-disabled] <file> store the query in the yaml file, - reads stdin
+  update <id> <file>                   replace a stored query by the query in the yaml file, - reads stdin
+  enable <id>                          search the stored query again
+  disable <id>                         stop searching the stored query
+  delete <id>                          delete the stored query and its last search time
+  import [-owner name] [config file]   store the queries of the config file, SEARCH_REQUEST_YAML by default
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	configPath := env("SEARCH_REQUEST_YAML", "./bin_pi/config.yml")
+	config, err := crawler.GetConfigFromFile(configPath)
+	if err != nil {
+		log.Fatalf("Could not read config: %s", err)
+	}
+	crawler.CONFIG = config
+
+	if err := run(context.Background(), os.Args[1], os.Args[2:], configPath); err != nil {
+		log.Fatalf("%s failed: %s", os.Args[1], err)
+	}
+}
+
+func run(ctx context.Context, command string, args []string, configPath string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	owner := flags.String("owner", "", "owner of the queries")
+	disabled := flags.Bool("disabled", false, "store the query disabled")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	switch command {
+	case "list":
+		return crawler.ListQueries(ctx, os.Stdout, *owner)
+	case "show":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <id>")
+		}
+		return crawler.ShowQuery(ctx, os.Stdout, args[0])
+	case "add":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <file>")
+		}
+		yamlBytes, err := readFile(args[0])
+		if err != nil {
+			return err
+		}
+		id, err := crawler.AddQuery(ctx, *owner, !*disabled, yamlBytes)
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	case "update":
+		if len(args) != 2 {
+			return fmt.Errorf("expected <id> <file>")
+		}
+		yamlBytes, err := readFile(args[1])
+		if err != nil {
+			return err
+		}
+		return crawler.UpdateQuery(ctx, args[0], yamlBytes)
+	case "enable", "disable":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <id>")
+		}
+		return crawler.EnableQuery(ctx, args[0], command == "enable")
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <id>")
+		}
+		return crawler.DeleteQuery(ctx, args[0])
+	case "import":
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one config file")
+		}
+		if len(args) == 1 {
+			configPath = args[0]
+		}
+		config, err := crawler.GetConfigFromFile(configPath)
+		if err != nil {
+			return err
+		}
+		count, err := crawler.ImportQueries(ctx, config, *owner)
+		if err != nil {
+			return err
+		}
+		log.Infof("Imported %d of %d queries from '%s'.", count, len(config.Queries), configPath)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+	return nil
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func env(key string, defaultValue string) string {
+	value, present := os.LookupEnv(key)
+	if present {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+const usage = `Usage: fundgrube-runs <command> [arguments]
+
+Commands:
+  list [-mode full|fast|search] [-limit n]  list the newest runs with their stats
+  show <id>                                 print a run with the stats of each category and its errors
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := run(context.Background(), os.Args[1], os.Args[2:]); err != nil {
+		log.Fatalf("%s failed: %s", os.Args[1], err)
+	}
+}
+
+func run(ctx context.Context, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	mode := flags.String("mode", "", "only list runs of this mode")
+	limit := flags.Int64("limit", 20, "number of runs to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	switch command {
+	case "list":
+		return crawler.ListRuns(ctx, os.Stdout, *mode, *limit)
+	case "show":
+		if len(args) != 1 {
+			return fmt.Errorf("expected <id>")
+		}
+		return crawler.ShowRun(ctx, os.Stdout, args[0])
+	}
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+	return nil
+}
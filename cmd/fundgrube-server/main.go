@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fundgrube-crawler/crawler"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	config, err := crawler.GetConfigFromFile(env("SEARCH_REQUEST_YAML", "./bin_pi/config.yml"))
+	if err != nil {
+		log.Fatalf("Could not read config: %s", err)
+	}
+	crawler.CONFIG = config
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", crawler.NewApiHandler())
+	mux.Handle("/feeds/", crawler.NewFeedHandler())
+	mux.Handle("/", crawler.NewWebHandler())
+	server := &http.Server{
+		Addr:              env("SERVER_ADDR", ":8080"),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Shutdown failed: %s", err)
+		}
+	}()
+
+	log.Infof("Listening on %s", server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server failed: %s", err)
+	}
+	log.Info("Server stopped")
+}
+
+func env(key string, defaultValue string) string {
+	value, present := os.LookupEnv(key)
+	if present {
+		return value
+	}
+	return defaultValue
+}
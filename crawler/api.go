@@ -0,0 +1,626 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// errInvalidRequest is answered with 400 Bad Request.
+var errInvalidRequest = errors.New("invalid request")
+
+// alertOnlyParams are query options applied when alerting only, so they cannot be used to list postings.
+var alertOnlyParams = []string{"below_historical_min", "percentile_max", "group_by_product"}
+
+// postingResponse is the json representation of a posting. The json tags of posting match the Fundgrube api.
+type postingResponse struct {
+	Id              string     `json:"id"`
+	Name            string     `json:"name"`
+	Brand           string     `json:"brand"`
+	Price           float64    `json:"price"`
+	PriceOld        float64    `json:"price_old"`
+	TotalPrice      float64    `json:"total_price"`
+	Saving          float64    `json:"saving"`
+	Discount        int        `json:"discount"`
+	ShippingCost    float64    `json:"shipping_cost"`
+	ShippingType    string     `json:"shipping_type"`
+	Currency        string     `json:"currency"`
+	Text            string     `json:"text"`
+	Condition       condition  `json:"condition,omitempty"`
+	ConditionFlags  []string   `json:"condition_flags,omitempty"`
+	Shop            Shop       `json:"shop"`
+	OutletId        int        `json:"outlet_id"`
+	OutletName      string     `json:"outlet_name"`
+	CategoryId      string     `json:"category_id"`
+	CategoryName    string     `json:"category_name,omitempty"`
+	PimId           int        `json:"pim_id"`
+	EfficiencyClass string     `json:"efficiency_class,omitempty"`
+	Score           float64    `json:"score"`
+	DistanceKm      *float64   `json:"distance_km,omitempty"`
+	ImageUrls       []string   `json:"image_urls"`
+	ShopUrl         string     `json:"shop_url"`
+	Active          bool       `json:"active"`
+	Created         *time.Time `json:"created"`
+	Modified        *time.Time `json:"modified"`
+}
+
+type postingDetailResponse struct {
+	postingResponse
+	History []historicalPrice `json:"history"`
+	Product *product          `json:"product,omitempty"`
+}
+
+type postingListResponse struct {
+	Postings []postingResponse `json:"postings"`
+	Limit    int64             `json:"limit"`
+	Offset   int64             `json:"offset"`
+}
+
+type runListResponse struct {
+	Runs   []run `json:"runs"`
+	Limit  int64 `json:"limit"`
+	Offset int64 `json:"offset"`
+}
+
+type queryResponse struct {
+	storedQuery
+	LastRun *time.Time `json:"last_run"`
+}
+
+// queryRequest creates or replaces a stored query. Queries are enabled unless enabled is false.
+type queryRequest struct {
+	Owner   string `json:"owner"`
+	Enabled *bool  `json:"enabled"`
+	Query   query  `json:"query"`
+}
+
+type searchResponse struct {
+	QueryId string            `json:"query_id"`
+	Deals   []postingResponse `json:"deals"`
+}
+
+func toPostingResponse(p posting) postingResponse {
+	r := postingResponse{
+		Id:             p.PostingId,
+		Name:           p.Name,
+		Brand:          p.Brand.Name,
+		Price:          p.Price,
+		PriceOld:       p.PriceOld,
+		TotalPrice:     p.TotalPrice,
+		Saving:         p.Saving,
+		Discount:       p.DiscountInPercent,
+		ShippingCost:   p.ShippingCost,
+		ShippingType:   p.ShippingType,
+		Currency:       p.Currency,
+		Text:           p.Text,
+		Condition:      p.Condition,
+		ConditionFlags: p.ConditionFlags,
+		Shop:           p.Shop,
+		OutletId:       p.Outlet.OutletId,
+		OutletName:     p.Outlet.Name,
+		CategoryId:     p.CategoryId,
+		CategoryName:   p.CategoryName,
+		PimId:          p.PimId,
+		Score:          p.Score,
+		DistanceKm:     p.DistanceKm,
+		ImageUrls:      p.Url,
+		ShopUrl:        p.ShopUrl,
+		Active:         p.Active,
+		Created:        p.CreDat,
+		Modified:       p.ModDat,
+	}
+	if p.EnergyLabel != nil {
+		r.EfficiencyClass = p.EnergyLabel.EfficiencyClass
+	}
+	return r
+}
+
+func toPostingResponses(postings []posting) []postingResponse {
+	ret := []postingResponse{}
+	for _, p := range postings {
+		ret = append(ret, toPostingResponse(p))
+	}
+	return ret
+}
+
+// NewApiHandler serves the crawled postings, reference data and configured queries as json.
+func NewApiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/postings", allowMethod(http.MethodGet, handleListPostings))
+	mux.HandleFunc("/api/postings/search", allowMethod(http.MethodPost, handleSearchPostings))
+	mux.HandleFunc("/api/postings/", allowMethod(http.MethodGet, handleGetPosting))
+	mux.HandleFunc("/api/outlets", allowMethod(http.MethodGet, handleListOutlets))
+	mux.HandleFunc("/api/categories", allowMethod(http.MethodGet, handleListCategories))
+	mux.HandleFunc("/api/queries", allowMethods(map[string]apiHandler{
+		http.MethodGet:  handleListQueries,
+		http.MethodPost: handleCreateQuery,
+	}))
+	mux.HandleFunc("/api/queries/", handleQuery)
+	mux.HandleFunc("/api/runs", allowMethod(http.MethodGet, handleListRuns))
+	mux.HandleFunc("/api/runs/", allowMethod(http.MethodGet, handleGetRun))
+	return mux
+}
+
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+func allowMethod(method string, handler apiHandler) http.HandlerFunc {
+	return allowMethods(map[string]apiHandler{method: handler})
+}
+
+func allowMethods(handlers map[string]apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			methods := []string{}
+			for method := range handlers {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": fmt.Sprintf("method %s not allowed", r.Method)})
+			return
+		}
+		if err := handler(w, r); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// handleListPostings lists postings filtered by url parameters named like the fields of a query, e.g.
+// `?name_regex=switch&price_max=200&shops=MM&shops=SATURN`.
+func handleListPostings(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	limit, offset, err := pagination(params)
+	if err != nil {
+		return err
+	}
+	afterTime, err := sinceParam(params)
+	if err != nil {
+		return err
+	}
+	params.Del("limit")
+	params.Del("offset")
+	params.Del("since")
+	q, err := queryFromParams(params)
+	if err != nil {
+		return err
+	}
+	return listPostings(w, r, q, afterTime, limit, offset)
+}
+
+// handleSearchPostings lists postings filtered by a query in the request body, written like in the config file.
+func handleSearchPostings(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	limit, offset, err := pagination(params)
+	if err != nil {
+		return err
+	}
+	afterTime, err := sinceParam(params)
+	if err != nil {
+		return err
+	}
+	q := query{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&q); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidRequest, err)
+	}
+	return listPostings(w, r, q, afterTime, limit, offset)
+}
+
+// validateListQuery validates a query listing postings, which rejects the options only applied when alerting.
+func validateListQuery(q query) error {
+	if err := q.validate(); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidRequest, err)
+	}
+	if q.BelowHistoricalMin || q.PercentileMax != nil || q.GroupByProduct {
+		return fmt.Errorf("%w: %s are only applied when alerting", errInvalidRequest, strings.Join(alertOnlyParams, ", "))
+	}
+	return nil
+}
+
+func listPostings(w http.ResponseWriter, r *http.Request, q query, afterTime *time.Time, limit int64, offset int64) error {
+	if err := validateListQuery(q); err != nil {
+		return err
+	}
+	postings, err := FindAll(r.Context(), q, afterTime, limit, offset)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, postingListResponse{Postings: toPostingResponses(withDistances(q, postings)), Limit: limit, Offset: offset})
+	return nil
+}
+
+// handleGetPosting returns a posting along with the prices of the other postings of its product.
+func handleGetPosting(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/api/postings/")
+	p, err := FindOne(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("posting '%s' not found", id)})
+		return nil
+	}
+
+	response := postingDetailResponse{postingResponse: toPostingResponse(*p), History: []historicalPrice{}}
+	if p.PimId != 0 {
+		histories, err := findPriceHistories(r.Context(), []int{p.PimId})
+		if err != nil {
+			return err
+		}
+		if history := historyOf(histories, *p); history != nil {
+			response.History = history.Prices
+		}
+		products, err := findProducts(r.Context(), []int{p.PimId})
+		if err != nil {
+			return err
+		}
+		if found, ok := products[p.PimId]; ok {
+			response.Product = &found
+		}
+	}
+	writeJson(w, http.StatusOK, response)
+	return nil
+}
+
+func handleListOutlets(w http.ResponseWriter, r *http.Request) error {
+	outlets, err := findOutlets(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, outlets)
+	return nil
+}
+
+func handleListCategories(w http.ResponseWriter, r *http.Request) error {
+	categories, err := findCategories(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, categories)
+	return nil
+}
+
+// handleListQueries lists the stored queries and the queries of the config file with the time of their last search,
+// only the stored queries of an owner given by `?owner=`.
+func handleListQueries(w http.ResponseWriter, r *http.Request) error {
+	queries, err := allQueries(r.Context(), r.URL.Query().Get("owner"))
+	if err != nil {
+		return err
+	}
+	responses := []queryResponse{}
+	for _, sq := range queries {
+		response, err := toQueryResponse(r, sq)
+		if err != nil {
+			return err
+		}
+		responses = append(responses, response)
+	}
+	writeJson(w, http.StatusOK, responses)
+	return nil
+}
+
+func handleCreateQuery(w http.ResponseWriter, r *http.Request) error {
+	request, err := decodeQueryRequest(r)
+	if err != nil {
+		return err
+	}
+	sq, err := createStoredQuery(r.Context(), request.Owner, request.Enabled == nil || *request.Enabled, request.Query)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusCreated, queryResponse{storedQuery: *sq})
+	return nil
+}
+
+// handleQuery serves `/api/queries/{id}` and `/api/queries/{id}/search`.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/queries/")
+	if id := strings.TrimSuffix(path, "/search"); id != path {
+		allowMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) error {
+			return runQuery(w, r, id)
+		})(w, r)
+		return
+	}
+	if strings.Contains(path, "/") {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	allowMethods(map[string]apiHandler{
+		http.MethodGet: func(w http.ResponseWriter, r *http.Request) error {
+			return getQuery(w, r, path)
+		},
+		http.MethodPut: func(w http.ResponseWriter, r *http.Request) error {
+			return replaceQuery(w, r, path)
+		},
+		http.MethodDelete: func(w http.ResponseWriter, r *http.Request) error {
+			return deleteQuery(w, r, path)
+		},
+	})(w, r)
+}
+
+func getQuery(w http.ResponseWriter, r *http.Request, id string) error {
+	sq, err := findQuery(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	response, err := toQueryResponse(r, *sq)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, response)
+	return nil
+}
+
+// replaceQuery replaces owner, enabled flag and query of a stored query. Queries of the config file cannot be replaced.
+func replaceQuery(w http.ResponseWriter, r *http.Request, id string) error {
+	request, err := decodeQueryRequest(r)
+	if err != nil {
+		return err
+	}
+	sq, err := editStoredQuery(r.Context(), id, func(sq *storedQuery) {
+		sq.Owner = request.Owner
+		sq.Enabled = request.Enabled == nil || *request.Enabled
+		sq.Query = request.Query
+	})
+	if err != nil {
+		return err
+	}
+	response, err := toQueryResponse(r, *sq)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, response)
+	return nil
+}
+
+func deleteQuery(w http.ResponseWriter, r *http.Request, id string) error {
+	if err := deleteStoredQuery(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// runQuery searches the new deals of a query like a scheduled run, so they are mailed and the last search time is
+// updated. Disabled queries can be run as well.
+func runQuery(w http.ResponseWriter, r *http.Request, id string) error {
+	sq, err := findQuery(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	deals, err := searchDealsForSingleQuery(r.Context(), sq.Id, sq.Query)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, searchResponse{QueryId: id, Deals: toPostingResponses(deals)})
+	return nil
+}
+
+// handleListRuns lists the runs newest first, only those of a mode given by `?mode=`.
+func handleListRuns(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	limit, offset, err := pagination(params)
+	if err != nil {
+		return err
+	}
+	mode := params.Get("mode")
+	if mode != "" && mode != RunModeFull && mode != RunModeFast && mode != RunModeSearch {
+		return fmt.Errorf("%w: unknown mode '%s'", errInvalidRequest, mode)
+	}
+	runs, err := findRuns(r.Context(), mode, limit, offset)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, runListResponse{Runs: runs, Limit: limit, Offset: offset})
+	return nil
+}
+
+func handleGetRun(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/api/runs/")
+	found, err := findRun(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return fmt.Errorf("%w: '%s'", ErrRunNotFound, id)
+	}
+	writeJson(w, http.StatusOK, found)
+	return nil
+}
+
+func toQueryResponse(r *http.Request, sq storedQuery) (queryResponse, error) {
+	op, err := findSearchOperation(r.Context(), sq.Id)
+	if err != nil {
+		return queryResponse{}, err
+	}
+	response := queryResponse{storedQuery: sq}
+	if op != nil {
+		response.LastRun = op.Timestamp
+	}
+	return response, nil
+}
+
+func decodeQueryRequest(r *http.Request) (queryRequest, error) {
+	request := queryRequest{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, fmt.Errorf("%w: %s", errInvalidRequest, err)
+	}
+	return request, nil
+}
+
+func pagination(params url.Values) (int64, int64, error) {
+	limit, err := intParam(params, "limit", apiDefaultLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit < 1 || limit > apiMaxLimit {
+		return 0, 0, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidRequest, apiMaxLimit)
+	}
+	offset, err := intParam(params, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("%w: offset must not be negative", errInvalidRequest)
+	}
+	return limit, offset, nil
+}
+
+func intParam(params url.Values, key string, defaultValue int64) (int64, error) {
+	value := params.Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a number", errInvalidRequest, key)
+	}
+	return parsed, nil
+}
+
+// sinceParam parses the optional `since` parameter, which lists postings modified after that time like an alert.
+func sinceParam(params url.Values) (*time.Time, error) {
+	value := params.Get("since")
+	if value == "" {
+		return nil, nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: since must be a RFC 3339 time", errInvalidRequest)
+	}
+	return &since, nil
+}
+
+// queryFromParams sets the fields of a query by their yaml names. Lists are given by repeating a parameter, fields of
+// nested filters are separated by a dot, e.g. `near.outlet=Hannover&near.radius_km=50`.
+func queryFromParams(params url.Values) (query, error) {
+	q := query{}
+	for key, values := range params {
+		field, err := fieldByYamlPath(reflect.ValueOf(&q).Elem(), strings.Split(key, "."))
+		if err != nil {
+			return q, fmt.Errorf("%w: unknown parameter '%s'", errInvalidRequest, key)
+		}
+		if err := setParam(field, values); err != nil {
+			return q, fmt.Errorf("%w: parameter '%s': %s", errInvalidRequest, key, err)
+		}
+	}
+	return q, nil
+}
+
+func fieldByYamlPath(v reflect.Value, path []string) (reflect.Value, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return v, fmt.Errorf("not a struct")
+	}
+	for i := 0; i < v.NumField(); i++ {
+		tag := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" || tag != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return v.Field(i), nil
+		}
+		return fieldByYamlPath(v.Field(i), path[1:])
+	}
+	return v, fmt.Errorf("no field %s", path[0])
+}
+
+func setParam(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setScalar(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	if len(values) > 1 {
+		return fmt.Errorf("must be given once")
+	}
+	if field.Kind() == reflect.Pointer {
+		value := reflect.New(field.Type().Elem())
+		if err := setScalar(value.Elem(), values[0]); err != nil {
+			return err
+		}
+		field.Set(value)
+		return nil
+	}
+	return setScalar(field, values[0])
+}
+
+func setScalar(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		field.SetBool(parsed)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		field.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		field.SetFloat(parsed)
+	default:
+		return fmt.Errorf("cannot be set by url parameter")
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Could not write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var storageErr *ErrStorageUnavailable
+	switch {
+	case errors.Is(err, errInvalidRequest), errors.Is(err, ErrQueryInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrQueryNotFound), errors.Is(err, ErrRunNotFound):
+		status = http.StatusNotFound
+	case errors.As(err, &storageErr):
+		status = http.StatusServiceUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		log.Errorf("%s %s failed: %s", r.Method, r.URL.Path, err)
+	}
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
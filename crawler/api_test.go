@@ -0,0 +1,201 @@
+package crawler
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_validateListQuery(t *testing.T) {
+	assert.NoError(t, validateListQuery(query{ScoreMin: fPtr(50)}))
+	assert.ErrorIs(t, validateListQuery(query{PercentileMax: fPtr(110)}), errInvalidRequest)
+	assert.ErrorContains(t, validateListQuery(query{BelowHistoricalMin: true}), "only applied when alerting")
+	assert.ErrorContains(t, validateListQuery(query{GroupByProduct: true}), "only applied when alerting")
+}
+
+func Test_queryFromParams(t *testing.T) {
+	params, _ := url.ParseQuery("name_regex=switch&name_regex=oled&price_max=199.5&discount_min=20&shops=MM&shops=SATURN" +
+		"&near.outlet=Hannover&near.radius_km=50&find_inactive=true&condition=new")
+
+	q, err := queryFromParams(params)
+
+	assert.NoError(t, err)
+	assert.Equal(t, query{
+		NameRegex:    []string{"switch", "oled"},
+		PriceMax:     fPtr(199.5),
+		DiscountMin:  iPtr(20),
+		Shops:        []Shop{MM, SATURN},
+		Near:         &nearFilter{Outlet: "Hannover", RadiusKm: 50},
+		FindInactive: true,
+		Condition:    []condition{conditionNew},
+	}, q)
+}
+
+func Test_queryFromParams_invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{"unknown parameter", "foo=bar", "unknown parameter 'foo'"},
+		{"unknown nested parameter", "near.foo=1", "unknown parameter 'near.foo'"},
+		{"nested parameter of a value", "price_max.foo=1", "unknown parameter 'price_max.foo'"},
+		{"ignored field", "Ids=1", "unknown parameter 'Ids'"},
+		{"not a number", "price_max=cheap", "parameter 'price_max': must be a number"},
+		{"not an integer", "discount_min=1.5", "parameter 'discount_min': must be an integer"},
+		{"not a bool", "find_inactive=yes", "parameter 'find_inactive': must be true or false"},
+		{"repeated single value", "price_max=1&price_max=2", "parameter 'price_max': must be given once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _ := url.ParseQuery(tt.params)
+			_, err := queryFromParams(params)
+			assert.ErrorIs(t, err, errInvalidRequest)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func Test_pagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		params     string
+		wantLimit  int64
+		wantOffset int64
+		wantErr    bool
+	}{
+		{"defaults", "", apiDefaultLimit, 0, false},
+		{"given", "limit=10&offset=20", 10, 20, false},
+		{"max limit", "limit=1000", 1000, 0, false},
+		{"limit too large", "limit=1001", 0, 0, true},
+		{"zero limit", "limit=0", 0, 0, true},
+		{"negative offset", "offset=-1", 0, 0, true},
+		{"not a number", "limit=ten", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _ := url.ParseQuery(tt.params)
+			limit, offset, err := pagination(params)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errInvalidRequest)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLimit, limit)
+			assert.Equal(t, tt.wantOffset, offset)
+		})
+	}
+}
+
+func Test_apiHandler_rejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"unknown parameter", http.MethodGet, "/api/postings?foo=bar", "", http.StatusBadRequest, "unknown parameter 'foo'"},
+		{"invalid query", http.MethodGet, "/api/postings?shipping_type=teleport", "", http.StatusBadRequest, "shipping_type"},
+		{"invalid expr", http.MethodGet, "/api/postings?expr=" + url.QueryEscape("price <"), "", http.StatusBadRequest, "invalid expr"},
+		{"alert only option", http.MethodGet, "/api/postings?percentile_max=10", "", http.StatusBadRequest, "only applied when alerting"},
+		{"invalid since", http.MethodGet, "/api/postings?since=yesterday", "", http.StatusBadRequest, "since must be a RFC 3339 time"},
+		{"invalid limit", http.MethodGet, "/api/postings?limit=5000", "", http.StatusBadRequest, "limit must be between 1 and 1000"},
+		{"unknown body field", http.MethodPost, "/api/postings/search", `{"foo": 1}`, http.StatusBadRequest, "unknown field"},
+		{"alert only option in body", http.MethodPost, "/api/postings/search", `{"group_by_product": true}`, http.StatusBadRequest, "only applied when alerting"},
+		{"wrong method", http.MethodPost, "/api/postings", "", http.StatusMethodNotAllowed, "method POST not allowed"},
+		{"unknown query action", http.MethodPost, "/api/queries/abc/foo", "", http.StatusNotFound, "not found"},
+		{"wrong method for query", http.MethodPost, "/api/queries/abc", "", http.StatusMethodNotAllowed, "method POST not allowed"},
+		{"unknown query field", http.MethodPost, "/api/queries", `{"query": {"foo": 1}}`, http.StatusBadRequest, "unknown field"},
+		{"invalid stored query", http.MethodPost, "/api/queries", `{"query": {"expr": "price <"}}`, http.StatusBadRequest, "invalid expr"},
+		{"invalid replaced query", http.MethodPut, "/api/queries/abc", `{"enabled": "yes"}`, http.StatusBadRequest, "cannot unmarshal"},
+		{"unknown run mode", http.MethodGet, "/api/runs?mode=slow", "", http.StatusBadRequest, "unknown mode 'slow'"},
+		{"wrong method for runs", http.MethodDelete, "/api/runs/abc", "", http.StatusMethodNotAllowed, "method DELETE not allowed"},
+	}
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{}
+	handler := NewApiHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+			body := map[string]string{}
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+			assert.Contains(t, body["error"], tt.wantError)
+		})
+	}
+}
+
+func (suite *PersistenceSuite) Test_apiHandler_manageQueries() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery()}}
+	handler := NewApiHandler()
+	serve := func(method string, target string, body string) (int, []byte) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return recorder.Code, recorder.Body.Bytes()
+	}
+
+	status, body := serve(http.MethodPost, "/api/queries", `{"owner": "anna", "query": {"desc": "switch", "name_regex": ["switch"]}}`)
+	assert.Equal(suite.T(), http.StatusCreated, status)
+	created := queryResponse{}
+	assert.NoError(suite.T(), json.Unmarshal(body, &created))
+	assert.Equal(suite.T(), "anna", created.Owner)
+	assert.True(suite.T(), created.Enabled)
+	assert.Equal(suite.T(), query{Desc: "switch", NameRegex: []string{"switch"}}, created.Query)
+
+	status, body = serve(http.MethodGet, "/api/queries", "")
+	assert.Equal(suite.T(), http.StatusOK, status)
+	listed := []queryResponse{}
+	assert.NoError(suite.T(), json.Unmarshal(body, &listed))
+	assert.Equal(suite.T(), []string{created.Id, getExampleHash()}, []string{listed[0].Id, listed[1].Id})
+	assert.True(suite.T(), listed[1].Config)
+
+	status, body = serve(http.MethodGet, "/api/queries?owner=bob", "")
+	assert.Equal(suite.T(), http.StatusOK, status)
+	assert.JSONEq(suite.T(), "[]", string(body))
+
+	status, _ = serve(http.MethodPut, "/api/queries/"+created.Id, `{"owner": "anna", "enabled": false, "query": {"desc": "oled"}}`)
+	assert.Equal(suite.T(), http.StatusOK, status)
+	status, body = serve(http.MethodGet, "/api/queries/"+created.Id, "")
+	assert.Equal(suite.T(), http.StatusOK, status)
+	replaced := queryResponse{}
+	assert.NoError(suite.T(), json.Unmarshal(body, &replaced))
+	assert.False(suite.T(), replaced.Enabled)
+	assert.Equal(suite.T(), "oled", replaced.Query.Desc)
+	assert.Equal(suite.T(), created.CreDat, replaced.CreDat)
+
+	status, _ = serve(http.MethodPut, "/api/queries/"+getExampleHash(), `{"query": {"desc": "config"}}`)
+	assert.Equal(suite.T(), http.StatusNotFound, status)
+	status, _ = serve(http.MethodPost, "/api/queries/unknown/search", "")
+	assert.Equal(suite.T(), http.StatusNotFound, status)
+
+	status, _ = serve(http.MethodDelete, "/api/queries/"+created.Id, "")
+	assert.Equal(suite.T(), http.StatusNoContent, status)
+	status, _ = serve(http.MethodDelete, "/api/queries/"+created.Id, "")
+	assert.Equal(suite.T(), http.StatusNotFound, status)
+}
+
+func (suite *PersistenceSuite) Test_apiHandler_queryLastRun() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery()}}
+	now := time.Now().UTC().Round(time.Millisecond)
+	assert.NoError(suite.T(), updateSearchOperation(ctx, getExampleHash(), getExampleQuery(), &now))
+	recorder := httptest.NewRecorder()
+
+	NewApiHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/queries/"+getExampleHash(), nil))
+
+	assert.Equal(suite.T(), http.StatusOK, recorder.Code)
+	response := queryResponse{}
+	assert.NoError(suite.T(), json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(suite.T(), &now, response.LastRun)
+}
@@ -0,0 +1,402 @@
+package crawler
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupVersion is the version of the archive layout. Restore rejects archives of other versions.
+const backupVersion = 1
+
+const (
+	backupManifestName = "manifest.json"
+	// restoreBatchSize is the number of documents inserted at once on restore.
+	restoreBatchSize = 1000
+	// maxDocumentSize is the maximum size of a MongoDB document, which bounds the length of a line of a backup.
+	maxDocumentSize = 16 * 1024 * 1024
+)
+
+// backupCollections are backed up under their logical name, so they can be restored into collections configured with
+// other names.
+var backupCollections = []struct {
+	name       string
+	collection func() (*mongo.Collection, error)
+}{
+	{"postings", postingsCollection},
+	{"operations", operationsCollection},
+	{"crawls", crawlsCollection},
+	{"watermarks", watermarksCollection},
+	{"outlets", outletsCollection},
+	{"categories", categoriesCollection},
+	{"reference_counts", referenceCountsCollection},
+	{"products", productsCollection},
+	{"queries", queriesCollection},
+	{"runs", runsCollection},
+}
+
+// backupManifest describes a backup archive. Each collection is stored in its own file as canonical extended json, one
+// document per line sorted by _id, so all types like dates are kept exactly. Sha256 is the checksum of that file.
+type backupManifest struct {
+	Version     int                `json:"version"`
+	Created     time.Time          `json:"created"`
+	Collections []backupCollection `json:"collections"`
+}
+
+type backupCollection struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Count  int    `json:"count"`
+	Sha256 string `json:"sha256"`
+}
+
+// Backup writes all collections into a zip archive at path. The archive is written to a temporary file first, so an
+// existing backup is only replaced by a complete one.
+func Backup(ctx context.Context, path string) error {
+	start := time.Now()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	manifest := backupManifest{Version: backupVersion, Created: time.Now().UTC().Round(time.Millisecond), Collections: []backupCollection{}}
+	zw := zip.NewWriter(tmp)
+	for _, bc := range backupCollections {
+		collection, err := bc.collection()
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		file := bc.name + ".jsonl"
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Modified: manifest.Created})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		count, checksum, err := dumpCollection(ctx, collection, w)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		log.Infof("Backed up %d documents of %s.", count, bc.name)
+		manifest.Collections = append(manifest.Collections, backupCollection{Name: bc.name, File: file, Count: count, Sha256: checksum})
+	}
+	if err := writeManifest(zw, manifest); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Infof("Wrote backup '%s' in %.2fs.", path, time.Since(start).Seconds())
+	return nil
+}
+
+// Restore writes the collections of the backup at path into the configured storage and verifies the restored
+// collections against the counts and checksums of the backup. Nothing is restored if the backup is corrupt or if a
+// collection is not empty, unless replace is set. Each collection is loaded into a temporary collection first, which
+// replaces it once all collections are loaded, so a restore failing or cancelled while loading keeps the previous
+// state. The collections are replaced one after another, so a failure while replacing leaves the collections replaced
+// so far restored and the others unchanged.
+func Restore(ctx context.Context, path string, replace bool) error {
+	archive, manifest, err := openBackup(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if err := verifyBackupFiles(archive, manifest); err != nil {
+		return err
+	}
+
+	collections := map[string]*mongo.Collection{}
+	for _, bc := range manifest.Collections {
+		collection, err := restoreTarget(bc.Name)
+		if err != nil {
+			return err
+		}
+		count, err := collection.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return storageError("count "+collection.Name(), err)
+		}
+		if count > 0 && !replace {
+			return fmt.Errorf("collection %s contains %d documents, restore with replace to delete them", collection.Name(), count)
+		}
+		collections[bc.Name] = collection
+	}
+
+	loaded := []*mongo.Collection{}
+	dropLoaded := func() {
+		for _, tmp := range loaded {
+			if err := tmp.Drop(uncancelable{ctx}); err != nil {
+				log.Errorf("Could not drop %s: %s", tmp.Name(), err)
+			}
+		}
+	}
+	for _, bc := range manifest.Collections {
+		tmp, err := loadRestoreCollection(ctx, archive, bc, collections[bc.Name])
+		if tmp != nil {
+			loaded = append(loaded, tmp)
+		}
+		if err != nil {
+			dropLoaded()
+			return err
+		}
+		log.Infof("Loaded %d documents of %s.", bc.Count, bc.Name)
+	}
+
+	for i, bc := range manifest.Collections {
+		if err := renameCollection(uncancelable{ctx}, loaded[i], collections[bc.Name]); err != nil {
+			// renamed collections are restored already, only the remaining temporary ones are dropped
+			loaded = loaded[i:]
+			dropLoaded()
+			return fmt.Errorf("restored %d of %d collections: %w", i, len(manifest.Collections), err)
+		}
+		log.Infof("Restored %d documents of %s.", bc.Count, bc.Name)
+	}
+	return verifyStorage(ctx, manifest)
+}
+
+// loadRestoreCollection loads the documents of the backup file into an empty temporary collection next to target,
+// which has the indexes of target. The temporary collection is returned even along with an error, so it can be dropped.
+func loadRestoreCollection(ctx context.Context, archive *zip.ReadCloser, bc backupCollection, target *mongo.Collection) (*mongo.Collection, error) {
+	db := target.Database()
+	tmp := db.Collection(target.Name() + "_restore")
+	if err := tmp.Drop(ctx); err != nil {
+		return nil, storageError("drop "+tmp.Name(), err)
+	}
+	if err := db.CreateCollection(ctx, tmp.Name()); err != nil {
+		return nil, storageError("create "+tmp.Name(), err)
+	}
+	if err := copyIndexes(ctx, target, tmp); err != nil {
+		return tmp, err
+	}
+	err := readBackupFile(archive, bc, func(batch []interface{}) error {
+		_, err := tmp.InsertMany(ctx, batch)
+		return storageError("restore "+tmp.Name(), err)
+	})
+	return tmp, err
+}
+
+// copyIndexes creates the indexes of from, except the one on _id, on to.
+func copyIndexes(ctx context.Context, from *mongo.Collection, to *mongo.Collection) error {
+	specs, err := from.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return storageError("list indexes of "+from.Name(), err)
+	}
+	models := []mongo.IndexModel{}
+	for _, spec := range specs {
+		if spec.Name == "_id_" {
+			continue
+		}
+		opts := options.Index().SetName(spec.Name)
+		if spec.Unique != nil {
+			opts.SetUnique(*spec.Unique)
+		}
+		if spec.Sparse != nil {
+			opts.SetSparse(*spec.Sparse)
+		}
+		if spec.ExpireAfterSeconds != nil {
+			opts.SetExpireAfterSeconds(*spec.ExpireAfterSeconds)
+		}
+		models = append(models, mongo.IndexModel{Keys: spec.KeysDocument, Options: opts})
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err = to.Indexes().CreateMany(ctx, models)
+	return storageError("create indexes of "+to.Name(), err)
+}
+
+// renameCollection replaces the collection to by from.
+func renameCollection(ctx context.Context, from *mongo.Collection, to *mongo.Collection) error {
+	db := from.Database()
+	command := bson.D{
+		{Key: "renameCollection", Value: db.Name() + "." + from.Name()},
+		{Key: "to", Value: to.Database().Name() + "." + to.Name()},
+		{Key: "dropTarget", Value: true},
+	}
+	err := db.Client().Database("admin").RunCommand(ctx, command).Err()
+	return storageError("rename "+from.Name()+" to "+to.Name(), err)
+}
+
+// VerifyBackup checks the files of the backup at path against its manifest and, if storage is set, compares the
+// configured storage with the backup, e.g. to check a restore or whether a backup is up to date.
+func VerifyBackup(ctx context.Context, path string, storage bool) error {
+	archive, manifest, err := openBackup(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if err := verifyBackupFiles(archive, manifest); err != nil {
+		return err
+	}
+	log.Infof("Backup '%s' of %s is complete.", path, manifest.Created.Format(time.RFC3339))
+	if !storage {
+		return nil
+	}
+	return verifyStorage(ctx, manifest)
+}
+
+// dumpCollection writes the documents of the collection sorted by _id and returns their count and checksum.
+func dumpCollection(ctx context.Context, collection *mongo.Collection, w io.Writer) (int, string, error) {
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, "", storageError("dump "+collection.Name(), err)
+	}
+	defer cur.Close(ctx)
+	checksum := sha256.New()
+	out := io.MultiWriter(w, checksum)
+	count := 0
+	for cur.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cur.Current, true, false)
+		if err != nil {
+			return count, "", err
+		}
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			return count, "", err
+		}
+		count++
+	}
+	if err := cur.Err(); err != nil {
+		return count, "", storageError("dump "+collection.Name(), err)
+	}
+	return count, hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// verifyStorage compares count and checksum of each collection in the storage with the manifest.
+func verifyStorage(ctx context.Context, manifest backupManifest) error {
+	for _, bc := range manifest.Collections {
+		collection, err := restoreTarget(bc.Name)
+		if err != nil {
+			return err
+		}
+		count, checksum, err := dumpCollection(ctx, collection, io.Discard)
+		if err != nil {
+			return err
+		}
+		if count != bc.Count || checksum != bc.Sha256 {
+			return fmt.Errorf("collection %s differs from backup: %d documents with checksum %s, expected %d with %s",
+				collection.Name(), count, checksum, bc.Count, bc.Sha256)
+		}
+	}
+	log.Infof("Storage matches backup of %s.", manifest.Created.Format(time.RFC3339))
+	return nil
+}
+
+func restoreTarget(name string) (*mongo.Collection, error) {
+	for _, bc := range backupCollections {
+		if bc.name == name {
+			return bc.collection()
+		}
+	}
+	return nil, fmt.Errorf("backup contains unknown collection '%s'", name)
+}
+
+func writeManifest(zw *zip.Writer, manifest backupManifest) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: backupManifestName, Method: zip.Deflate, Modified: manifest.Created})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+func openBackup(path string) (*zip.ReadCloser, backupManifest, error) {
+	manifest := backupManifest{}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, manifest, err
+	}
+	file, err := archive.Open(backupManifestName)
+	if err != nil {
+		archive.Close()
+		return nil, manifest, fmt.Errorf("backup '%s' has no manifest: %w", path, err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		archive.Close()
+		return nil, manifest, fmt.Errorf("backup '%s' has an invalid manifest: %w", path, err)
+	}
+	if manifest.Version != backupVersion {
+		archive.Close()
+		return nil, manifest, fmt.Errorf("backup '%s' has version %d, only version %d is supported", path, manifest.Version, backupVersion)
+	}
+	return archive, manifest, nil
+}
+
+func verifyBackupFiles(archive *zip.ReadCloser, manifest backupManifest) error {
+	for _, bc := range manifest.Collections {
+		if err := readBackupFile(archive, bc, func(batch []interface{}) error { return nil }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBackupFile passes the documents of the file in batches to insert and verifies count and checksum of the file.
+func readBackupFile(archive *zip.ReadCloser, bc backupCollection, insert func(batch []interface{}) error) error {
+	file, err := archive.Open(bc.File)
+	if err != nil {
+		return fmt.Errorf("backup misses %s: %w", bc.File, err)
+	}
+	defer file.Close()
+
+	checksum := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(file, checksum))
+	scanner.Buffer(make([]byte, 64*1024), maxDocumentSize*2)
+	count := 0
+	batch := []interface{}{}
+	for scanner.Scan() {
+		doc := bson.D{}
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return fmt.Errorf("invalid document %d of %s: %w", count+1, bc.File, err)
+		}
+		batch = append(batch, doc)
+		count++
+		if len(batch) == restoreBatchSize {
+			if err := insert(batch); err != nil {
+				return err
+			}
+			batch = []interface{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %w", bc.File, err)
+	}
+	if len(batch) > 0 {
+		if err := insert(batch); err != nil {
+			return err
+		}
+	}
+	return verifyChecksum(bc, count, checksum)
+}
+
+func verifyChecksum(bc backupCollection, count int, checksum hash.Hash) error {
+	sum := hex.EncodeToString(checksum.Sum(nil))
+	if count != bc.Count || sum != bc.Sha256 {
+		return fmt.Errorf("%s is corrupt: %d documents with checksum %s, expected %d with %s", bc.File, count, sum, bc.Count, bc.Sha256)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package crawler
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const backupPostingsLines = `{"_id":"a","active":true,"cre_dat":{"$date":{"$numberLong":"1648807200000"}}}
+{"_id":"b","active":false,"price":{"$numberDouble":"9.99"}}
+`
+
+// writeTestBackup writes a backup of the files with the manifest and returns its path.
+func writeTestBackup(t *testing.T, manifest backupManifest, files map[string]string) string {
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writeManifest(zw, manifest))
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, file.Close())
+	return path
+}
+
+func backupChecksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_readBackupFile(t *testing.T) {
+	bc := backupCollection{Name: "postings", File: "postings.jsonl", Count: 2, Sha256: backupChecksum(backupPostingsLines)}
+	path := writeTestBackup(t, backupManifest{Version: backupVersion, Collections: []backupCollection{bc}},
+		map[string]string{bc.File: backupPostingsLines})
+
+	archive, manifest, err := openBackup(path)
+	assert.NoError(t, err)
+	defer archive.Close()
+	assert.Equal(t, []backupCollection{bc}, manifest.Collections)
+
+	docs := []interface{}{}
+	err = readBackupFile(archive, bc, func(batch []interface{}) error {
+		docs = append(docs, batch...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+	created := docs[0].(bson.D).Map()["cre_dat"]
+	assert.Equal(t, parseDate("2022-04-01T10:00:00Z").UnixMilli(), int64(created.(primitive.DateTime)))
+	assert.Equal(t, false, docs[1].(bson.D).Map()["active"])
+	assert.Equal(t, 9.99, docs[1].(bson.D).Map()["price"])
+}
+
+func Test_readBackupFile_corrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		count   int
+		wantErr string
+	}{
+		{"missing document", strings.SplitAfter(backupPostingsLines, "\n")[0], 2, "postings.jsonl is corrupt: 1 documents"},
+		{"changed document", strings.Replace(backupPostingsLines, "9.99", "1.99", 1), 2, "postings.jsonl is corrupt: 2 documents"},
+		{"wrong count", backupPostingsLines, 3, "postings.jsonl is corrupt: 2 documents"},
+		{"invalid document", "{\"_id\":\n", 1, "invalid document 1 of postings.jsonl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := backupCollection{Name: "postings", File: "postings.jsonl", Count: tt.count, Sha256: backupChecksum(backupPostingsLines)}
+			path := writeTestBackup(t, backupManifest{Version: backupVersion, Collections: []backupCollection{bc}},
+				map[string]string{bc.File: tt.content})
+			archive, manifest, err := openBackup(path)
+			assert.NoError(t, err)
+			defer archive.Close()
+
+			err = verifyBackupFiles(archive, manifest)
+
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_readBackupFile_batches(t *testing.T) {
+	var content strings.Builder
+	for i := 0; i < restoreBatchSize+1; i++ {
+		content.WriteString(`{"_id":{"$numberInt":"` + strconv.Itoa(i) + `"}}` + "\n")
+	}
+	bc := backupCollection{Name: "postings", File: "postings.jsonl", Count: restoreBatchSize + 1, Sha256: backupChecksum(content.String())}
+	path := writeTestBackup(t, backupManifest{Version: backupVersion, Collections: []backupCollection{bc}},
+		map[string]string{bc.File: content.String()})
+	archive, _, err := openBackup(path)
+	assert.NoError(t, err)
+	defer archive.Close()
+
+	sizes := []int{}
+	err = readBackupFile(archive, bc, func(batch []interface{}) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{restoreBatchSize, 1}, sizes)
+}
+
+func Test_openBackup(t *testing.T) {
+	path := writeTestBackup(t, backupManifest{Version: backupVersion + 1}, nil)
+	_, _, err := openBackup(path)
+	assert.ErrorContains(t, err, "only version 1 is supported")
+
+	bc := backupCollection{Name: "postings", File: "postings.jsonl", Count: 2, Sha256: backupChecksum(backupPostingsLines)}
+	path = writeTestBackup(t, backupManifest{Version: backupVersion, Collections: []backupCollection{bc}}, nil)
+	archive, manifest, err := openBackup(path)
+	assert.NoError(t, err)
+	defer archive.Close()
+	assert.ErrorContains(t, verifyBackupFiles(archive, manifest), "backup misses postings.jsonl")
+
+	_, _, err = openBackup(filepath.Join(t.TempDir(), "missing.zip"))
+	assert.Error(t, err)
+}
+
+func (suite *PersistenceSuite) Test_Backup() {
+	path := filepath.Join(suite.T().TempDir(), "backup.zip")
+	before, err := FindOne(ctx, PID_NHL)
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), Backup(ctx, path))
+	assert.NoError(suite.T(), VerifyBackup(ctx, path, true))
+
+	clearAll()
+	assert.ErrorContains(suite.T(), VerifyBackup(ctx, path, true), "collection postings differs from backup")
+	assert.NoError(suite.T(), Restore(ctx, path, true))
+
+	after, err := FindOne(ctx, PID_NHL)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), before, after)
+	assert.False(suite.T(), after.Active)
+	collection, err := postingsCollection()
+	assert.NoError(suite.T(), err)
+	names, err := collection.Database().ListCollectionNames(ctx, bson.M{"name": bson.M{"$regex": "_restore$"}})
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), names)
+
+	err = Restore(ctx, path, false)
+	assert.ErrorContains(suite.T(), err, "restore with replace to delete them")
+}
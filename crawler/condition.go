@@ -0,0 +1,100 @@
+package crawler
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// condition is the normalized condition of a posting derived from its text.
+type condition string
+
+const (
+	conditionNew       condition = "new"
+	conditionOpenBox   condition = "open_box"
+	conditionDisplay   condition = "display"
+	conditionUsed      condition = "used"
+	conditionDefective condition = "defective"
+	conditionUnknown   condition = "unknown"
+)
+
+var conditions = []condition{conditionNew, conditionOpenBox, conditionDisplay, conditionUsed, conditionDefective, conditionUnknown}
+
+const (
+	flagMissingAccessories = "missing_accessories"
+	flagDamagedPackaging   = "damaged_packaging"
+	flagDisplayUnit        = "display_unit"
+)
+
+var conditionFlags = []string{flagMissingAccessories, flagDamagedPackaging, flagDisplayUnit}
+
+// conditionRule matches the text of a posting ignoring case. The condition of the first matching rule with a
+// condition wins, the flags of all matching rules are combined.
+type conditionRule struct {
+	Regex     string    `yaml:"regex"`
+	Condition condition `yaml:"condition"`
+	Flags     []string  `yaml:"flags"`
+}
+
+// defaultConditionRules cover the German texts of the Fundgrube. Worse conditions come first, so "Neu, Verpackung
+// beschädigt" is new with damaged packaging, but "Neuware, defekt" is defective.
+var defaultConditionRules = []conditionRule{
+	{Regex: `defekt|funktioniert nicht|ohne funktion|bastler`, Condition: conditionDefective},
+	{Regex: `gebraucht|gebrauchsspuren|kratzer|neuwertig`, Condition: conditionUsed},
+	{Regex: `ausstellungs(stück|gerät|ware)|displayger(ä|a)t|vorführ(gerät|ware)`, Condition: conditionDisplay, Flags: []string{flagDisplayUnit}},
+	{Regex: `b-ware|retoure|rückläufer|geöffnet|ausgepackt|originalverpackung fehlt|ohne (ovp|originalverpackung)`, Condition: conditionOpenBox},
+	{Regex: `\bneu(ware)?\b|originalverpackt|restposten`, Condition: conditionNew},
+	{Regex: `verpackungsschaden|verpackung[^.]{0,30}beschädigt|beschädigte verpackung`, Flags: []string{flagDamagedPackaging}},
+	{Regex: `zubehör[^.]{0,30}(fehlt|unvollständig)|ohne zubehör|unvollständig|fehlende[ns]? (zubehör|kabel|netzteil|fernbedienung)`, Flags: []string{flagMissingAccessories}},
+}
+
+var conditionRegexes sync.Map
+
+func (r conditionRule) regex() (*regexp.Regexp, error) {
+	if cached, ok := conditionRegexes.Load(r.Regex); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	regex, err := regexp.Compile("(?i)" + r.Regex)
+	if err != nil {
+		return nil, err
+	}
+	conditionRegexes.Store(r.Regex, regex)
+	return regex, nil
+}
+
+func (r conditionRule) validate() error {
+	if _, err := r.regex(); err != nil {
+		return fmt.Errorf("invalid condition rule regex '%s': %w", r.Regex, err)
+	}
+	if r.Condition != "" && !Contains(conditions, r.Condition) {
+		return fmt.Errorf("unknown condition '%s', expected one of %v", r.Condition, conditions)
+	}
+	for _, flag := range r.Flags {
+		if !Contains(conditionFlags, flag) {
+			return fmt.Errorf("unknown condition flag '%s', expected one of %v", flag, conditionFlags)
+		}
+	}
+	return nil
+}
+
+// classifyCondition derives the condition and flags of a posting text. The rules are tried before the default rules.
+// The flags are nil if no rule with flags matches, like they are loaded from the database.
+func classifyCondition(text string, rules []conditionRule) (condition, []string) {
+	result := conditionUnknown
+	var flags []string
+	for _, rule := range append(append([]conditionRule{}, rules...), defaultConditionRules...) {
+		regex, err := rule.regex()
+		if err != nil || !regex.MatchString(text) {
+			continue
+		}
+		if rule.Condition != "" && result == conditionUnknown {
+			result = rule.Condition
+		}
+		for _, flag := range rule.Flags {
+			if !Contains(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return result, flags
+}
@@ -0,0 +1,49 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_classifyCondition(t *testing.T) {
+	tests := []struct {
+		text      string
+		condition condition
+		flags     []string
+	}{
+		{"Neuware", conditionNew, nil},
+		{"Neu, Verpackungsschaden / Folie kann beschädigt sein. OVP", conditionNew, []string{flagDamagedPackaging}},
+		{"B-Ware", conditionOpenBox, nil},
+		{"Originalverpackung fehlt", conditionOpenBox, nil},
+		{"Ausstellungsstück", conditionDisplay, []string{flagDisplayUnit}},
+		{"Displaygerät, Zubehör unvollständig", conditionDisplay, []string{flagDisplayUnit, flagMissingAccessories}},
+		{"Gebrauchsspuren, ohne Zubehör", conditionUsed, []string{flagMissingAccessories}},
+		{"Neuware, Gerät defekt", conditionDefective, nil},
+		{"Neuigkeit", conditionUnknown, nil},
+		{"", conditionUnknown, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			c, flags := classifyCondition(tt.text, nil)
+			assert.Equal(t, tt.condition, c)
+			assert.Equal(t, tt.flags, flags)
+		})
+	}
+}
+
+func Test_classifyCondition_configuredRulesFirst(t *testing.T) {
+	rules := []conditionRule{{Regex: "restposten", Condition: conditionOpenBox, Flags: []string{flagDamagedPackaging}}}
+
+	c, flags := classifyCondition("Restposten", rules)
+
+	assert.Equal(t, conditionOpenBox, c)
+	assert.Equal(t, []string{flagDamagedPackaging}, flags)
+}
+
+func Test_conditionRule_validate(t *testing.T) {
+	assert.NoError(t, conditionRule{Regex: "ovp", Condition: conditionNew}.validate())
+	assert.NoError(t, conditionRule{Regex: "kratzer", Flags: []string{flagDamagedPackaging}}.validate())
+	assert.Error(t, conditionRule{Regex: "(ovp"}.validate())
+	assert.Error(t, conditionRule{Regex: "ovp", Condition: "mint"}.validate())
+	assert.Error(t, conditionRule{Regex: "ovp", Flags: []string{"scratched"}}.validate())
+}
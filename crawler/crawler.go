@@ -2,9 +2,11 @@ package crawler
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"fundgrube-crawler/alert"
 	log "github.com/sirupsen/logrus"
@@ -15,53 +17,219 @@ import (
 
 var CONFIG ConfigFile
 
-func RefreshAllPostings(mockedPostings bool) error {
-	stats := CrawlerStats{}
-	for _, shop := range []Shop{SATURN, MM} {
-		categories, err := fetchCategories(shop, mockedPostings)
+// RefreshAllPostings crawls every category of every shop. Failing categories are recorded in the returned report
+// and do not stop the remaining categories from being crawled. If ctx is done the crawl stops after the current unit
+// of work and ctx.Err() is returned along with the report of everything crawled so far. An ErrStorageUnavailable
+// stops the crawl as well.
+func RefreshAllPostings(ctx context.Context, mockedPostings bool) (*CrawlReport, error) {
+	report := CrawlReport{}
+	for _, shop := range CONFIG.shopIds() {
+		categories, err := fetchCategories(ctx, shop, mockedPostings)
+		if ctx.Err() != nil {
+			return &report, ctx.Err()
+		}
+		var storageErr *ErrStorageUnavailable
+		if errors.As(err, &storageErr) {
+			return &report, err
+		}
 		if err != nil {
-			return err
+			log.Errorf("Could not fetch categories for %s: %s", shop, err)
+			report.addError(shop, nil, err)
+			continue
 		}
 
-		categories = filterCategories(categories, CONFIG.GlobalConfig.BlacklistedCategories)
-
-		for _, c := range categories {
-			categoryStats, err := RefreshPostingsForCategory(shop, mockedPostings, c)
+		categories = filterCategories(categories, CONFIG.GlobalConfig.Categories, CONFIG.GlobalConfig.BlacklistedCategories)
+		if !envBool("IGNORE_CRAWL_INTERVALS") {
+			lastCrawls, err := findLastCrawls(ctx, shop)
 			if err != nil {
-				return err
+				return &report, err
 			}
-			stats.add(categoryStats)
+			dueCategories := filterDueCategories(categories, lastCrawls, CONFIG.GlobalConfig, time.Now())
+			report.Skipped += len(categories) - len(dueCategories)
+			categories = dueCategories
+		}
+
+		err = refreshCategories(ctx, shop, mockedPostings, categories, &report)
+		if err != nil {
+			return &report, err
 		}
 	}
 
-	log.Infof("Refreshed postings. %s", stats.String())
+	err := refreshProductsAfterCrawl(ctx)
+	if err != nil {
+		return &report, err
+	}
+	log.Infof("Refreshed postings. %s", report.String())
+	return &report, nil
+}
+
+// refreshCategories crawls the categories of a shop and adds the results to the report. Only a done ctx or an
+// ErrStorageUnavailable is returned, all other errors are recorded in the report.
+func refreshCategories(ctx context.Context, shop Shop, mockedPostings bool, categories []category, report *CrawlReport) error {
+	for _, c := range categories {
+		start := now()
+		categoryStats, err := RefreshPostingsForCategory(ctx, shop, mockedPostings, c)
+		report.addStats(shop, &c, categoryStats)
+		if ctx.Err() != nil {
+			log.Warnf("Cancelled crawling at '%s' for %s. %s", c.Name, shop, report.String())
+			return ctx.Err()
+		}
+		var storageErr *ErrStorageUnavailable
+		if errors.As(err, &storageErr) {
+			return err
+		}
+		if err != nil {
+			log.Errorf("Could not refresh '%s' for %s: %s", c.Name, shop, err)
+			report.addError(shop, &c, err)
+			continue
+		}
+		err = updateLastCrawl(uncancelable{ctx}, shop, c, start)
+		if err != nil {
+			return err
+		}
+		report.Categories++
+	}
 	return nil
 }
 
-func RefreshOnlyNewPostings() error {
+// RefreshOnlyNewPostings crawls the newest postings of each shop until the watermark of the previous run is reached.
+// If the watermark is not found, the categories whose posting count differs from the stored active postings are
+// crawled completely to catch up on postings that might have been missed.
+func RefreshOnlyNewPostings(ctx context.Context) (*CrawlReport, error) {
 	log.Info("Fetching only new Postings.")
-	stats := CrawlerStats{}
-	for _, shop := range []Shop{SATURN, MM} {
-		shopStats, err := refreshOnlyNewPostingsForShop(shop)
+	report := CrawlReport{}
+	for _, shop := range CONFIG.shopIds() {
+		shopStats, reached, err := refreshOnlyNewPostingsForShop(ctx, shop)
+		report.addStats(shop, nil, shopStats)
+		if ctx.Err() != nil {
+			log.Warnf("Cancelled fetching new postings of %s. %s", shop, report.String())
+			return &report, ctx.Err()
+		}
 		if err != nil {
-			return err
+			var storageErr *ErrStorageUnavailable
+			if errors.As(err, &storageErr) {
+				return &report, err
+			}
+			log.Errorf("Could not fetch new postings for %s: %s", shop, err)
+			report.addError(shop, nil, err)
+			continue
+		}
+
+		if !reached {
+			err = refreshCategoriesWithNewPostings(ctx, shop, &report)
+			if err != nil {
+				return &report, err
+			}
 		}
-		stats.add(shopStats)
 	}
+
+	err := refreshProductsAfterCrawl(ctx)
+	if err != nil {
+		return &report, err
+	}
+	log.Infof("Refreshed new postings. %s", report.String())
+	return &report, nil
+}
+
+func refreshCategoriesWithNewPostings(ctx context.Context, shop Shop, report *CrawlReport) error {
+	categories, err := fetchCategories(ctx, shop, false)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var storageErr *ErrStorageUnavailable
+	if errors.As(err, &storageErr) {
+		return err
+	}
+	if err != nil {
+		log.Errorf("Could not fetch categories for %s: %s", shop, err)
+		report.addError(shop, nil, err)
+		return nil
+	}
+	activeCounts, err := countActivePostingsByCategory(ctx, shop)
+	if err != nil {
+		return err
+	}
+
+	categories = filterCategories(categories, CONFIG.GlobalConfig.Categories, CONFIG.GlobalConfig.BlacklistedCategories)
+	categories, missed := categoriesWithNewPostings(categories, activeCounts)
+	log.Warnf("Watermark of %s not found. Up to %d new postings might have been missed, crawling %d categories.", shop, missed, len(categories))
+
+	inserted := report.Stats.Inserted
+	err = refreshCategories(ctx, shop, false, categories, report)
+	log.Infof("Caught up on %d new postings of %s.", report.Stats.Inserted-inserted, shop)
+	return err
+}
+
+func refreshProductsAfterCrawl(ctx context.Context) error {
+	start := time.Now()
+	count, err := refreshProducts(uncancelable{ctx}, now())
+	if err != nil {
+		return err
+	}
+	log.Infof("Refreshed %d products in %.2fs.", count, time.Since(start).Seconds())
 	return nil
 }
 
-func SearchDeals() {
-	for _, query := range CONFIG.Queries {
-		searchDealsForSingleQuery(query)
+// SearchReport summarizes a search for deals of all queries.
+type SearchReport struct {
+	Queries       int `json:"queries" bson:"queries"`
+	Failed        int `json:"failed" bson:"failed"`
+	Matches       int `json:"matches" bson:"matches"`
+	Notifications int `json:"notifications" bson:"notifications"`
+}
+
+// SearchDeals runs the enabled stored queries and the queries of the config file, see searchableQueries. Queries that
+// were not run because ctx is done or failed keep their last search time, so they will pick up the same postings on
+// the next run. A failing query does not stop the remaining ones; the first error is returned along with the report
+// of all queries.
+func SearchDeals(ctx context.Context) (*SearchReport, error) {
+	report := SearchReport{}
+	if err := migrateConfigQueryIds(ctx); err != nil {
+		return &report, err
 	}
+	queries, err := searchableQueries(ctx)
+	if err != nil {
+		return &report, err
+	}
+	var firstErr error
+	for _, sq := range queries {
+		if ctx.Err() != nil {
+			return &report, ctx.Err()
+		}
+		report.Queries++
+		deals, err := searchDealsForSingleQuery(ctx, sq.Id, sq.Query)
+		report.Matches += len(deals)
+		if len(deals) > 0 {
+			report.Notifications++
+		}
+		if err != nil {
+			log.Errorf("Could not search deals for query '%s': %s", sq.Query.Desc, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			report.Failed++
+		}
+	}
+	if firstErr != nil {
+		return &report, fmt.Errorf("%d of %d queries failed: %w", report.Failed, len(queries), firstErr)
+	}
+	return &report, nil
 }
 
-func searchDealsForSingleQuery(query query) {
+// searchDealsForSingleQuery mails the new deals of the query since its last search and returns them. The last search
+// time is stored with the id of the query. Deals are only returned along with an error if they were mailed.
+func searchDealsForSingleQuery(ctx context.Context, id string, query query) ([]posting, error) {
 	var limit, offset int64 = 100, 0
 	deals := []posting{}
+	lastSearchTime, err := getLastSearchTime(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 	for true {
-		postings := FindAll(query, getLastSearchTime(query), limit, offset)
+		postings, err := FindAll(ctx, query, lastSearchTime, limit, offset)
+		if err != nil {
+			return nil, err
+		}
 		log.Infof("Found %d deals for query '%s'.", len(postings), query.Desc)
 		deals = append(deals, postings...)
 
@@ -70,14 +238,29 @@ func searchDealsForSingleQuery(query query) {
 		}
 		offset = offset + limit
 	}
+	deals = withDistances(query, deals)
+	histories, err := findPriceHistories(ctx, pimIds(deals))
+	if err != nil {
+		return nil, err
+	}
+	deals = rankDeals(query, deals, histories, time.Now())
+	queryMatches.WithLabelValues(id).Add(float64(len(deals)))
 	if len(deals) > 0 {
-		message := fmtDealsMessage(query, deals)
+		var products map[int]product
+		if query.GroupByProduct {
+			products, err = findProducts(ctx, pimIds(deals))
+			if err != nil {
+				return nil, err
+			}
+		}
+		message := fmtDealsMessage(query, deals, products)
 		err := alert.SendAlertMail(formatSubject(query, deals), message)
 		if err != nil {
-			log.Fatalf("Could not send deals via mail: %s", err)
+			return nil, fmt.Errorf("could not send deals via mail: %w", err)
 		}
+		queryNotifications.WithLabelValues(id).Inc()
 	}
-	updateSearchOperation(query, now())
+	return deals, updateSearchOperation(ctx, id, query, now())
 }
 
 func formatSubject(q query, deals []posting) string {
@@ -85,30 +268,31 @@ func formatSubject(q query, deals []posting) string {
 		return fmt.Sprintf("Found no deals for query '%s'. 😿", q.Desc)
 	}
 	deal := deals[0]
-	return fmt.Sprintf("Query '%s' matched by %s for %.2f€ in %s (%d deal(s) overall)", q.Desc, deal.Name, deal.Price, deal.Outlet.Name, len(deals))
+	return fmt.Sprintf("Query '%s' matched by %s for %s in %s (%d deal(s) overall)", q.Desc, deal.Name, formatPrice(deal.Price, deal.Currency), deal.Outlet.Name, len(deals))
 }
 
-func getLastSearchTime(q query) *time.Time {
+func getLastSearchTime(ctx context.Context, id string) (*time.Time, error) {
 	if envBool("FIND_ALL") {
-		return nil
+		return nil, nil
 	}
 
-	md5Hex := hashQuery(q)
-
-	op := findSearchOperation(md5Hex)
+	op, err := findSearchOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 	if op == nil {
-		return &time.Time{}
+		return &time.Time{}, nil
 	}
-	return op.Timestamp
+	return op.Timestamp, nil
 }
 
-func hashQuery(q query) string {
+func hashQuery(q query) (string, error) {
 	jsonBytes, err := json.Marshal(q)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	md5Bytes := md5.Sum(jsonBytes)
-	return hex.EncodeToString(md5Bytes[:])
+	return hex.EncodeToString(md5Bytes[:]), nil
 }
 
 func now() *time.Time {
@@ -116,12 +300,26 @@ func now() *time.Time {
 	return &now
 }
 
-func fmtDealsMessage(q query, deals []posting) string {
+// fmtDealsMessage lists the deals, or one entry per product along with its stats from products if the query groups
+// by product.
+func fmtDealsMessage(q query, deals []posting, products map[int]product) string {
 	var buffer bytes.Buffer
 
-	buffer.WriteString(fmt.Sprintf("Query '%s' matched by %d new deals.\n\n", q.Desc, len(deals)))
-	for _, deal := range deals {
-		buffer.WriteString(deal.String() + "\n\n")
+	if q.GroupByProduct {
+		groups := groupByProduct(deals)
+		buffer.WriteString(fmt.Sprintf("Query '%s' matched by %d new deals of %d products.\n\n", q.Desc, len(deals), len(groups)))
+		for _, g := range groups {
+			var p *product
+			if found, ok := products[g.PimId]; ok {
+				p = &found
+			}
+			buffer.WriteString(g.String(p) + "\n\n")
+		}
+	} else {
+		buffer.WriteString(fmt.Sprintf("Query '%s' matched by %d new deals.\n\n", q.Desc, len(deals)))
+		for _, deal := range deals {
+			buffer.WriteString(deal.String() + "\n\n")
+		}
 	}
 
 	message := buffer.String()
@@ -129,15 +327,25 @@ func fmtDealsMessage(q query, deals []posting) string {
 	return message
 }
 
-func GetConfigFromFile(yamlPath string) ConfigFile {
+func GetConfigFromFile(yamlPath string) (ConfigFile, error) {
 	yamlBytes, err := os.ReadFile(yamlPath)
 	if err != nil {
-		panic(err)
+		return ConfigFile{}, &ErrConfigInvalid{Path: yamlPath, Err: err}
 	}
 	cf := ConfigFile{}
 	err = yaml.Unmarshal(yamlBytes, &cf)
 	if err != nil {
-		panic(err)
+		return ConfigFile{}, &ErrConfigInvalid{Path: yamlPath, Err: err}
+	}
+	err = cf.validate()
+	if err != nil {
+		return ConfigFile{}, &ErrConfigInvalid{Path: yamlPath, Err: err}
+	}
+	for _, q := range cf.Queries {
+		if q.Id == "" {
+			log.Warnf("Query '%s' has no id. Its last search time is lost when it is edited.", q.Desc)
+		}
 	}
-	return cf
+	cf.locations = bundledOutletLocations.withConfigured(cf.GlobalConfig.OutletLocations)
+	return cf, nil
 }
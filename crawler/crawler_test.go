@@ -1,8 +1,12 @@
 package crawler
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func Test_hashQuery(t *testing.T) {
@@ -24,11 +28,126 @@ func Test_hashQuery(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equalf(t, tt.want, hashQuery(tt.args.q), "hashQuery(%v)", tt.args.q)
+			hash, err := hashQuery(tt.args.q)
+			assert.NoError(t, err)
+			assert.Equalf(t, tt.want, hash, "hashQuery(%v)", tt.args.q)
 		})
 	}
 }
 
+func TestCrawlReport_addError(t *testing.T) {
+	report := CrawlReport{Stats: CrawlerStats{Postings: 3}, Categories: 1}
+	assert.False(t, report.HasErrors())
+	assert.Equal(t, "categories: 1, skipped: 0, failed: 0, postings: 3, tookApi: 0.000s", report.String())
+
+	apiErr := errors.New("Http Status 500")
+	report.addError(MM, nil, apiErr)
+	report.addError(SATURN, &category{CategoryId: "CAT_ID", Name: "Gaming"}, apiErr)
+
+	assert.True(t, report.HasErrors())
+	assert.ErrorIs(t, report.Errors[1], apiErr)
+	assert.Equal(t, "categories: 1, skipped: 0, failed: 2, postings: 3, tookApi: 0.000s"+
+		"\n\t💥 MM: Http Status 500"+
+		"\n\t💥 SATURN 'Gaming' (CAT_ID): Http Status 500", report.String())
+}
+
+func TestCrawlReport_addStats(t *testing.T) {
+	report := CrawlReport{}
+
+	report.addStats(MM, &category{CategoryId: "CAT_ID", Name: "Gaming"}, &CrawlerStats{Postings: 3, Inserted: 1, TookApi: time.Second})
+	report.addStats(SATURN, nil, &CrawlerStats{Postings: 2, Updated: 2})
+	report.addStats(SATURN, nil, nil)
+
+	assert.Equal(t, CrawlerStats{Postings: 5, Inserted: 1, Updated: 2, TookApi: time.Second}, report.Stats)
+	assert.Equal(t, []CategoryStats{
+		{Shop: MM, CategoryId: "CAT_ID", CategoryName: "Gaming", Stats: CrawlerStats{Postings: 3, Inserted: 1, TookApi: time.Second}},
+		{Shop: SATURN, Stats: CrawlerStats{Postings: 2, Updated: 2}},
+	}, report.ByCategory)
+}
+
+func TestGetConfigFromFile_missingFile(t *testing.T) {
+	_, err := GetConfigFromFile("does-not-exist.yml")
+
+	var configErr *ErrConfigInvalid
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "does-not-exist.yml", configErr.Path)
+}
+
+func TestGetConfigFromFile(t *testing.T) {
+	yamlPath := filepath.Join(t.TempDir(), "config.yml")
+	yamlContent := `
+globalConfig:
+  categories: [ Gaming ]
+  crawlInterval: 1h
+  categoryIntervals:
+    Gaming: 10m
+shops:
+  - id: SATURN
+    disabled: true
+queries:
+  - desc: switch
+    name_regex: [ switch ]
+    shops: [ MM ]
+`
+	assert.NoError(t, os.WriteFile(yamlPath, []byte(yamlContent), 0644))
+
+	config, err := GetConfigFromFile(yamlPath)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Gaming"}, config.GlobalConfig.Categories)
+	assert.Equal(t, time.Hour, config.GlobalConfig.CrawlInterval)
+	assert.Equal(t, 10*time.Minute, config.GlobalConfig.crawlInterval(category{Name: "Gaming"}))
+	assert.Equal(t, []Shop{MM}, config.shopIds())
+	assert.Equal(t, []Shop{MM}, config.Queries[0].Shops)
+}
+
+func Test_query_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       query
+		wantErr bool
+	}{
+		{"empty", query{}, false},
+		{"id", query{Id: "switch_deals-2"}, false},
+		{"id with path", query{Id: "../x"}, true},
+		{"id with slash", query{Id: "a/b"}, true},
+		{"shipping type pickup", query{ShippingType: sPtr("pickup")}, false},
+		{"shipping type shipping", query{ShippingType: sPtr("shipping")}, false},
+		{"unknown shipping type", query{ShippingType: sPtr("drone")}, true},
+		{"outlet names", query{OutletNames: []string{"^Lübeck$", "Ham.*"}}, false},
+		{"invalid outlet name regex", query{OutletNames: []string{"(Lübeck"}}, true},
+		{"expr", query{Expr: sPtr(`name ~ "switch" AND NOT text ~ "defekt"`)}, false},
+		{"invalid expr", query{Expr: sPtr(`name ~ "switch" AND`)}, true},
+		{"conditions", query{Condition: []condition{conditionNew, conditionOpenBox}}, false},
+		{"unknown condition", query{Condition: []condition{"mint"}}, true},
+		{"sort", query{Sort: sPtr("saving")}, false},
+		{"unknown sort", query{Sort: sPtr("name")}, true},
+		{"percentile max", query{PercentileMax: fPtr(10)}, false},
+		{"percentile max above 100", query{PercentileMax: fPtr(110)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.q.validate()
+			assert.Equal(t, tt.wantErr, err != nil, "validate() = %v", err)
+		})
+	}
+}
+
+func Test_query_mergesSingleAndMultipleFilters(t *testing.T) {
+	q := query{
+		OutletId:      iPtr(111),
+		OutletIds:     []int{222},
+		OutletName:    sPtr("Neu-Isenburg"),
+		OutletNames:   []string{"^Lü"},
+		CategoryName:  sPtr("Gaming"),
+		CategoryNames: []string{"Haushalt"},
+	}
+
+	assert.Equal(t, []int{222, 111}, q.allOutletIds())
+	assert.Equal(t, []string{"^Lü", "^Neu-Isenburg$"}, q.outletNamePatterns())
+	assert.Equal(t, []string{"Haushalt", "Gaming"}, q.allCategoryNames())
+}
+
 func sPtr(s string) *string {
 	return &s
 }
@@ -0,0 +1,63 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownShop is returned for shops without a known base url.
+var ErrUnknownShop = errors.New("unknown shop")
+
+// ErrQueryNotFound is returned if there is no stored query with the given id.
+var ErrQueryNotFound = errors.New("query not found")
+
+// ErrRunNotFound is returned if there is no run with the given id.
+var ErrRunNotFound = errors.New("run not found")
+
+// ErrQueryInvalid is returned if a query to be stored does not pass validation.
+var ErrQueryInvalid = errors.New("invalid query")
+
+// ErrStorageUnavailable is returned if the database cannot be reached or an operation on it fails.
+type ErrStorageUnavailable struct {
+	Op  string
+	Err error
+}
+
+func (e *ErrStorageUnavailable) Error() string {
+	return fmt.Sprintf("storage unavailable on %s: %s", e.Op, e.Err)
+}
+
+func (e *ErrStorageUnavailable) Unwrap() error {
+	return e.Err
+}
+
+func storageError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ErrStorageUnavailable{Op: op, Err: err}
+}
+
+// ErrApiStatus is returned if the Fundgrube api answers with an unexpected http status.
+type ErrApiStatus struct {
+	Code int
+	URL  string
+}
+
+func (e *ErrApiStatus) Error() string {
+	return fmt.Sprintf("Http Status %d on call of '%s'", e.Code, e.URL)
+}
+
+// ErrConfigInvalid is returned if the config file cannot be read or contains invalid values.
+type ErrConfigInvalid struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrConfigInvalid) Error() string {
+	return fmt.Sprintf("invalid config '%s': %s", e.Path, e.Err)
+}
+
+func (e *ErrConfigInvalid) Unwrap() error {
+	return e.Err
+}
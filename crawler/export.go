@@ -0,0 +1,311 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportRowGroupSize is the number of postings in a row group of the columnar format.
+const exportRowGroupSize = 10000
+
+// exportField is a column of an export. Values are strings, numbers, bools, times or string slices.
+type exportField struct {
+	name  string
+	value func(p posting) interface{}
+}
+
+// exportFields are the columns in their export order, which does not depend on the order fields are selected in.
+var exportFields = []exportField{
+	{"id", func(p posting) interface{} { return p.PostingId }},
+	{"name", func(p posting) interface{} { return p.Name }},
+	{"brand", func(p posting) interface{} { return p.Brand.Name }},
+	{"price", func(p posting) interface{} { return p.Price }},
+	{"price_old", func(p posting) interface{} { return p.PriceOld }},
+	{"total_price", func(p posting) interface{} { return p.TotalPrice }},
+	{"saving", func(p posting) interface{} { return p.Saving }},
+	{"discount", func(p posting) interface{} { return p.DiscountInPercent }},
+	{"shipping_cost", func(p posting) interface{} { return p.ShippingCost }},
+	{"shipping_type", func(p posting) interface{} { return p.ShippingType }},
+	{"currency", func(p posting) interface{} { return p.Currency }},
+	{"shop", func(p posting) interface{} { return string(p.Shop) }},
+	{"outlet_id", func(p posting) interface{} { return p.Outlet.OutletId }},
+	{"outlet", func(p posting) interface{} { return p.Outlet.Name }},
+	{"category_id", func(p posting) interface{} { return p.CategoryId }},
+	{"category", func(p posting) interface{} { return p.CategoryName }},
+	{"pim_id", func(p posting) interface{} { return p.PimId }},
+	{"condition", func(p posting) interface{} { return string(p.Condition) }},
+	{"condition_flags", func(p posting) interface{} { return p.ConditionFlags }},
+	{"efficiency_class", func(p posting) interface{} {
+		if p.EnergyLabel == nil {
+			return ""
+		}
+		return p.EnergyLabel.EfficiencyClass
+	}},
+	{"score", func(p posting) interface{} { return p.Score }},
+	{"active", func(p posting) interface{} { return p.Active }},
+	{"created", func(p posting) interface{} { return p.CreDat }},
+	{"modified", func(p posting) interface{} { return p.ModDat }},
+	{"shop_url", func(p posting) interface{} { return p.ShopUrl }},
+	{"image_urls", func(p posting) interface{} { return p.Url }},
+	{"text", func(p posting) interface{} { return p.Text }},
+}
+
+// exportFormats create a writer for the fields. Formats are "csv", "jsonl" and "columns".
+var exportFormats = map[string]func(w io.Writer, fields []exportField) postingWriter{
+	"csv":     newCsvWriter,
+	"jsonl":   newJsonLinesWriter,
+	"columns": newColumnsWriter,
+}
+
+// postingWriter writes postings one after another in an export format. close flushes buffered postings.
+type postingWriter interface {
+	write(p posting) error
+	close() error
+}
+
+// selectExportFields returns the fields with the given names in export order, all fields if names is empty.
+func selectExportFields(names []string) ([]exportField, error) {
+	if len(names) == 0 {
+		return exportFields, nil
+	}
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[strings.TrimSpace(name)] = true
+	}
+	fields := []exportField{}
+	for _, field := range exportFields {
+		if selected[field.name] {
+			fields = append(fields, field)
+			delete(selected, field.name)
+		}
+	}
+	for name := range selected {
+		return nil, fmt.Errorf("unknown field '%s'", name)
+	}
+	return fields, nil
+}
+
+// Export streams the postings matching the query given as yaml, written like a query of the config file, in the
+// format and returns their number. Inactive postings are exported if the query sets find_inactive. Postings are
+// decoded one after another, so exports of all postings do not need more memory than a single row group.
+func Export(ctx context.Context, w io.Writer, format string, fieldNames []string, yamlQuery []byte) (int, error) {
+	newWriter, ok := exportFormats[format]
+	if !ok {
+		return 0, fmt.Errorf("unknown format '%s'", format)
+	}
+	fields, err := selectExportFields(fieldNames)
+	if err != nil {
+		return 0, err
+	}
+	q, err := parseQueryYaml(yamlQuery)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.validate(); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrQueryInvalid, err)
+	}
+
+	buffered := bufio.NewWriter(w)
+	writer := newWriter(buffered, fields)
+	count := 0
+	// sorting all postings exceeds the memory limit of a sort in MongoDB
+	err = streamPostings(ctx, q, nil, options.Find().SetAllowDiskUse(true), func(p posting) error {
+		count++
+		return writer.write(p)
+	})
+	if err != nil {
+		return count, err
+	}
+	if err := writer.close(); err != nil {
+		return count, err
+	}
+	return count, buffered.Flush()
+}
+
+type csvWriter struct {
+	csv     *csv.Writer
+	fields  []exportField
+	started bool
+}
+
+func newCsvWriter(w io.Writer, fields []exportField) postingWriter {
+	return &csvWriter{csv: csv.NewWriter(w), fields: fields}
+}
+
+// write writes the header before the first posting. Lists are joined by "|".
+func (cw *csvWriter) write(p posting) error {
+	if !cw.started {
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	record := []string{}
+	for _, field := range cw.fields {
+		value, err := csvValue(field.value(p))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.name, err)
+		}
+		record = append(record, value)
+	}
+	return cw.csv.Write(record)
+}
+
+func (cw *csvWriter) writeHeader() error {
+	cw.started = true
+	header := []string{}
+	for _, field := range cw.fields {
+		header = append(header, field.name)
+	}
+	return cw.csv.Write(header)
+}
+
+func (cw *csvWriter) close() error {
+	if !cw.started {
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	cw.csv.Flush()
+	return cw.csv.Error()
+}
+
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case *time.Time:
+		if v == nil {
+			return "", nil
+		}
+		return v.UTC().Format(time.RFC3339), nil
+	case []string:
+		return strings.Join(v, "|"), nil
+	}
+	return "", fmt.Errorf("unsupported export value %T", value)
+}
+
+type jsonLinesWriter struct {
+	w      io.Writer
+	fields []exportField
+}
+
+func newJsonLinesWriter(w io.Writer, fields []exportField) postingWriter {
+	return &jsonLinesWriter{w: w, fields: fields}
+}
+
+// write writes a json object per line with its keys in export order.
+func (jw *jsonLinesWriter) write(p posting) error {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, field := range jw.fields {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		value, err := json.Marshal(jsonValue(field.value(p)))
+		if err != nil {
+			return err
+		}
+		line.WriteString(strconv.Quote(field.name) + ":")
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+	_, err := jw.w.Write(line.Bytes())
+	return err
+}
+
+func (jw *jsonLinesWriter) close() error {
+	return nil
+}
+
+// jsonValue writes missing times as null and missing lists as empty lists.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UTC().Format(time.RFC3339)
+	case []string:
+		if v == nil {
+			return []string{}
+		}
+	}
+	return value
+}
+
+// columnsWriter writes row groups of up to exportRowGroupSize postings, one json object per line like
+// `{"rows":2,"columns":{"id":["a","b"],"price":[1.5,2]}}`. Like Parquet, the values of a column are stored together,
+// while only a single row group is held in memory.
+type columnsWriter struct {
+	w        io.Writer
+	fields   []exportField
+	rowGroup [][]interface{}
+	rows     int
+}
+
+func newColumnsWriter(w io.Writer, fields []exportField) postingWriter {
+	cw := &columnsWriter{w: w, fields: fields}
+	cw.reset()
+	return cw
+}
+
+func (cw *columnsWriter) reset() {
+	cw.rowGroup = make([][]interface{}, len(cw.fields))
+	for i := range cw.rowGroup {
+		cw.rowGroup[i] = []interface{}{}
+	}
+	cw.rows = 0
+}
+
+func (cw *columnsWriter) write(p posting) error {
+	for i, field := range cw.fields {
+		cw.rowGroup[i] = append(cw.rowGroup[i], jsonValue(field.value(p)))
+	}
+	cw.rows++
+	if cw.rows == exportRowGroupSize {
+		return cw.flushRowGroup()
+	}
+	return nil
+}
+
+func (cw *columnsWriter) flushRowGroup() error {
+	var line bytes.Buffer
+	line.WriteString(fmt.Sprintf(`{"rows":%d,"columns":{`, cw.rows))
+	for i, field := range cw.fields {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		values, err := json.Marshal(cw.rowGroup[i])
+		if err != nil {
+			return err
+		}
+		line.WriteString(strconv.Quote(field.name) + ":")
+		line.Write(values)
+	}
+	line.WriteString("}}\n")
+	cw.reset()
+	_, err := cw.w.Write(line.Bytes())
+	return err
+}
+
+func (cw *columnsWriter) close() error {
+	if cw.rows == 0 {
+		return nil
+	}
+	return cw.flushRowGroup()
+}
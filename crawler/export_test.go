@@ -0,0 +1,122 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func exportExamplePostings() []posting {
+	switchPosting := getExamplePosting("switch")
+	switchPosting.Name = `Switch "OLED", weiß`
+	switchPosting.CreDat = parseDate("2022-04-01T10:00:00Z")
+	switchPosting.ConditionFlags = []string{flagDisplayUnit, flagDamagedPackaging}
+	return []posting{switchPosting, getExamplePosting("zelda")}
+}
+
+func writeAll(t *testing.T, format string, fieldNames []string, postings []posting) string {
+	fields, err := selectExportFields(fieldNames)
+	assert.NoError(t, err)
+	var buffer bytes.Buffer
+	writer := exportFormats[format](&buffer, fields)
+	for _, p := range postings {
+		assert.NoError(t, writer.write(p))
+	}
+	assert.NoError(t, writer.close())
+	return buffer.String()
+}
+
+func Test_selectExportFields(t *testing.T) {
+	fields, err := selectExportFields([]string{"price", " id", "name"})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, field := range fields {
+		names = append(names, field.name)
+	}
+	assert.Equal(t, []string{"id", "name", "price"}, names)
+
+	all, err := selectExportFields(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(exportFields), len(all))
+
+	_, err = selectExportFields([]string{"id", "color"})
+	assert.EqualError(t, err, "unknown field 'color'")
+}
+
+func Test_csvWriter(t *testing.T) {
+	out := writeAll(t, "csv", []string{"id", "name", "price", "active", "created", "condition_flags"}, exportExamplePostings())
+
+	assert.Equal(t, "id,name,price,condition_flags,active,created\n"+
+		"switch-id,\"Switch \"\"OLED\"\", weiß\",1337,display_unit|damaged_packaging,true,2022-04-01T10:00:00Z\n"+
+		"zelda-id,zelda,1337,,true,\n", out)
+}
+
+func Test_csvWriter_unsupportedValue(t *testing.T) {
+	cw := &csvWriter{csv: csv.NewWriter(io.Discard), fields: []exportField{{"outlet", func(p posting) interface{} { return p.Outlet }}}}
+
+	assert.ErrorContains(t, cw.write(posting{}), "field outlet: unsupported export value crawler.postingOutlet")
+}
+
+func Test_csvWriter_writesHeaderWithoutPostings(t *testing.T) {
+	assert.Equal(t, "id,price\n", writeAll(t, "csv", []string{"price", "id"}, []posting{}))
+}
+
+func Test_jsonLinesWriter(t *testing.T) {
+	out := writeAll(t, "jsonl", []string{"price", "id", "created", "condition_flags", "outlet_id"}, exportExamplePostings())
+
+	assert.Equal(t, `{"id":"switch-id","price":1337,"outlet_id":42,"condition_flags":["display_unit","damaged_packaging"],"created":"2022-04-01T10:00:00Z"}`+"\n"+
+		`{"id":"zelda-id","price":1337,"outlet_id":42,"condition_flags":[],"created":null}`+"\n", out)
+}
+
+func Test_columnsWriter(t *testing.T) {
+	out := writeAll(t, "columns", []string{"id", "price", "active"}, exportExamplePostings())
+
+	assert.Equal(t, `{"rows":2,"columns":{"id":["switch-id","zelda-id"],"price":[1337,1337],"active":[true,true]}}`+"\n", out)
+	assert.Equal(t, "", writeAll(t, "columns", []string{"id"}, []posting{}))
+}
+
+func Test_columnsWriter_splitsRowGroups(t *testing.T) {
+	postings := []posting{}
+	for i := 0; i < exportRowGroupSize+1; i++ {
+		postings = append(postings, getExamplePosting("p"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(writeAll(t, "columns", []string{"id"}, postings)), "\n")
+
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], `{"rows":10000,`))
+	assert.Equal(t, `{"rows":1,"columns":{"id":["p-id"]}}`, lines[1])
+}
+
+func Test_Export_invalid(t *testing.T) {
+	_, err := Export(ctx, &bytes.Buffer{}, "xlsx", nil, []byte("{}"))
+	assert.EqualError(t, err, "unknown format 'xlsx'")
+
+	_, err = Export(ctx, &bytes.Buffer{}, "csv", []string{"color"}, []byte("{}"))
+	assert.EqualError(t, err, "unknown field 'color'")
+
+	_, err = Export(ctx, &bytes.Buffer{}, "csv", nil, []byte("expr: 'price <'"))
+	assert.ErrorIs(t, err, ErrQueryInvalid)
+}
+
+func (suite *PersistenceSuite) Test_Export() {
+	var buffer bytes.Buffer
+
+	count, err := Export(ctx, &buffer, "csv", []string{"id", "active"}, []byte("find_inactive: true\nsort: newest\n"))
+
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4, count)
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(suite.T(), "id,active", lines[0])
+	assert.Len(suite.T(), lines, 5)
+	assert.Contains(suite.T(), lines, PID_NHL+",false")
+
+	buffer.Reset()
+	count, err = Export(ctx, &buffer, "jsonl", []string{"id"}, []byte("name_regex: [ nhl ]"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, count)
+	assert.Equal(suite.T(), "", buffer.String())
+}
@@ -0,0 +1,399 @@
+package crawler
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprNode is a parsed query expression like `name ~ "switch" AND (name ~ "oled" OR price < 250)`. It can be compiled
+// to a Mongo filter or evaluated for a single posting.
+type exprNode interface {
+	bson() bson.M
+	matches(p posting) bool
+}
+
+// exprField is a posting field usable in expressions. Numeric fields compare with numbers, all others with strings.
+type exprField struct {
+	key     string
+	numeric bool
+	str     func(p posting) string
+	num     func(p posting) float64
+}
+
+var exprFields = map[string]exprField{
+	"name":          {key: "name", str: func(p posting) string { return p.Name }},
+	"text":          {key: "text", str: func(p posting) string { return p.Text }},
+	"brand":         {key: "brand.name", str: func(p posting) string { return p.Brand.Name }},
+	"outlet":        {key: "outlet.name", str: func(p posting) string { return p.Outlet.Name }},
+	"shop":          {key: "shop", str: func(p posting) string { return string(p.Shop) }},
+	"category":      {key: "category_id", str: func(p posting) string { return p.CategoryId }},
+	"shipping_type": {key: "shipping_type", str: func(p posting) string { return p.ShippingType }},
+	"condition":     {key: "condition", str: func(p posting) string { return string(p.Condition) }},
+	"price":         {key: "price", numeric: true, num: func(p posting) float64 { return p.Price }},
+	"price_old":     {key: "price_old", numeric: true, num: func(p posting) float64 { return p.PriceOld }},
+	"total_price":   {key: "total_price", numeric: true, num: func(p posting) float64 { return p.TotalPrice }},
+	"saving":        {key: "saving", numeric: true, num: func(p posting) float64 { return p.Saving }},
+	"discount":      {key: "discount_in_percent", numeric: true, num: func(p posting) float64 { return float64(p.DiscountInPercent) }},
+	"shipping_cost": {key: "shipping_cost", numeric: true, num: func(p posting) float64 { return p.ShippingCost }},
+	"outlet_id":     {key: "outlet.id", numeric: true, num: func(p posting) float64 { return float64(p.Outlet.OutletId) }},
+}
+
+var exprOperators = map[string]string{
+	"=":  "$eq",
+	"!=": "$ne",
+	"<":  "$lt",
+	"<=": "$lte",
+	">":  "$gt",
+	">=": "$gte",
+}
+
+type andExpr []exprNode
+
+func (e andExpr) bson() bson.M {
+	return bson.M{"$and": nodesToBson(e)}
+}
+
+func (e andExpr) matches(p posting) bool {
+	for _, node := range e {
+		if !node.matches(p) {
+			return false
+		}
+	}
+	return true
+}
+
+type orExpr []exprNode
+
+func (e orExpr) bson() bson.M {
+	return bson.M{"$or": nodesToBson(e)}
+}
+
+func (e orExpr) matches(p posting) bool {
+	for _, node := range e {
+		if node.matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+type notExpr struct {
+	node exprNode
+}
+
+func (e notExpr) bson() bson.M {
+	// $not only applies to operators of a single field, $nor negates arbitrary filters.
+	return bson.M{"$nor": bson.A{e.node.bson()}}
+}
+
+func (e notExpr) matches(p posting) bool {
+	return !e.node.matches(p)
+}
+
+func nodesToBson(nodes []exprNode) bson.A {
+	ret := bson.A{}
+	for _, node := range nodes {
+		ret = append(ret, node.bson())
+	}
+	return ret
+}
+
+// comparison compares a field with a value. The operator ~ matches a regex ignoring case, !~ is its negation.
+type comparison struct {
+	field exprField
+	op    string
+	str   string
+	num   float64
+	regex *regexp.Regexp
+}
+
+func (c comparison) bson() bson.M {
+	switch c.op {
+	case "~":
+		return bson.M{c.field.key: bson.M{"$regex": primitive.Regex{Pattern: c.str, Options: "i"}}}
+	case "!~":
+		return bson.M{c.field.key: bson.M{"$not": primitive.Regex{Pattern: c.str, Options: "i"}}}
+	}
+	if c.field.numeric {
+		return bson.M{c.field.key: bson.M{exprOperators[c.op]: c.num}}
+	}
+	return bson.M{c.field.key: bson.M{exprOperators[c.op]: c.str}}
+}
+
+func (c comparison) matches(p posting) bool {
+	switch c.op {
+	case "~":
+		return c.regex.MatchString(c.field.str(p))
+	case "!~":
+		return !c.regex.MatchString(c.field.str(p))
+	}
+	if !c.field.numeric {
+		if c.op == "=" {
+			return c.field.str(p) == c.str
+		}
+		return c.field.str(p) != c.str
+	}
+	value := c.field.num(p)
+	switch c.op {
+	case "=":
+		return value == c.num
+	case "!=":
+		return value != c.num
+	case "<":
+		return value < c.num
+	case "<=":
+		return value <= c.num
+	case ">":
+		return value > c.num
+	}
+	return value >= c.num
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// parseExpr parses an expression. NOT binds stronger than AND, AND stronger than OR; keywords ignore case.
+func parseExpr(expr string) (exprNode, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.value, t.pos)
+	}
+	return node, nil
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.value, keyword)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []exprNode{node}
+	for p.isKeyword("OR") {
+		p.next()
+		node, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return orExpr(nodes), nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []exprNode{node}
+	for p.isKeyword("AND") {
+		p.next()
+		node, err = p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return andExpr(nodes), nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf("expected ')' at position %d", closing.pos)
+		}
+		return node, nil
+	case tokenIdent:
+		return p.parseComparison(t)
+	case tokenEnd:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected '%s' at position %d", t.value, t.pos)
+}
+
+func (p *exprParser) parseComparison(fieldToken token) (exprNode, error) {
+	field, ok := exprFields[strings.ToLower(fieldToken.value)]
+	if !ok {
+		return nil, fmt.Errorf("unknown field '%s' at position %d", fieldToken.value, fieldToken.pos)
+	}
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, fmt.Errorf("expected operator after '%s' at position %d", fieldToken.value, op.pos)
+	}
+	value := p.next()
+	c := comparison{field: field, op: op.value}
+
+	switch {
+	case op.value == "~" || op.value == "!~":
+		if field.numeric {
+			return nil, fmt.Errorf("operator %s needs a text field, '%s' is numeric", op.value, fieldToken.value)
+		}
+		if value.kind != tokenString {
+			return nil, fmt.Errorf("expected a quoted regex at position %d", value.pos)
+		}
+		regex, err := regexp.Compile("(?i)" + value.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex at position %d: %w", value.pos, err)
+		}
+		c.str = value.value
+		c.regex = regex
+	case field.numeric:
+		if value.kind != tokenNumber {
+			return nil, fmt.Errorf("expected a number at position %d", value.pos)
+		}
+		num, err := strconv.ParseFloat(value.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at position %d: %w", value.pos, err)
+		}
+		c.num = num
+	default:
+		if op.value != "=" && op.value != "!=" {
+			return nil, fmt.Errorf("operator %s needs a numeric field, '%s' is text", op.value, fieldToken.value)
+		}
+		if value.kind != tokenString {
+			return nil, fmt.Errorf("expected a quoted string at position %d", value.pos)
+		}
+		c.str = value.value
+	}
+	return c, nil
+}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		case r == '"':
+			value, end, err := readString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, value, i})
+			i = end
+		case strings.ContainsRune("~=<>!", r):
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '!' && runes[i+1] == '~')) {
+				op += string(runes[i+1])
+			}
+			if _, ok := exprOperators[op]; !ok && op != "~" && op != "!~" {
+				return nil, fmt.Errorf("unknown operator '%s' at position %d", op, i)
+			}
+			tokens = append(tokens, token{tokenOperator, op, i})
+			i += len([]rune(op))
+		case unicode.IsDigit(r) || r == '-' || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || (i == start && runes[i] == '-')) {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at position %d", r, i)
+		}
+	}
+	return append(tokens, token{tokenEnd, "", len(runes)}), nil
+}
+
+// readString reads a double-quoted string starting at runes[start]. Only \" and \\ are unescaped, so regexes like
+// "\d+" can be written without doubling the backslash.
+func readString(runes []rune, start int) (string, int, error) {
+	var sb strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		switch {
+		case runes[i] == '"':
+			return sb.String(), i + 1, nil
+		case runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\'):
+			sb.WriteRune(runes[i+1])
+			i++
+		default:
+			sb.WriteRune(runes[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d", start)
+}
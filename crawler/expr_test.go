@@ -0,0 +1,74 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func Test_parseExpr_matches(t *testing.T) {
+	oled := posting{Name: "Nintendo Switch OLED", Price: 299, Text: "Neuware"}
+	lite := posting{Name: "Nintendo Switch Lite", Price: 179, Text: "Displaygerät"}
+	broken := posting{Name: "Nintendo Switch", Price: 149, Text: "Gerät defekt"}
+	tests := []struct {
+		expr string
+		want []bool
+	}{
+		{`name ~ "switch"`, []bool{true, true, true}},
+		{`name ~ "switch" AND (name ~ "oled" OR price < 250) AND NOT text ~ "defekt"`, []bool{true, true, false}},
+		{`name ~ "oled" or text ~ "display"`, []bool{true, true, false}},
+		{`NOT NOT name ~ "lite"`, []bool{false, true, false}},
+		{`text !~ "defekt" AND price >= 179`, []bool{true, true, false}},
+		{`price = 149 OR price > 250`, []bool{true, false, true}},
+		{`text = "Neuware"`, []bool{true, false, false}},
+		{`text != "Neuware"`, []bool{false, true, true}},
+		{`name ~ "switch\s+\w+$"`, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			node, err := parseExpr(tt.expr)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, []bool{node.matches(oled), node.matches(lite), node.matches(broken)})
+		})
+	}
+}
+
+func Test_parseExpr_errors(t *testing.T) {
+	tests := []string{
+		``,
+		`name`,
+		`name ~`,
+		`name ~ switch`,
+		`color ~ "red"`,
+		`price ~ "1"`,
+		`price < "1"`,
+		`name < "b"`,
+		`name ~ "(oled"`,
+		`name ~ "oled`,
+		`(name ~ "oled"`,
+		`name ~ "oled" name ~ "lite"`,
+		`name == "oled"`,
+		`name ~ "oled" AND`,
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			_, err := parseExpr(expr)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_parseExpr_bson(t *testing.T) {
+	node, err := parseExpr(`name ~ "switch" AND (price <= 250 OR NOT shop = "MM")`)
+	assert.NoError(t, err)
+
+	expected := bson.M{"$and": bson.A{
+		bson.M{"name": bson.M{"$regex": primitive.Regex{Pattern: "switch", Options: "i"}}},
+		bson.M{"$or": bson.A{
+			bson.M{"price": bson.M{"$lte": 250.0}},
+			bson.M{"$nor": bson.A{bson.M{"shop": bson.M{"$eq": "MM"}}}},
+		}},
+	}}
+	assert.Equal(t, expected, node.bson())
+}
@@ -0,0 +1,224 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// feedSize is the number of newest postings in a feed.
+const feedSize = 50
+
+// feedIdPrefix makes the ids of feeds and entries globally unique tag URIs, see RFC 4151. Entry ids only depend on the
+// posting id, so feed readers recognize a posting in every feed and after it changed.
+const feedIdPrefix = "tag:fundgrube-crawler,2022:"
+
+const atomContentType = "application/atom+xml; charset=utf-8"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Links     []atomLink  `xml:"link"`
+	Summary   atomContent `xml:"summary"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+var feedSummaryTemplate = template.Must(template.New("summary").Funcs(webTemplateFuncs).Parse(
+	`{{if .Url}}<p><img src="{{index .Url 0}}" alt=""></p>{{end}}` +
+		`<p><b>{{price .Price .Currency}}</b>{{if .PriceOld}} instead of {{price .PriceOld .Currency}} (-{{.DiscountInPercent}}%){{end}}` +
+		`{{if eq .ShippingType "shipping"}}, shipping +{{price .ShippingCost .Currency}}{{end}}</p>` +
+		`<p>{{.Shop}} {{.Outlet.Name}}{{if .Condition}}, condition {{.Condition}}{{end}}</p>` +
+		`{{with .History}}<p>📉 {{.String $.Price $.Currency}}</p>{{end}}` +
+		`<p>{{.Text}}</p>`))
+
+// NewFeedHandler serves Atom feeds of the newest postings at `/feeds/postings.atom` and of the newest matches of a
+// query at `/feeds/queries/{id}.atom`. The matches of a query are filtered like its alerts.
+func NewFeedHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feeds/postings.atom", allowFeedMethod(handlePostingsFeed))
+	mux.HandleFunc("/feeds/queries/", allowFeedMethod(handleQueryFeed))
+	return mux
+}
+
+func allowFeedMethod(handler func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := handler(w, r); err != nil {
+			status := http.StatusInternalServerError
+			var storageErr *ErrStorageUnavailable
+			switch {
+			case errors.Is(err, ErrQueryNotFound):
+				status = http.StatusNotFound
+			case errors.As(err, &storageErr):
+				status = http.StatusServiceUnavailable
+			}
+			if status >= http.StatusInternalServerError {
+				log.Errorf("%s %s failed: %s", r.Method, r.URL.Path, err)
+			}
+			http.Error(w, err.Error(), status)
+		}
+	}
+}
+
+func handlePostingsFeed(w http.ResponseWriter, r *http.Request) error {
+	newest := "newest"
+	postings, err := FindAll(r.Context(), query{Sort: &newest}, nil, feedSize, 0)
+	if err != nil {
+		return err
+	}
+	return writeFeed(w, toAtomFeed("postings", "Fundgrube: new postings", feedUrl(r), postings, time.Now()))
+}
+
+func handleQueryFeed(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/feeds/queries/")
+	if !strings.HasSuffix(id, ".atom") {
+		http.NotFound(w, r)
+		return nil
+	}
+	sq, err := findQuery(r.Context(), strings.TrimSuffix(id, ".atom"))
+	if err != nil {
+		return err
+	}
+
+	q := sq.Query
+	newest := "newest"
+	q.Sort = &newest
+	postings, err := FindAll(r.Context(), q, nil, feedSize, 0)
+	if err != nil {
+		return err
+	}
+	postings = withDistances(q, postings)
+	histories, err := findPriceHistories(r.Context(), pimIds(postings))
+	if err != nil {
+		return err
+	}
+	postings = rankDeals(q, postings, histories, time.Now())
+	return writeFeed(w, toAtomFeed("query/"+sq.Id, fmt.Sprintf("Fundgrube: %s", q.Desc), feedUrl(r), postings, time.Now()))
+}
+
+// toAtomFeed lists the postings as entries. The feed is updated with its newest entry, or now if it is empty.
+func toAtomFeed(id string, title string, selfUrl string, postings []posting, now time.Time) atomFeed {
+	feed := atomFeed{
+		Id:      feedIdPrefix + id,
+		Title:   title,
+		Updated: now.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Href: selfUrl, Type: "application/atom+xml"}},
+		Author:  atomAuthor{Name: "fundgrube-crawler"},
+		Entries: []atomEntry{},
+	}
+	var newest *time.Time
+	for _, p := range postings {
+		feed.Entries = append(feed.Entries, toAtomEntry(p, now))
+		if updated := postingUpdated(p); updated != nil && (newest == nil || updated.After(*newest)) {
+			newest = updated
+		}
+	}
+	if newest != nil {
+		feed.Updated = newest.UTC().Format(time.RFC3339)
+	}
+	return feed
+}
+
+func toAtomEntry(p posting, now time.Time) atomEntry {
+	title := fmt.Sprintf("%s %s", formatPrice(p.Price, p.Currency), p.Name)
+	if p.Outlet.Name != "" {
+		title = fmt.Sprintf("%s (%s)", title, p.Outlet.Name)
+	}
+	entry := atomEntry{
+		Id:      feedIdPrefix + "posting/" + p.PostingId,
+		Title:   title,
+		Updated: now.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Href: p.ShopUrl, Type: "text/html"}},
+	}
+	if updated := postingUpdated(p); updated != nil {
+		entry.Updated = updated.UTC().Format(time.RFC3339)
+	}
+	if p.CreDat != nil {
+		entry.Published = p.CreDat.UTC().Format(time.RFC3339)
+	}
+	if len(p.Url) > 0 {
+		entry.Links = append(entry.Links, atomLink{Rel: "enclosure", Href: p.Url[0], Type: imageType(p.Url[0])})
+	}
+
+	var summary bytes.Buffer
+	if err := feedSummaryTemplate.Execute(&summary, p); err != nil {
+		log.Errorf("Could not render feed entry of posting '%s': %s", p.PostingId, err)
+	}
+	entry.Summary = atomContent{Type: "html", Body: summary.String()}
+	return entry
+}
+
+func postingUpdated(p posting) *time.Time {
+	if p.ModDat != nil {
+		return p.ModDat
+	}
+	return p.CreDat
+}
+
+// imageType guesses the media type of an image from its url, since enclosures should name their type.
+func imageType(url string) string {
+	path := strings.ToLower(strings.SplitN(url, "?", 2)[0])
+	switch {
+	case strings.HasSuffix(path, ".png"):
+		return "image/png"
+	case strings.HasSuffix(path, ".webp"):
+		return "image/webp"
+	case strings.HasSuffix(path, ".gif"):
+		return "image/gif"
+	}
+	return "image/jpeg"
+}
+
+func feedUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+}
+
+func writeFeed(w http.ResponseWriter, feed atomFeed) error {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", atomContentType)
+	_, err = w.Write(append([]byte(xml.Header), body...))
+	return err
+}
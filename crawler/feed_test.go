@@ -0,0 +1,112 @@
+package crawler
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_toAtomFeed(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	older := getExamplePosting("older")
+	older.CreDat = parseDate("2022-04-01T10:00:00Z")
+	older.ModDat = parseDate("2022-04-02T10:00:00Z")
+	newer := getExamplePosting("newer")
+	newer.Url = []string{"https://assets.mmsrg.com/newer.png?x=1"}
+	newer.ShopUrl = "https://www.mediamarkt.de/newer"
+	newer.Currency = "EUR"
+	newer.CreDat = parseDate("2022-04-03T10:00:00Z")
+
+	feed := toAtomFeed("query/abc", "Fundgrube: switch", "http://localhost/feeds/queries/abc.atom", []posting{newer, older}, now)
+
+	assert.Equal(t, "tag:fundgrube-crawler,2022:query/abc", feed.Id)
+	assert.Equal(t, "2022-04-03T10:00:00Z", feed.Updated)
+	assert.Equal(t, []atomLink{{Rel: "self", Href: "http://localhost/feeds/queries/abc.atom", Type: "application/atom+xml"}}, feed.Links)
+	assert.Len(t, feed.Entries, 2)
+
+	entry := feed.Entries[0]
+	assert.Equal(t, "tag:fundgrube-crawler,2022:posting/newer-id", entry.Id)
+	assert.Equal(t, "1337.00€ newer (outlet)", entry.Title)
+	assert.Equal(t, "2022-04-03T10:00:00Z", entry.Updated)
+	assert.Equal(t, "2022-04-03T10:00:00Z", entry.Published)
+	assert.Equal(t, []atomLink{
+		{Rel: "alternate", Href: "https://www.mediamarkt.de/newer", Type: "text/html"},
+		{Rel: "enclosure", Href: "https://assets.mmsrg.com/newer.png?x=1", Type: "image/png"},
+	}, entry.Links)
+	assert.Equal(t, "html", entry.Summary.Type)
+	assert.Contains(t, entry.Summary.Body, `<img src="https://assets.mmsrg.com/newer.png?x=1" alt="">`)
+	assert.Contains(t, entry.Summary.Body, "<b>1337.00€</b> instead of 1338.00€ (-1%)")
+	assert.Equal(t, "2022-04-02T10:00:00Z", feed.Entries[1].Updated)
+}
+
+func Test_toAtomFeed_empty(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	feed := toAtomFeed("postings", "Fundgrube: new postings", "http://localhost/feeds/postings.atom", []posting{}, now)
+	body, err := xml.Marshal(feed)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2022-05-01T12:00:00Z", feed.Updated)
+	assert.Contains(t, string(body), `<feed xmlns="http://www.w3.org/2005/Atom"><id>tag:fundgrube-crawler,2022:postings</id>`)
+}
+
+func Test_imageType(t *testing.T) {
+	assert.Equal(t, "image/jpeg", imageType("https://assets.mmsrg.com/isr/166325/c1/-/ASSET_MMS_1?x=450&y=450"))
+	assert.Equal(t, "image/png", imageType("https://example.com/a.PNG"))
+	assert.Equal(t, "image/webp", imageType("https://example.com/a.webp?format=png"))
+}
+
+func Test_feedHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{"wrong method", http.MethodPost, "/feeds/postings.atom", http.StatusMethodNotAllowed},
+		{"missing extension", http.MethodGet, "/feeds/queries/abc", http.StatusNotFound},
+		{"unknown feed", http.MethodGet, "/feeds/foo.atom", http.StatusNotFound},
+	}
+	handler := NewFeedHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+		})
+	}
+}
+
+func (suite *PersistenceSuite) Test_feedHandler_query() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	q := query{Desc: "switch", NameRegex: []string{"nintendo switch"}}
+	CONFIG = ConfigFile{Queries: []query{q}}
+	id, err := hashQuery(q)
+	assert.NoError(suite.T(), err)
+	recorder := httptest.NewRecorder()
+
+	NewFeedHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/feeds/queries/"+id+".atom", nil))
+
+	assert.Equal(suite.T(), http.StatusOK, recorder.Code)
+	assert.Equal(suite.T(), atomContentType, recorder.Header().Get("Content-Type"))
+	feed := atomFeed{}
+	assert.NoError(suite.T(), xml.Unmarshal(recorder.Body.Bytes(), &feed))
+	assert.Equal(suite.T(), "Fundgrube: switch", feed.Title)
+	ids := []string{}
+	for _, entry := range feed.Entries {
+		ids = append(ids, entry.Id)
+	}
+	assert.ElementsMatch(suite.T(), []string{feedIdPrefix + "posting/" + PID_CHEF_PARTY, feedIdPrefix + "posting/" + PID_NECRODANCER}, ids)
+}
+
+func (suite *PersistenceSuite) Test_feedHandler_unknownQuery() {
+	recorder := httptest.NewRecorder()
+
+	NewFeedHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/feeds/queries/unknown.atom", nil))
+
+	assert.Equal(suite.T(), http.StatusNotFound, recorder.Code)
+}
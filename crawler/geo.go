@@ -0,0 +1,226 @@
+package crawler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strings"
+	"sync"
+)
+
+// outletLocationsJson contains approximate coordinates of outlets. Only a few outlets are keyed by shop and outlet id,
+// most are located by the center of the city they are named like, e.g. "Hamburg-Altona", which is off by the size of
+// the city.
+//
+//go:embed outlet_locations.json
+var outletLocationsJson []byte
+
+// bundledOutletLocations is parsed once when the package is initialized.
+var bundledOutletLocations = parseOutletLocations(outletLocationsJson)
+
+// unlocatedOutlets holds the outlets already logged as having no location, so each is logged once.
+var unlocatedOutlets sync.Map
+
+const earthRadiusKm = 6371.0
+
+// outletLocation is the position of an outlet. Configured locations in globalConfig.outletLocations take precedence
+// over the bundled ones.
+type outletLocation struct {
+	Shop     Shop    `yaml:"shop" json:"shop,omitempty"`
+	OutletId int     `yaml:"outlet_id" json:"outlet_id,omitempty"`
+	Name     string  `yaml:"name" json:"name"`
+	Lat      float64 `yaml:"lat" json:"lat"`
+	Lon      float64 `yaml:"lon" json:"lon"`
+}
+
+// nearFilter matches postings of outlets within RadiusKm around either Lat/Lon or the location of Outlet. Outlets without
+// a configured location are mostly located by their city center, so distances are city-level approximations.
+type nearFilter struct {
+	Lat      *float64 `yaml:"lat" json:"lat,omitempty" bson:"lat"`
+	Lon      *float64 `yaml:"lon" json:"lon,omitempty" bson:"lon"`
+	Outlet   string   `yaml:"outlet" json:"outlet,omitempty" bson:"outlet"`
+	RadiusKm float64  `yaml:"radius_km" json:"radius_km,omitempty" bson:"radius_km"`
+}
+
+func (n nearFilter) validate() error {
+	if n.RadiusKm <= 0 {
+		return fmt.Errorf("near needs a positive radius_km")
+	}
+	_, _, err := n.center()
+	return err
+}
+
+// center returns the coordinates to measure distances from.
+func (n nearFilter) center() (float64, float64, error) {
+	if n.Lat != nil && n.Lon != nil {
+		return *n.Lat, *n.Lon, nil
+	}
+	if n.Outlet != "" {
+		location := findOutletLocation("", 0, n.Outlet)
+		if location == nil {
+			return 0, 0, fmt.Errorf("no location known for outlet '%s'", n.Outlet)
+		}
+		return location.Lat, location.Lon, nil
+	}
+	return 0, 0, fmt.Errorf("near needs either lat and lon or an outlet")
+}
+
+// distanceKm returns the distance of the outlet to the center or nil if its location is unknown.
+func (n nearFilter) distanceKm(shop Shop, outletId int, outletName string) *float64 {
+	lat, lon, err := n.center()
+	if err != nil {
+		return nil
+	}
+	location := findOutletLocation(shop, outletId, outletName)
+	if location == nil {
+		return nil
+	}
+	distance := haversineKm(lat, lon, location.Lat, location.Lon)
+	return &distance
+}
+
+// matches evaluates the filter for a posting without a database.
+func (n nearFilter) matches(p posting) bool {
+	distance := n.distanceKm(p.Shop, p.Outlet.OutletId, p.Outlet.Name)
+	return distance != nil && *distance <= n.RadiusKm
+}
+
+// outletsWithin returns the ids of the given outlets within the radius grouped by shop.
+func (n nearFilter) outletsWithin(outlets []outletReference) map[Shop][]int {
+	ret := map[Shop][]int{}
+	for _, o := range outlets {
+		distance := n.distanceKm(o.Shop, o.OutletId, o.Name)
+		if distance == nil {
+			if _, logged := unlocatedOutlets.LoadOrStore(outletKey{o.Shop, o.OutletId}, true); !logged {
+				log.Warnf("No location known for outlet '%s' (%s %d). Add it to globalConfig.outletLocations.", o.Name, o.Shop, o.OutletId)
+			}
+			continue
+		}
+		if *distance <= n.RadiusKm {
+			ret[o.Shop] = append(ret[o.Shop], o.OutletId)
+		}
+	}
+	return ret
+}
+
+// findOutletLocation looks up the location of an outlet by shop and id and falls back to its name. An empty shop only
+// looks up the name.
+func findOutletLocation(shop Shop, outletId int, name string) *outletLocation {
+	return CONFIG.outletLocations().find(shop, outletId, name)
+}
+
+type outletKey struct {
+	Shop     Shop
+	OutletId int
+}
+
+// outletLocations indexes the locations of outlets by shop and outlet id and keeps the city centers to fall back to.
+type outletLocations struct {
+	outlets map[outletKey]outletLocation
+	// named holds the outlets in order of precedence to look them up by name.
+	named  []outletLocation
+	cities []outletLocation
+}
+
+// parseOutletLocations parses the bundled outlet locations and panics if they are invalid.
+func parseOutletLocations(data []byte) *outletLocations {
+	var bundled struct {
+		Outlets []outletLocation `json:"outlets"`
+		Cities  []outletLocation `json:"cities"`
+	}
+	if err := json.Unmarshal(data, &bundled); err != nil {
+		panic(fmt.Sprintf("invalid bundled outlet locations: %s", err))
+	}
+	return (&outletLocations{outlets: map[outletKey]outletLocation{}, cities: bundled.Cities}).withConfigured(bundled.Outlets)
+}
+
+// withConfigured returns the locations merged with the configured ones, which take precedence. Configured locations
+// without shop are used as city centers.
+func (o *outletLocations) withConfigured(configured []outletLocation) *outletLocations {
+	merged := &outletLocations{outlets: map[outletKey]outletLocation{}}
+	for _, l := range configured {
+		if l.Shop == "" {
+			merged.cities = append(merged.cities, l)
+			continue
+		}
+		key := outletKey{l.Shop, l.OutletId}
+		if _, ok := merged.outlets[key]; !ok {
+			merged.outlets[key] = l
+			merged.named = append(merged.named, l)
+		}
+	}
+	for _, l := range o.named {
+		key := outletKey{l.Shop, l.OutletId}
+		if _, ok := merged.outlets[key]; !ok {
+			merged.outlets[key] = l
+			merged.named = append(merged.named, l)
+		}
+	}
+	merged.cities = append(merged.cities, o.cities...)
+	return merged
+}
+
+func (o *outletLocations) find(shop Shop, outletId int, name string) *outletLocation {
+	if shop != "" {
+		if l, ok := o.outlets[outletKey{shop, outletId}]; ok {
+			return &l
+		}
+	}
+	for _, l := range o.named {
+		if strings.EqualFold(l.Name, name) {
+			return &l
+		}
+	}
+	return o.findCity(name)
+}
+
+// findCity returns the city center of the longest city name the outlet name equals or starts with, followed by a
+// separator like in "Hamburg-Altona" or "Berlin Alexanderplatz".
+func (o *outletLocations) findCity(name string) *outletLocation {
+	var found *outletLocation
+	for i, l := range o.cities {
+		if !isCityOf(l.Name, name) {
+			continue
+		}
+		if found == nil || len(l.Name) > len(found.Name) {
+			found = &o.cities[i]
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	l := *found
+	return &l
+}
+
+func isCityOf(city string, name string) bool {
+	if len(name) < len(city) || !strings.EqualFold(name[:len(city)], city) {
+		return false
+	}
+	return len(name) == len(city) || strings.ContainsAny(name[len(city):len(city)+1], " -/(,")
+}
+
+func haversineKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// withDistances sets the distance of each posting to the center of the near filter of the query.
+func withDistances(q query, postings []posting) []posting {
+	if q.Near == nil {
+		return postings
+	}
+	for i, p := range postings {
+		postings[i].DistanceKm = q.Near.distanceKm(p.Shop, p.Outlet.OutletId, p.Outlet.Name)
+	}
+	return postings
+}
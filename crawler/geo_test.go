@@ -0,0 +1,78 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_haversineKm(t *testing.T) {
+	// Hannover to Braunschweig
+	assert.InDelta(t, 55.3, haversineKm(52.3759, 9.7320, 52.2689, 10.5268), 0.1)
+	assert.Equal(t, 0.0, haversineKm(52.3759, 9.7320, 52.3759, 9.7320))
+}
+
+func Test_bundledOutletLocations(t *testing.T) {
+	assert.NotEmpty(t, bundledOutletLocations.outlets)
+	assert.NotEmpty(t, bundledOutletLocations.cities)
+	for key, l := range bundledOutletLocations.outlets {
+		assert.Equal(t, outletKey{l.Shop, l.OutletId}, key)
+		assert.NotEmpty(t, l.Shop, l.Name)
+		assert.NotZero(t, l.OutletId, l.Name)
+	}
+	for _, l := range append(bundledOutletLocations.named, bundledOutletLocations.cities...) {
+		assert.NotEmpty(t, l.Name)
+		assert.InDelta(t, 51, l.Lat, 4, l.Name)
+		assert.InDelta(t, 10, l.Lon, 5, l.Name)
+	}
+}
+
+func Test_findOutletLocation(t *testing.T) {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{locations: bundledOutletLocations.withConfigured([]outletLocation{
+		{Shop: MM, OutletId: 475, Name: "Lübeck", Lat: 53.9, Lon: 10.7},
+		{Shop: SATURN, OutletId: 60, Name: "Braunschweig Schloss", Lat: 52.26, Lon: 10.52},
+		{Name: "Lüneburg", Lat: 53.25, Lon: 10.41},
+	})}
+
+	assert.Equal(t, &outletLocation{Shop: MM, OutletId: 475, Name: "Lübeck", Lat: 53.9, Lon: 10.7}, findOutletLocation(MM, 475, "Lübeck"))
+	assert.Equal(t, "Neu-Isenburg", findOutletLocation(SATURN, 67, "").Name)
+	assert.Equal(t, "Braunschweig Schloss", findOutletLocation(SATURN, 60, "Braunschweig").Name)
+	assert.Equal(t, "Hannover", findOutletLocation(MM, 1, "hannover").Name)
+	assert.Equal(t, "Hamburg", findOutletLocation(MM, 2, "Hamburg-Altona").Name)
+	assert.Equal(t, "Lüneburg", findOutletLocation(MM, 3, "Lüneburg (Bardowick)").Name)
+	assert.Equal(t, "Neu-Isenburg", findOutletLocation("", 0, "Neu-Isenburg").Name)
+	assert.Nil(t, findOutletLocation(MM, 4, "Hamburger Meile"))
+	assert.Nil(t, findOutletLocation(MM, 1, "Atlantis"))
+}
+
+func Test_nearFilter(t *testing.T) {
+	near := nearFilter{Outlet: "Hannover", RadiusKm: 60}
+	assert.NoError(t, near.validate())
+
+	assert.True(t, near.matches(posting{Shop: MM, Outlet: postingOutlet{1, "Braunschweig"}}))
+	assert.True(t, near.matches(posting{Shop: MM, Outlet: postingOutlet{2, "Hildesheim"}}))
+	assert.False(t, near.matches(posting{Shop: MM, Outlet: postingOutlet{3, "Hamburg"}}))
+	assert.False(t, near.matches(posting{Shop: MM, Outlet: postingOutlet{4, "Atlantis"}}))
+
+	assert.Equal(t, map[Shop][]int{MM: {1}, SATURN: {60}}, near.outletsWithin([]outletReference{
+		{Shop: MM, OutletId: 1, Name: "Braunschweig"},
+		{Shop: MM, OutletId: 3, Name: "Hamburg-Altona"},
+		{Shop: MM, OutletId: 4, Name: "Atlantis"},
+		{Shop: SATURN, OutletId: 60, Name: "Braunschweig"},
+	}))
+}
+
+func Test_nearFilter_validate(t *testing.T) {
+	assert.NoError(t, nearFilter{Lat: fPtr(52.37), Lon: fPtr(9.73), RadiusKm: 50}.validate())
+	assert.Error(t, nearFilter{Lat: fPtr(52.37), Lon: fPtr(9.73)}.validate())
+	assert.Error(t, nearFilter{Outlet: "Atlantis", RadiusKm: 50}.validate())
+	assert.Error(t, nearFilter{RadiusKm: 50}.validate())
+}
+
+func Test_withDistances(t *testing.T) {
+	q := query{Near: &nearFilter{Outlet: "Braunschweig", RadiusKm: 50}}
+	postings := withDistances(q, []posting{{Shop: SATURN, Outlet: postingOutlet{60, "Braunschweig"}}, {Outlet: postingOutlet{0, "Atlantis"}}})
+
+	assert.Equal(t, 0.0, *postings[0].DistanceKm)
+	assert.Nil(t, postings[1].DistanceKm)
+}
@@ -0,0 +1,124 @@
+package crawler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxHistoryPrices is the number of the cheapest prices kept in a price history, so a history stays small for products
+// with many postings.
+const maxHistoryPrices = 1000
+
+// priceHistory contains the prices of the stored postings of a product, active and inactive, sorted by price. Only the
+// cheapest maxHistoryPrices prices are kept, Count and Median are those of all postings.
+type priceHistory struct {
+	PimId  int               `bson:"_id"`
+	Prices []historicalPrice `bson:"prices"`
+	Count  int               `bson:"count"`
+	Median float64           `bson:"median"`
+}
+
+type historicalPrice struct {
+	PostingId string     `json:"posting_id" bson:"id"`
+	Price     float64    `json:"price" bson:"price"`
+	Date      *time.Time `json:"date" bson:"date"`
+	Outlet    string     `json:"outlet" bson:"outlet"`
+}
+
+// without returns the history without the posting, so a posting is compared to the other postings only. A posting
+// that is not among the kept prices of an incomplete history is assumed to be one of the others. The median is kept.
+func (h priceHistory) without(postingId string) priceHistory {
+	prices := []historicalPrice{}
+	for _, p := range h.Prices {
+		if p.PostingId != postingId {
+			prices = append(prices, p)
+		}
+	}
+	count := h.Count
+	if count > 0 && (len(prices) < len(h.Prices) || !h.complete()) {
+		count--
+	}
+	return priceHistory{PimId: h.PimId, Prices: prices, Count: count, Median: h.Median}
+}
+
+// complete returns whether the history keeps the prices of all postings.
+func (h priceHistory) complete() bool {
+	return h.Count <= len(h.Prices)
+}
+
+func (h priceHistory) lowest() historicalPrice {
+	return h.Prices[0]
+}
+
+func (h priceHistory) median() float64 {
+	if !h.complete() {
+		return h.Median
+	}
+	prices := []float64{}
+	for _, p := range h.Prices {
+		prices = append(prices, p.Price)
+	}
+	return toProduct(h.PimId, prices).MedianPrice
+}
+
+// percentile returns the share of historical prices lower than price in percent, 0 means cheaper than ever. Prices
+// above the kept prices of an incomplete history are ranked 100.
+func (h priceHistory) percentile(price float64) float64 {
+	lower := sort.Search(len(h.Prices), func(i int) bool {
+		return h.Prices[i].Price >= price
+	})
+	if lower == len(h.Prices) && !h.complete() {
+		return 100
+	}
+	count := h.Count
+	if h.complete() {
+		count = len(h.Prices)
+	}
+	return float64(lower) * 100 / float64(count)
+}
+
+func (h priceHistory) String(price float64, currency string) string {
+	lowest := h.lowest()
+	date := ""
+	if lowest.Date != nil {
+		date = lowest.Date.Format("2006-01-02") + ", "
+	}
+	ret := fmt.Sprintf("lowest seen: %s (%s%s)", formatPrice(lowest.Price, currency), date, lowest.Outlet)
+	median := h.median()
+	if median <= 0 {
+		return ret
+	}
+	if price > median {
+		return fmt.Sprintf("%s, %.0f%% above historical median", ret, (price-median)/median*100)
+	}
+	return fmt.Sprintf("%s, %.0f%% below historical median", ret, (median-price)/median*100)
+}
+
+// matchesHistory returns whether the price of the posting passes below_historical_min and percentile_max of the
+// query. Postings without history of other postings do not pass these options.
+func (q query) matchesHistory(p posting, history *priceHistory) bool {
+	if !q.BelowHistoricalMin && q.PercentileMax == nil {
+		return true
+	}
+	if history == nil {
+		return false
+	}
+	if q.BelowHistoricalMin && p.Price >= history.lowest().Price {
+		return false
+	}
+	return q.PercentileMax == nil || history.percentile(p.Price) <= *q.PercentileMax
+}
+
+// historyOf returns the history of the other postings of the product of p or nil if there are none.
+func historyOf(histories map[int]priceHistory, p posting) *priceHistory {
+	history, ok := histories[p.PimId]
+	if !ok || p.PimId == 0 {
+		return nil
+	}
+	history = history.without(p.PostingId)
+	if len(history.Prices) == 0 {
+		return nil
+	}
+	return &history
+}
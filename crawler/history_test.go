@@ -0,0 +1,87 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func examplePriceHistory() priceHistory {
+	return priceHistory{PimId: 1, Prices: []historicalPrice{
+		{PostingId: "a", Price: 129, Date: parseDate("2026-03-02T10:00:00Z"), Outlet: "Braunschweig"},
+		{PostingId: "b", Price: 149, Outlet: "Hannover"},
+		{PostingId: "c", Price: 199, Outlet: "Hamburg"},
+		{PostingId: "d", Price: 249, Outlet: "Kiel"},
+	}}
+}
+
+func Test_priceHistory(t *testing.T) {
+	h := examplePriceHistory()
+
+	assert.Equal(t, "Braunschweig", h.lowest().Outlet)
+	assert.Equal(t, 174.0, h.median())
+	assert.Equal(t, 0.0, h.percentile(100))
+	assert.Equal(t, 0.0, h.percentile(129))
+	assert.Equal(t, 50.0, h.percentile(150))
+	assert.Equal(t, 100.0, h.percentile(300))
+	assert.Equal(t, "Hannover", h.without("a").lowest().Outlet)
+	assert.Len(t, h.without("unknown").Prices, 4)
+}
+
+func Test_priceHistory_incomplete(t *testing.T) {
+	h := examplePriceHistory()
+	h.Count = 10
+	h.Median = 300
+
+	assert.Equal(t, 300.0, h.median())
+	assert.Equal(t, 0.0, h.percentile(129))
+	assert.Equal(t, 10.0, h.percentile(149))
+	assert.Equal(t, 30.0, h.percentile(249))
+	assert.Equal(t, 100.0, h.percentile(250))
+	assert.Equal(t, 9, h.without("a").Count)
+	assert.Equal(t, 9, h.without("beyond the kept prices").Count)
+	assert.Equal(t, 300.0, h.without("a").median())
+
+	complete := examplePriceHistory()
+	complete.Count = 4
+	assert.Equal(t, 3, complete.without("a").Count)
+	assert.Equal(t, 4, complete.without("unknown").Count)
+}
+
+func Test_priceHistory_String(t *testing.T) {
+	h := examplePriceHistory()
+
+	assert.Equal(t, "lowest seen: 129.00€ (2026-03-02, Braunschweig), 26% below historical median", h.String(129, "EUR"))
+	assert.Equal(t, "lowest seen: 149.00€ (Hannover), 13% above historical median", h.without("a").String(225, "EUR"))
+}
+
+func Test_historyOf(t *testing.T) {
+	histories := map[int]priceHistory{1: examplePriceHistory(), 2: {PimId: 2, Prices: []historicalPrice{{PostingId: "x", Price: 1}}}}
+
+	assert.Len(t, historyOf(histories, posting{PostingId: "a", PimId: 1}).Prices, 3)
+	assert.Nil(t, historyOf(histories, posting{PostingId: "x", PimId: 2}))
+	assert.Nil(t, historyOf(histories, posting{PostingId: "y", PimId: 3}))
+	assert.Nil(t, historyOf(histories, posting{PostingId: "z"}))
+}
+
+func Test_query_matchesHistory(t *testing.T) {
+	h := examplePriceHistory()
+	tests := []struct {
+		name    string
+		q       query
+		price   float64
+		history *priceHistory
+		want    bool
+	}{
+		{"no options", query{}, 500, nil, true},
+		{"below min", query{BelowHistoricalMin: true}, 128, &h, true},
+		{"equal to min", query{BelowHistoricalMin: true}, 129, &h, false},
+		{"without history", query{BelowHistoricalMin: true}, 1, nil, false},
+		{"within percentile", query{PercentileMax: fPtr(25)}, 140, &h, true},
+		{"above percentile", query{PercentileMax: fPtr(25)}, 150, &h, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.q.matchesHistory(posting{Price: tt.price}, tt.history))
+		})
+	}
+}
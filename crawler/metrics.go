@@ -0,0 +1,131 @@
+package crawler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// metricsRegistry holds the metrics of the crawler only, so pushes of a single run do not carry go runtime metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var metrics = promauto.With(metricsRegistry)
+
+// Crawl metrics are labeled by shop and category id. The category is empty for postings crawled across all categories
+// by the fast crawl and for requests of the categories of a shop.
+var (
+	postingsCrawled = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_postings_crawled_total",
+		Help: "Postings fetched from the api.",
+	}, []string{"shop", "category"})
+	postingsInserted = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_postings_inserted_total",
+		Help: "New postings saved.",
+	}, []string{"shop", "category"})
+	postingsUpdated = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_postings_updated_total",
+		Help: "Changed postings saved.",
+	}, []string{"shop", "category"})
+	postingsDeactivated = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_postings_deactivated_total",
+		Help: "Postings set inactive since they disappeared from the api.",
+	}, []string{"shop", "category"})
+	apiRequestDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fundgrube_api_request_duration_seconds",
+		Help:    "Latency of requests to the api until the response headers are received.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"shop", "category"})
+	apiResponses = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_api_responses_total",
+		Help: "Responses of the api by http status. Requests failing without response have the status 'error'.",
+	}, []string{"shop", "category", "status"})
+	apiRetries = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_api_retries_total",
+		Help: "Requests to the api retried after a timeout.",
+	}, []string{"shop", "category"})
+)
+
+// Query metrics are labeled by the id of the query.
+var (
+	queryMatches = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_query_matches_total",
+		Help: "New deals found by a query.",
+	}, []string{"query"})
+	queryNotifications = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_query_notifications_total",
+		Help: "Mails sent about new deals of a query.",
+	}, []string{"query"})
+)
+
+var (
+	runDuration = metrics.NewGauge(prometheus.GaugeOpts{
+		Name: "fundgrube_run_duration_seconds",
+		Help: "Duration of the last run of crawling and searching deals.",
+	})
+	runResults = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundgrube_runs_total",
+		Help: "Runs by result, which is 'success' or 'failure'.",
+	}, []string{"result"})
+	lastSuccess = metrics.NewGauge(prometheus.GaugeOpts{
+		Name: "fundgrube_last_success_timestamp_seconds",
+		Help: "Unix time of the end of the last successful run.",
+	})
+)
+
+// apiLabels labels the metrics of requests to the api of the shop for the given categories. Requests for several
+// categories are not attributed to any of them.
+func apiLabels(shop Shop, categories []category) prometheus.Labels {
+	categoryId := ""
+	if len(categories) == 1 {
+		categoryId = categories[0].CategoryId
+	}
+	return prometheus.Labels{"shop": string(shop), "category": categoryId}
+}
+
+// observeApiResponse records a response of the api with the status code, or 0 if the request failed without response.
+func observeApiResponse(labels prometheus.Labels, took time.Duration, code int) {
+	apiRequestDuration.With(labels).Observe(took.Seconds())
+	status := "error"
+	if code > 0 {
+		status = strconv.Itoa(code)
+	}
+	apiResponses.WithLabelValues(labels["shop"], labels["category"], status).Inc()
+}
+
+// recordCrawlerStats adds the stats of a crawl of the category of the shop to the metrics.
+func recordCrawlerStats(shop Shop, categoryId string, stats *CrawlerStats) {
+	if stats == nil {
+		return
+	}
+	postingsCrawled.WithLabelValues(string(shop), categoryId).Add(float64(stats.Postings))
+	postingsInserted.WithLabelValues(string(shop), categoryId).Add(float64(stats.Inserted))
+	postingsUpdated.WithLabelValues(string(shop), categoryId).Add(float64(stats.Updated))
+	postingsDeactivated.WithLabelValues(string(shop), categoryId).Add(float64(stats.Inactive))
+}
+
+// recordRunMetrics records the duration of a run of crawling and searching deals and, if it succeeded, its end as last
+// success.
+func recordRunMetrics(start time.Time, end time.Time, success bool) {
+	runDuration.Set(end.Sub(start).Seconds())
+	if !success {
+		runResults.WithLabelValues("failure").Inc()
+		return
+	}
+	runResults.WithLabelValues("success").Inc()
+	lastSuccess.Set(float64(end.Unix()))
+}
+
+// NewMetricsHandler serves the metrics in the Prometheus text format.
+func NewMetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// PushMetrics replaces the metrics of the job at a Pushgateway compatible endpoint by the current metrics, so the
+// metrics of a single run can be scraped after the crawler exited.
+func PushMetrics(url string, job string) error {
+	return push.New(url, job).Gatherer(metricsRegistry).Push()
+}
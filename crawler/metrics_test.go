@@ -0,0 +1,107 @@
+package crawler
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_apiLabels(t *testing.T) {
+	gaming := category{CategoryId: "CAT_1", Name: "Gaming"}
+	household := category{CategoryId: "CAT_2", Name: "Haushalt"}
+
+	assert.Equal(t, "CAT_1", apiLabels(SATURN, []category{gaming})["category"])
+	assert.Equal(t, "", apiLabels(SATURN, []category{gaming, household})["category"])
+	assert.Equal(t, "", apiLabels(SATURN, nil)["category"])
+	assert.Equal(t, "SATURN", apiLabels(SATURN, nil)["shop"])
+}
+
+func Test_recordCrawlerStats(t *testing.T) {
+	recordCrawlerStats(MM, "CAT_METRICS", &CrawlerStats{Postings: 10, Inserted: 3, Updated: 2, Inactive: 1})
+	recordCrawlerStats(MM, "CAT_METRICS", &CrawlerStats{Postings: 5, Inserted: 1})
+	recordCrawlerStats(MM, "CAT_METRICS", nil)
+
+	assert.Equal(t, 15.0, testutil.ToFloat64(postingsCrawled.WithLabelValues("MM", "CAT_METRICS")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(postingsInserted.WithLabelValues("MM", "CAT_METRICS")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(postingsUpdated.WithLabelValues("MM", "CAT_METRICS")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(postingsDeactivated.WithLabelValues("MM", "CAT_METRICS")))
+}
+
+func Test_getResponseBodyFromServer_metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("status") == "ok" {
+			w.Write([]byte("{}"))
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+	labels := apiLabels(SATURN, []category{{CategoryId: "CAT_STATUS"}})
+
+	body, err := getResponseBodyFromServer(context.Background(), server.URL+"?status=ok", "de-DE", labels, true)
+	assert.NoError(t, err)
+	body.Close()
+	_, err = getResponseBodyFromServer(context.Background(), server.URL, "de-DE", labels, true)
+	assert.Error(t, err)
+	_, err = getResponseBodyFromServer(context.Background(), "http://127.0.0.1:0", "de-DE", labels, true)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiResponses.WithLabelValues("SATURN", "CAT_STATUS", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiResponses.WithLabelValues("SATURN", "CAT_STATUS", "422")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiResponses.WithLabelValues("SATURN", "CAT_STATUS", "error")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(apiRetries.WithLabelValues("SATURN", "CAT_STATUS")))
+}
+
+func Test_recordRunMetrics(t *testing.T) {
+	successes := testutil.ToFloat64(runResults.WithLabelValues("success"))
+	failures := testutil.ToFloat64(runResults.WithLabelValues("failure"))
+	end := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	recordRunMetrics(end.Add(-2*time.Second), end, true)
+	assert.Equal(t, float64(end.Unix()), testutil.ToFloat64(lastSuccess))
+	assert.Equal(t, 2.0, testutil.ToFloat64(runDuration))
+
+	recordRunMetrics(end.Add(time.Minute), end.Add(2*time.Minute), false)
+	assert.Equal(t, float64(end.Unix()), testutil.ToFloat64(lastSuccess))
+	assert.Equal(t, 60.0, testutil.ToFloat64(runDuration))
+	assert.Equal(t, successes+1, testutil.ToFloat64(runResults.WithLabelValues("success")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(runResults.WithLabelValues("failure")))
+}
+
+func Test_NewMetricsHandler(t *testing.T) {
+	queryMatches.WithLabelValues("metrics-query").Add(3)
+	queryNotifications.WithLabelValues("metrics-query").Inc()
+	rec := httptest.NewRecorder()
+
+	NewMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `fundgrube_query_matches_total{query="metrics-query"} 3`)
+	assert.Contains(t, string(body), `fundgrube_query_notifications_total{query="metrics-query"} 1`)
+	assert.False(t, strings.Contains(string(body), "go_goroutines"))
+}
+
+func Test_PushMetrics(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.Method + " " + r.URL.Path
+		bytes, _ := io.ReadAll(r.Body)
+		body = string(bytes)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	queryMatches.WithLabelValues("pushed-query").Add(1)
+
+	err := PushMetrics(server.URL, "fundgrube_crawler")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "PUT /metrics/job/fundgrube_crawler", path)
+	assert.Contains(t, body, "pushed-query")
+}
@@ -1,33 +1,195 @@
 package crawler
 
 import (
+	"bytes"
 	"fmt"
 	"regexp"
 	"time"
 )
 
 type ConfigFile struct {
-	Queries      []query      `yaml:"queries"`
-	GlobalConfig globalConfig `yaml:"globalConfig"`
+	Queries      []query          `yaml:"queries"`
+	GlobalConfig globalConfig     `yaml:"globalConfig"`
+	Shops        []shopDefinition `yaml:"shops"`
+	// locations are the bundled outlet locations merged with GlobalConfig.OutletLocations when the config is loaded.
+	locations *outletLocations
+}
+
+// outletLocations returns the outlet locations of the config or the bundled ones if the config was not loaded from a
+// file.
+func (cf *ConfigFile) outletLocations() *outletLocations {
+	if cf.locations == nil {
+		return bundledOutletLocations
+	}
+	return cf.locations
+}
+
+// shopDefinition describes a shop offering the Fundgrube api, e.g. MediaMarkt or Saturn in a single country.
+type shopDefinition struct {
+	Id       Shop   `yaml:"id"`
+	Name     string `yaml:"name"`
+	ApiUrl   string `yaml:"api_url"`
+	ShopUrl  string `yaml:"shop_url"`
+	Currency string `yaml:"currency"`
+	Locale   string `yaml:"locale"`
+	Disabled bool   `yaml:"disabled"`
 }
 
 type globalConfig struct {
-	BlacklistedCategories []string `yaml:"blacklistedCategories"`
+	BlacklistedCategories []string                 `yaml:"blacklistedCategories"`
+	Categories            []string                 `yaml:"categories"`
+	CrawlInterval         time.Duration            `yaml:"crawlInterval"`
+	CategoryIntervals     map[string]time.Duration `yaml:"categoryIntervals"`
+	OutletLocations       []outletLocation         `yaml:"outletLocations"`
+	ConditionRules        []conditionRule          `yaml:"conditionRules"`
+	ScoreWeights          map[string]float64       `yaml:"scoreWeights"`
 }
 
+// crawlInterval returns the minimum time between two crawls of the category. Intervals are configured by category id
+// or name, the id takes precedence if both are configured; zero means the category is crawled on every run.
+func (g globalConfig) crawlInterval(c category) time.Duration {
+	for _, ref := range []string{c.CategoryId, c.Name} {
+		if interval, ok := g.CategoryIntervals[ref]; ok && ref != "" {
+			return interval
+		}
+	}
+	return g.CrawlInterval
+}
+
+// queryIdPattern restricts the ids of config queries, which name files of the report, to safe characters.
+var queryIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type query struct {
-	Desc         string   `yaml:"desc" json:"desc,omitempty" bson:"desc"`
-	NameRegex    []string `yaml:"name_regex" json:"name_regex,omitempty" bson:"name_regex"`
-	NotRegex     *string  `yaml:"not_regex" json:"not_regex,omitempty" bson:"not_regex"`
-	BrandRegex   *string  `yaml:"brand_regex" json:"brand_regex,omitempty" bson:"brand_regex"`
-	PriceMin     *float64 `yaml:"price_min" json:"price_min,omitempty" bson:"price_min"`
-	PriceMax     *float64 `yaml:"price_max" json:"price_max,omitempty" bson:"price_max"`
-	DiscountMin  *int     `yaml:"discount_min" json:"discount_min,omitempty" bson:"discount_min"`
-	OutletId     *int     `yaml:"outlet_id" json:"outlet_id,omitempty" bson:"outlet_id"`
+	// Id identifies a query of the config file, so its last search time is kept when it is edited. Queries of the config
+	// file without id are identified by their hash, see configQueryId. It consists of letters, digits, '_' and '-'.
+	Id         string   `yaml:"id,omitempty" json:"-" bson:"-"`
+	Desc       string   `yaml:"desc" json:"desc,omitempty" bson:"desc"`
+	NameRegex  []string `yaml:"name_regex" json:"name_regex,omitempty" bson:"name_regex"`
+	NotRegex   *string  `yaml:"not_regex" json:"not_regex,omitempty" bson:"not_regex"`
+	BrandRegex *string  `yaml:"brand_regex" json:"brand_regex,omitempty" bson:"brand_regex"`
+	// Expr is a boolean expression like `name ~ "switch" AND NOT text ~ "defekt"`, see parseExpr.
+	Expr     *string  `yaml:"expr" json:"expr,omitempty" bson:"expr"`
+	PriceMin *float64 `yaml:"price_min" json:"price_min,omitempty" bson:"price_min"`
+	PriceMax *float64 `yaml:"price_max" json:"price_max,omitempty" bson:"price_max"`
+	// TotalPriceMin and TotalPriceMax filter on the price including shipping cost.
+	TotalPriceMin *float64 `yaml:"total_price_min" json:"total_price_min,omitempty" bson:"total_price_min"`
+	TotalPriceMax *float64 `yaml:"total_price_max" json:"total_price_max,omitempty" bson:"total_price_max"`
+	DiscountMin   *int     `yaml:"discount_min" json:"discount_min,omitempty" bson:"discount_min"`
+	OutletId      *int     `yaml:"outlet_id" json:"outlet_id,omitempty" bson:"outlet_id"`
+	OutletIds     []int    `yaml:"outlet_ids" json:"outlet_ids,omitempty" bson:"outlet_ids"`
+	OutletName    *string  `yaml:"outlet_name" json:"outlet_name,omitempty" bson:"outlet_name"`
+	// OutletNames are regexes, matched ignoring case.
+	OutletNames   []string `yaml:"outlet_names" json:"outlet_names,omitempty" bson:"outlet_names"`
+	CategoryIds   []string `yaml:"category_ids" json:"category_ids,omitempty" bson:"category_ids"`
+	CategoryName  *string  `yaml:"category_name" json:"category_name,omitempty" bson:"category_name"`
+	CategoryNames []string `yaml:"category_names" json:"category_names,omitempty" bson:"category_names"`
+	// ShippingType is either "pickup" or "shipping".
+	ShippingType *string     `yaml:"shipping_type" json:"shipping_type,omitempty" bson:"shipping_type"`
+	Near         *nearFilter `yaml:"near" json:"near,omitempty" bson:"near"`
+	Shops        []Shop      `yaml:"shops" json:"shops,omitempty" bson:"shops"`
+	// EfficiencyClassMax matches postings with an energy efficiency class of at least this class within the scale of
+	// their label, e.g. "B" matches A+++ to B of the label before 2021 and A to B of the rescaled label, "A+" matches
+	// only the label before 2021. Postings without energy label do not match.
+	EfficiencyClassMax *string     `yaml:"efficiency_class_max" json:"efficiency_class_max,omitempty" bson:"efficiency_class_max"`
+	Condition          []condition `yaml:"condition" json:"condition,omitempty" bson:"condition"`
+	// BelowHistoricalMin matches postings cheaper than all other stored postings of the product.
+	BelowHistoricalMin bool `yaml:"below_historical_min" json:"below_historical_min,omitempty" bson:"below_historical_min"`
+	// PercentileMax matches postings whose price is lower than at most this percentage of the other stored postings of
+	// the product, e.g. 10 for the cheapest tenth.
+	PercentileMax *float64 `yaml:"percentile_max" json:"percentile_max,omitempty" bson:"percentile_max"`
+	// GroupByProduct sends one entry per pim_id listing the cheapest outlets instead of one per posting.
+	GroupByProduct bool `yaml:"group_by_product" json:"group_by_product,omitempty" bson:"group_by_product"`
+	// ScoreMin matches postings with at least this stored score, which leaves out distance and age, see scorePostings.
+	ScoreMin *float64 `yaml:"score_min" json:"score_min,omitempty" bson:"score_min"`
+	// Sort is one of the keys of sortOrders, postings are sorted by price by default.
+	Sort         *string  `yaml:"sort" json:"sort,omitempty" bson:"sort"`
 	Ids          []string `yaml:"-" json:"-,omitempty" bson:"-"`
 	FindInactive bool     `yaml:"find_inactive" json:"find_inactive,omitempty" bson:"find_inactive"`
 }
 
+func (q query) validate() error {
+	if q.Id != "" && !queryIdPattern.MatchString(q.Id) {
+		return fmt.Errorf("query '%s': invalid id '%s', expected letters, digits, '_' or '-'", q.Desc, q.Id)
+	}
+	if q.Expr != nil {
+		if _, err := parseExpr(*q.Expr); err != nil {
+			return fmt.Errorf("query '%s': invalid expr: %w", q.Desc, err)
+		}
+	}
+	if q.EfficiencyClassMax != nil {
+		if efficiencyClassesUpTo(efficiencyClasses, *q.EfficiencyClassMax) == nil {
+			return fmt.Errorf("query '%s': unknown efficiency class '%s'", q.Desc, *q.EfficiencyClassMax)
+		}
+	}
+	if q.Near != nil {
+		if err := q.Near.validate(); err != nil {
+			return fmt.Errorf("query '%s': %w", q.Desc, err)
+		}
+	}
+	for _, pattern := range q.OutletNames {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("query '%s': invalid outlet_names regex: %w", q.Desc, err)
+		}
+	}
+	if q.ShippingType != nil {
+		if _, err := q.apiShippingType(); err != nil {
+			return fmt.Errorf("query '%s': %w", q.Desc, err)
+		}
+	}
+	if q.PercentileMax != nil && (*q.PercentileMax < 0 || *q.PercentileMax > 100) {
+		return fmt.Errorf("query '%s': percentile_max must be between 0 and 100", q.Desc)
+	}
+	if q.Sort != nil {
+		if _, ok := sortOrders[*q.Sort]; !ok {
+			return fmt.Errorf("query '%s': unknown sort '%s', expected one of score, price, total_price, discount, newest or saving", q.Desc, *q.Sort)
+		}
+	}
+	for _, c := range q.Condition {
+		if !Contains(conditions, c) {
+			return fmt.Errorf("query '%s': unknown condition '%s', expected one of %v", q.Desc, c, conditions)
+		}
+	}
+	return nil
+}
+
+// allOutletIds returns the ids of outlet_id and outlet_ids.
+func (q query) allOutletIds() []int {
+	ids := append([]int{}, q.OutletIds...)
+	if q.OutletId != nil {
+		ids = append(ids, *q.OutletId)
+	}
+	return ids
+}
+
+// outletNamePatterns returns the regexes of outlet_names and outlet_name as exact match.
+func (q query) outletNamePatterns() []string {
+	patterns := append([]string{}, q.OutletNames...)
+	if q.OutletName != nil {
+		patterns = append(patterns, "^"+regexp.QuoteMeta(*q.OutletName)+"$")
+	}
+	return patterns
+}
+
+// allCategoryNames returns the names of category_name and category_names.
+func (q query) allCategoryNames() []string {
+	names := append([]string{}, q.CategoryNames...)
+	if q.CategoryName != nil {
+		names = append(names, *q.CategoryName)
+	}
+	return names
+}
+
+// apiShippingType maps the shipping_type of the query to the value of the api, which calls pickup "collect".
+func (q query) apiShippingType() (string, error) {
+	switch *q.ShippingType {
+	case "shipping":
+		return "shipping", nil
+	case "pickup", "collect":
+		return "collect", nil
+	}
+	return "", fmt.Errorf("unknown shipping_type '%s', expected pickup or shipping", *q.ShippingType)
+}
+
 func (q query) String() string {
 	if q.NameRegex == nil {
 		return ""
@@ -60,6 +222,86 @@ func (c *CrawlerStats) String() string {
 	return fmt.Sprintf("postings: %d, inserted: %d, updated: %d, inactive: %d, tookApi: %.3fs, tookDB: %.3fs", c.Postings, c.Inserted, c.Updated, c.Inactive, c.TookApi.Seconds(), c.TookDB.Seconds())
 }
 
+// CrawlReport summarizes a crawl of all shops and categories including the errors of failed categories.
+type CrawlReport struct {
+	Stats CrawlerStats
+	// ByCategory holds the stats of each crawled category. The stats of a fast crawl across all categories of a shop
+	// have no category.
+	ByCategory []CategoryStats
+	Categories int
+	Skipped    int
+	Errors     []CrawlError
+}
+
+// CrawlError is the error of a single (shop, category) unit. CategoryId is empty if the categories of the shop could
+// not be fetched at all.
+type CrawlError struct {
+	Shop         Shop
+	CategoryId   string
+	CategoryName string
+	Err          error
+}
+
+func (e CrawlError) Error() string {
+	if e.CategoryId == "" {
+		return fmt.Sprintf("%s: %s", e.Shop, e.Err)
+	}
+	return fmt.Sprintf("%s '%s' (%s): %s", e.Shop, e.CategoryName, e.CategoryId, e.Err)
+}
+
+func (e CrawlError) Unwrap() error {
+	return e.Err
+}
+
+// CategoryStats are the stats of a crawl of a single category of a shop.
+type CategoryStats struct {
+	Shop         Shop
+	CategoryId   string
+	CategoryName string
+	Stats        CrawlerStats
+}
+
+// addStats adds the stats of a crawl of the category, or of the whole shop if c is nil, to the report and the metrics.
+func (r *CrawlReport) addStats(shop Shop, c *category, stats *CrawlerStats) {
+	if stats == nil {
+		return
+	}
+	categoryStats := CategoryStats{Shop: shop, Stats: *stats}
+	if c != nil {
+		categoryStats.CategoryId = c.CategoryId
+		categoryStats.CategoryName = c.Name
+	}
+	r.Stats.add(stats)
+	r.ByCategory = append(r.ByCategory, categoryStats)
+	recordCrawlerStats(shop, categoryStats.CategoryId, stats)
+}
+
+func (r *CrawlReport) addError(shop Shop, c *category, err error) {
+	crawlError := CrawlError{Shop: shop, Err: err}
+	if c != nil {
+		crawlError.CategoryId = c.CategoryId
+		crawlError.CategoryName = c.Name
+	}
+	r.Errors = append(r.Errors, crawlError)
+}
+
+func (r *CrawlReport) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+func (r *CrawlReport) String() string {
+	summary := fmt.Sprintf("categories: %d, skipped: %d, failed: %d, %s", r.Categories, r.Skipped, len(r.Errors), r.Stats.String())
+	if !r.HasErrors() {
+		return summary
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(summary)
+	for _, e := range r.Errors {
+		buffer.WriteString("\n\t💥 " + e.Error())
+	}
+	return buffer.String()
+}
+
 type postingsResponse struct {
 	Postings     []posting  `json:"postings"`
 	Outlets      []outlet   `json:"outlets"`
@@ -83,7 +325,23 @@ Example json
 	    "id": 6927,
 	    "name": "AKRACING"
 	  },
-	  "eek": {},
+	  "eek": {
+	    "classRange": {
+	      "from": "A+++",
+	      "to": "D"
+	    },
+	    "energyEfficiencyLabelEu2017_1369": false,
+	    "efficiencyClass": "C",
+	    "colorCode": "rgb(236 102 8)",
+	    "label": {
+	      "url": "https://assets.mmsrg.com/ada/166325/c1/-/-/ASSET_MMS_69853472",
+	      "mimetype": "image/pdf"
+	    },
+	    "datasheet": {
+	      "url": "https://assets.mmsrg.com/ada/166325/c1/-/-/ASSET_MMS_69853468",
+	      "mimetype": "image/pdf"
+	    }
+	  },
 	  "top_level_catalog_id": "CAT_DE_SAT_786",
 	  "original_url": [
 	    "https://assets.mmsrg.com/is/166325/12975367df8e182e57044734f5165e190/c3/-/31b5554e0e7f4ad5a6a07101fd3750aa"
@@ -96,39 +354,69 @@ Example json
 	}
 */
 type posting struct {
-	PostingId         string        `json:"posting_id" bson:"_id"`
-	PriceString       string        `json:"price" bson:"-"`
-	PriceOldString    string        `json:"price_old" bson:"-"`
-	Price             float64       `json:"-" bson:"price"`
-	PriceOld          float64       `json:"-" bson:"price_old"`
-	DiscountInPercent int           `json:"discount_in_percent" bson:"discount_in_percent"`
-	ShippingCost      float64       `json:"shipping_cost" bson:"shipping_cost"`
-	ShippingType      string        `json:"shipping_type" bson:"shipping_type"`
-	Name              string        `json:"name" bson:"name"`
-	Url               []string      `json:"original_url" bson:"url"`
-	Text              string        `json:"posting_text" bson:"text"`
-	Outlet            postingOutlet `json:"outlet" bson:"outlet"`
-	CategoryId        string        `json:"top_level_catalog_id" bson:"category_id"`
-	Brand             brand         `json:"brand" bson:"brand"`
-	Shop              Shop          `json:"-" bson:"shop"`
-	ShopUrl           string        `json:"-" bson:"shop_url"`
-	PimId             int           `json:"pim_id" bson:"pim_id"`
-	CreDat            *time.Time    `json:"-" bson:"cre_dat" `
-	ModDat            *time.Time    `json:"-" bson:"mod_dat"`
-	Active            bool          `json:"-" bson:"active"`
+	PostingId      string  `json:"posting_id" bson:"_id"`
+	PriceString    string  `json:"price" bson:"-"`
+	PriceOldString string  `json:"price_old" bson:"-"`
+	Price          float64 `json:"-" bson:"price"`
+	PriceOld       float64 `json:"-" bson:"price_old"`
+	// TotalPrice includes the shipping cost of postings that are shipped.
+	TotalPrice float64 `json:"-" bson:"total_price"`
+	// Saving is the absolute discount price_old - price, zero without price_old.
+	Saving            float64   `json:"-" bson:"saving"`
+	DiscountInPercent int       `json:"discount_in_percent" bson:"discount_in_percent"`
+	ShippingCost      float64   `json:"shipping_cost" bson:"shipping_cost"`
+	ShippingType      string    `json:"shipping_type" bson:"shipping_type"`
+	Name              string    `json:"name" bson:"name"`
+	Url               []string  `json:"original_url" bson:"url"`
+	Text              string    `json:"posting_text" bson:"text"`
+	Condition         condition `json:"-" bson:"condition,omitempty"`
+	ConditionFlags    []string  `json:"-" bson:"condition_flags,omitempty"`
+	// Score rates the deal from 0 to 100. It is stored without query specific components and updated on change.
+	Score        float64       `json:"-" bson:"score,omitempty"`
+	Outlet       postingOutlet `json:"outlet" bson:"outlet"`
+	CategoryId   string        `json:"top_level_catalog_id" bson:"category_id"`
+	CategoryName string        `json:"-" bson:"category_name,omitempty"`
+	Brand        brand         `json:"brand" bson:"brand"`
+	EnergyLabel  *energyLabel  `json:"eek" bson:"eek,omitempty"`
+	Shop         Shop          `json:"-" bson:"shop"`
+	ShopUrl      string        `json:"-" bson:"shop_url"`
+	Currency     string        `json:"-" bson:"currency,omitempty"`
+	PimId        int           `json:"pim_id" bson:"pim_id"`
+	CreDat       *time.Time    `json:"-" bson:"cre_dat" `
+	ModDat       *time.Time    `json:"-" bson:"mod_dat"`
+	Active       bool          `json:"-" bson:"active"`
+	// DistanceKm is the distance to the center of the near filter of a query and not persisted.
+	DistanceKm *float64 `json:"-" bson:"-"`
+	// History contains the prices of the other postings of the product when alerting and is not persisted.
+	History *priceHistory `json:"-" bson:"-"`
 }
 
 func (p posting) String() string {
 	shippingInfo := ""
 	if p.ShippingType == "shipping" {
-		shippingInfo = fmt.Sprintf(" +%.2f€", p.ShippingCost)
+		shippingInfo = fmt.Sprintf(" +%s", formatPrice(p.ShippingCost, p.Currency))
 	}
 	uvpInfo := ""
 	if p.PriceOld != 0 {
-		uvpInfo = fmt.Sprintf(" (UVP %.2f€ -%d%%)", p.PriceOld, p.DiscountInPercent)
+		uvpInfo = fmt.Sprintf(" (UVP %s -%d%%)", formatPrice(p.PriceOld, p.Currency), p.DiscountInPercent)
 	}
-	priceInfo := fmt.Sprintf("%.2f€%s%s", p.Price, shippingInfo, uvpInfo)
-	return fmt.Sprintf("%s 👉%s👈 in %s [%s]\n\t📗 %s\n\t📸 %s\n\t🛒 %s", priceInfo, p.Name, p.Outlet.Name, p.PostingId, shorten(p.Text), p.Url[0], p.ShopUrl)
+	priceInfo := fmt.Sprintf("%s%s%s", formatPrice(p.Price, p.Currency), shippingInfo, uvpInfo)
+	if p.Score > 0 {
+		priceInfo = fmt.Sprintf("%s ⭐%.0f", priceInfo, p.Score)
+	}
+	energyInfo := ""
+	if p.EnergyLabel != nil {
+		energyInfo = "\n\t⚡ " + p.EnergyLabel.String()
+	}
+	historyInfo := ""
+	if p.History != nil {
+		historyInfo = "\n\t📉 " + p.History.String(p.Price, p.Currency)
+	}
+	outletInfo := p.Outlet.Name
+	if p.DistanceKm != nil {
+		outletInfo = fmt.Sprintf("%s (%.0f km)", outletInfo, *p.DistanceKm)
+	}
+	return fmt.Sprintf("%s 👉%s👈 in %s [%s]\n\t📗 %s%s\n\t📸 %s\n\t🛒 %s", priceInfo, p.Name, outletInfo, p.PostingId, shorten(p.Text), energyInfo+historyInfo, p.Url[0], p.ShopUrl)
 }
 
 func shorten(text string) string {
@@ -154,6 +442,8 @@ type outlet struct {
 	OutletId int    `json:"id"`
 	Name     string `json:"name"`
 	Count    int    `json:"count"`
+	NameFull string `json:"nameFull"`
+	IsActive bool   `json:"isActive"`
 }
 
 type postingOutlet struct {
@@ -174,13 +464,9 @@ type category struct {
 	Count      int    `json:"count"`
 }
 
-type postingCategory struct {
-	CategoryId string `json:"id" bson:"id"`
-	Name       string `json:"name" bson:"name"`
-}
-
-func (c *category) toPostingCategory() postingCategory {
-	return postingCategory{CategoryId: c.CategoryId, Name: c.Name}
+// matches returns true if ref is the id or the name of the category.
+func (c category) matches(ref string) bool {
+	return c.CategoryId == ref || c.Name == ref
 }
 
 type brand struct {
@@ -188,6 +474,179 @@ type brand struct {
 	Name    string `json:"name" bson:"name"`
 }
 
+// outletReference is an outlet of a shop as stored in the outlets collection. Count is the number of postings when the
+// outlet was seen last.
+type outletReference struct {
+	Id        string     `json:"id" bson:"_id"`
+	Shop      Shop       `json:"shop" bson:"shop"`
+	OutletId  int        `json:"outlet_id" bson:"outlet_id"`
+	Name      string     `json:"name" bson:"name"`
+	NameFull  string     `json:"name_full" bson:"name_full"`
+	IsActive  bool       `json:"is_active" bson:"is_active"`
+	Count     int        `json:"count" bson:"count"`
+	FirstSeen *time.Time `json:"first_seen" bson:"first_seen"`
+	LastSeen  *time.Time `json:"last_seen" bson:"last_seen"`
+}
+
+// categoryReference is a category of a shop as stored in the categories collection. Count is the number of postings
+// when the category was seen last.
+type categoryReference struct {
+	Id         string     `json:"id" bson:"_id"`
+	Shop       Shop       `json:"shop" bson:"shop"`
+	CategoryId string     `json:"category_id" bson:"category_id"`
+	Name       string     `json:"name" bson:"name"`
+	Count      int        `json:"count" bson:"count"`
+	FirstSeen  *time.Time `json:"first_seen" bson:"first_seen"`
+	LastSeen   *time.Time `json:"last_seen" bson:"last_seen"`
+}
+
+// referenceCount is the posting count of an outlet or category on a single day.
+type referenceCount struct {
+	Id    string `bson:"_id"`
+	Kind  string `bson:"kind"`
+	Shop  Shop   `bson:"shop"`
+	RefId string `bson:"ref_id"`
+	Day   string `bson:"day"`
+	Count int    `bson:"count"`
+}
+
+// crawlOperation stores when a category of a shop was crawled successfully for the last time.
+type crawlOperation struct {
+	Id           string     `bson:"_id"`
+	Shop         Shop       `bson:"shop"`
+	CategoryId   string     `bson:"category_id"`
+	CategoryName string     `bson:"category_name"`
+	Timestamp    *time.Time `bson:"timestamp"`
+}
+
+// watermark stores the newest postings of a shop seen by the last fast crawl.
+type watermark struct {
+	Shop       Shop       `bson:"_id"`
+	PostingIds []string   `bson:"posting_ids"`
+	Timestamp  *time.Time `bson:"timestamp"`
+}
+
+// product aggregates the active postings of all outlets with the same pim_id. The prices are kept when the last
+// posting of a product becomes inactive.
+type product struct {
+	PimId          int        `json:"pim_id" bson:"_id"`
+	Name           string     `json:"name" bson:"name"`
+	Brand          string     `json:"brand" bson:"brand"`
+	MinPrice       float64    `json:"min_price" bson:"min_price"`
+	MaxPrice       float64    `json:"max_price" bson:"max_price"`
+	MedianPrice    float64    `json:"median_price" bson:"median_price"`
+	ActivePostings int        `json:"active_postings" bson:"active_postings"`
+	Outlets        int        `json:"outlets" bson:"outlets"`
+	FirstSeen      *time.Time `json:"first_seen" bson:"first_seen"`
+	LastSeen       *time.Time `json:"last_seen" bson:"last_seen"`
+}
+
+// energyLabel is the eu energy label of a posting. The api returns an empty object for postings without label.
+type energyLabel struct {
+	EfficiencyClass string         `json:"efficiencyClass" bson:"efficiency_class"`
+	ColorCode       string         `json:"colorCode" bson:"color_code,omitempty"`
+	ClassRange      *classRange    `json:"classRange" bson:"class_range,omitempty"`
+	Label2017       bool           `json:"energyEfficiencyLabelEu2017_1369" bson:"label_2017"`
+	Label           *labelDocument `json:"label" bson:"label,omitempty"`
+	Datasheet       *labelDocument `json:"datasheet" bson:"datasheet,omitempty"`
+}
+
+func (e energyLabel) String() string {
+	info := fmt.Sprintf("Energy class %s", e.EfficiencyClass)
+	if e.ClassRange != nil {
+		info = fmt.Sprintf("%s (%s to %s)", info, e.ClassRange.From, e.ClassRange.To)
+	}
+	if e.Datasheet != nil {
+		info = fmt.Sprintf("%s, datasheet: %s", info, e.Datasheet.Url)
+	}
+	return info
+}
+
+type classRange struct {
+	From string `json:"from" bson:"from"`
+	To   string `json:"to" bson:"to"`
+}
+
+type labelDocument struct {
+	Url      string `json:"url" bson:"url"`
+	Mimetype string `json:"mimetype" bson:"mimetype"`
+}
+
+// efficiencyClasses are the energy efficiency classes of the eu label before 2021 from best to worst.
+var efficiencyClasses = []string{"A+++", "A++", "A+", "A", "B", "C", "D", "E", "F", "G"}
+
+// efficiencyClasses2017 are the classes of the rescaled eu label of regulation 2017/1369 from best to worst. A class
+// of one scale is not comparable to the same letter of the other scale.
+var efficiencyClasses2017 = []string{"A", "B", "C", "D", "E", "F", "G"}
+
+// efficiencyClassesUpTo returns the classes of the scale that are at least as good as max or nil if max is no class of
+// the scale.
+func efficiencyClassesUpTo(scale []string, max string) []string {
+	for i, c := range scale {
+		if c == max {
+			return append([]string{}, scale[:i+1]...)
+		}
+	}
+	return nil
+}
+
+// storedQuery is a query of the queries collection. Its id stays the same when the query is edited, so its last search
+// time in the operations collection is kept.
+type storedQuery struct {
+	Id      string     `json:"id" bson:"_id"`
+	Owner   string     `json:"owner" bson:"owner"`
+	Enabled bool       `json:"enabled" bson:"enabled"`
+	Query   query      `json:"query" bson:"query"`
+	CreDat  *time.Time `json:"created" bson:"cre_dat"`
+	ModDat  *time.Time `json:"modified" bson:"mod_dat"`
+	// Config marks a query of the config file. It is identified by its id, see configQueryId, and cannot be edited at
+	// runtime.
+	Config bool `json:"config" bson:"-"`
+}
+
+// run is a record of the runs collection, see RunReport. Durations are in seconds, so they can be compared and
+// aggregated across runs.
+type run struct {
+	Id      string     `json:"id" bson:"_id"`
+	Start   *time.Time `json:"start" bson:"start"`
+	End     *time.Time `json:"end" bson:"end"`
+	Took    float64    `json:"took" bson:"took"`
+	Mode    string     `json:"mode" bson:"mode"`
+	Version string     `json:"version" bson:"version"`
+	Success bool       `json:"success" bson:"success"`
+	// Error is the error that stopped the run or its crawl early, if any.
+	Error  string        `json:"error,omitempty" bson:"error,omitempty"`
+	Crawl  *runCrawl     `json:"crawl,omitempty" bson:"crawl,omitempty"`
+	Search *SearchReport `json:"search,omitempty" bson:"search,omitempty"`
+}
+
+type runCrawl struct {
+	Categories int        `json:"categories" bson:"categories"`
+	Skipped    int        `json:"skipped" bson:"skipped"`
+	Stats      runStats   `json:"stats" bson:"stats"`
+	ByCategory []runStats `json:"by_category" bson:"by_category"`
+	Errors     []runError `json:"errors" bson:"errors"`
+}
+
+type runStats struct {
+	Shop         Shop    `json:"shop,omitempty" bson:"shop,omitempty"`
+	CategoryId   string  `json:"category_id,omitempty" bson:"category_id,omitempty"`
+	CategoryName string  `json:"category_name,omitempty" bson:"category_name,omitempty"`
+	Postings     int     `json:"postings" bson:"postings"`
+	Inserted     int     `json:"inserted" bson:"inserted"`
+	Updated      int     `json:"updated" bson:"updated"`
+	Inactive     int     `json:"inactive" bson:"inactive"`
+	TookApi      float64 `json:"took_api" bson:"took_api"`
+	TookDB       float64 `json:"took_db" bson:"took_db"`
+}
+
+type runError struct {
+	Shop         Shop   `json:"shop" bson:"shop"`
+	CategoryId   string `json:"category_id,omitempty" bson:"category_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty" bson:"category_name,omitempty"`
+	Error        string `json:"error" bson:"error"`
+}
+
 type operation struct {
 	Id          string     `bson:"_id"`
 	Description string     `bson:"description"`
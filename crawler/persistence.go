@@ -2,6 +2,8 @@ package crawler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -9,22 +11,86 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"os"
 	"reflect"
+	"regexp"
+	"sort"
+	"sync"
 	"time"
 )
 
+// connectMutex guards mongoClient and the cached collections, which are connected on first use by concurrent
+// requests of the server.
+var connectMutex sync.Mutex
+var mongoClient *mongo.Client
 var collectionPostings *mongo.Collection
 var collectionOperations *mongo.Collection
+var collectionCrawls *mongo.Collection
+var collectionWatermarks *mongo.Collection
+var collectionOutlets *mongo.Collection
+var collectionCategories *mongo.Collection
+var collectionReferenceCounts *mongo.Collection
+var collectionProducts *mongo.Collection
+var collectionQueries *mongo.Collection
+var collectionRuns *mongo.Collection
 
-func FindOne(postingId string) *posting {
+// FindOne returns the posting with the given id or nil if it does not exist.
+func FindOne(ctx context.Context, postingId string) (*posting, error) {
+	collection, err := postingsCollection()
+	if err != nil {
+		return nil, err
+	}
 	posting := posting{}
-	err := postingsCollection().FindOne(context.TODO(), bson.M{"_id": postingId}).Decode(&posting)
+	err = collection.FindOne(ctx, bson.M{"_id": postingId}).Decode(&posting)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
 	if err != nil {
+		return nil, storageError("find one", err)
+	}
+	return &posting, nil
+}
+
+func FindAll(ctx context.Context, q query, afterTime *time.Time, limit int64, offset int64) ([]posting, error) {
+	postings := []posting{}
+	err := streamPostings(ctx, q, afterTime, options.Find().SetLimit(limit).SetSkip(offset), func(p posting) error {
+		postings = append(postings, p)
 		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return postings, nil
+}
+
+// streamPostings calls fn for each posting matching the query in the sort order of the query, decoding one posting
+// after another from the cursor. An error of fn stops the iteration and is returned.
+func streamPostings(ctx context.Context, q query, afterTime *time.Time, findOptions *options.FindOptions, fn func(p posting) error) error {
+	filter, err := postingsFilter(ctx, q, afterTime)
+	if err != nil {
+		return err
 	}
-	return &posting
+	collection, err := postingsCollection()
+	if err != nil {
+		return err
+	}
+	cur, err := collection.Find(ctx, filter, findOptions.SetSort(q.sortOrder()))
+	if err != nil {
+		return storageError("find all", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var elem posting
+		err := cur.Decode(&elem)
+		if err != nil {
+			return storageError("decode posting", err)
+		}
+		if err := fn(elem); err != nil {
+			return err
+		}
+	}
+	return storageError("find all", cur.Err())
 }
 
-func FindAll(q query, afterTime *time.Time, limit int64, offset int64) []posting {
+func postingsFilter(ctx context.Context, q query, afterTime *time.Time) (bson.M, error) {
 	filter := bson.M{}
 	if afterTime != nil {
 		filter["mod_dat"] = bson.M{"$gte": primitive.NewDateTimeFromTime(*afterTime)}
@@ -46,54 +112,130 @@ func FindAll(q query, afterTime *time.Time, limit int64, offset int64) []posting
 	if q.BrandRegex != nil {
 		filter["brand.name"] = bson.M{"$regex": primitive.Regex{Pattern: *q.BrandRegex, Options: "i"}}
 	}
-	if q.PriceMin != nil || q.PriceMax != nil {
-		filter["price"] = priceFilter(q.PriceMin, q.PriceMax)
+	if price := priceFilter(q.PriceMin, q.PriceMax); len(price) > 0 {
+		filter["price"] = price
+	}
+	if totalPrice := priceFilter(q.TotalPriceMin, q.TotalPriceMax); len(totalPrice) > 0 {
+		filter["total_price"] = totalPrice
 	}
 	if q.DiscountMin != nil {
 		filter["discount_in_percent"] = bson.M{"$gte": q.DiscountMin}
 	}
-	if q.OutletId != nil {
-		filter["outlet.id"] = bson.M{"$eq": q.OutletId}
+	if q.ScoreMin != nil {
+		filter["score"] = bson.M{"$gte": q.ScoreMin}
+	}
+	if outletIds := q.allOutletIds(); len(outletIds) > 0 {
+		filter["outlet.id"] = bson.M{"$in": outletIds}
+	}
+	if patterns := q.outletNamePatterns(); len(patterns) > 0 {
+		regexes := bson.A{}
+		for _, pattern := range patterns {
+			regexes = append(regexes, primitive.Regex{Pattern: pattern, Options: "i"})
+		}
+		filter["outlet.name"] = bson.M{"$in": regexes}
+	}
+	if categoryNames := q.allCategoryNames(); len(q.CategoryIds) > 0 || len(categoryNames) > 0 {
+		categoryIds, err := findCategoryIdsByNames(ctx, categoryNames)
+		if err != nil {
+			return nil, err
+		}
+		filter["category_id"] = bson.M{"$in": append(categoryIds, q.CategoryIds...)}
+	}
+	if q.ShippingType != nil {
+		shippingType, err := q.apiShippingType()
+		if err != nil {
+			return nil, err
+		}
+		filter["shipping_type"] = shippingType
+	}
+	if q.Near != nil {
+		outlets, err := findOutlets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filter["$or"] = outletsFilter(q.Near.outletsWithin(outlets))
+	}
+	if len(q.Shops) > 0 {
+		filter["shop"] = bson.M{"$in": q.Shops}
+	}
+	and := bson.A{}
+	if q.EfficiencyClassMax != nil {
+		efficiency, err := efficiencyFilter(*q.EfficiencyClassMax)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, efficiency)
+	}
+	if len(q.Condition) > 0 {
+		filter["condition"] = bson.M{"$in": q.Condition}
+	}
+	if q.Expr != nil {
+		node, err := parseExpr(*q.Expr)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, node.bson())
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
 	}
 	if q.Ids != nil {
 		filter["_id"] = bson.M{"$in": q.Ids}
 	} else if !q.FindInactive {
 		filter["active"] = bson.M{"$eq": true}
 	}
+	return filter, nil
+}
 
-	findOptions := options.Find().SetLimit(limit).SetSkip(offset).SetSort(bson.M{"price": 1})
-	cur, err := postingsCollection().Find(context.TODO(), filter, findOptions)
-	if err != nil {
-		panic(err)
-	}
-	postings := []posting{}
-	for cur.Next(context.TODO()) {
-		var elem posting
-		err := cur.Decode(&elem)
-		if err != nil {
-			panic(err)
-		}
-		postings = append(postings, elem)
+// sortOrders map the sort option of a query to the fields to sort by. The id makes paging stable for equal values.
+// Without sort option postings are found by price, but alerts are sorted by score, see rankDeals.
+var sortOrders = map[string]bson.D{
+	"price":       {{Key: "price", Value: 1}, {Key: "_id", Value: 1}},
+	"total_price": {{Key: "total_price", Value: 1}, {Key: "_id", Value: 1}},
+	"discount":    {{Key: "discount_in_percent", Value: -1}, {Key: "_id", Value: 1}},
+	"newest":      {{Key: "cre_dat", Value: -1}, {Key: "_id", Value: 1}},
+	"saving":      {{Key: "saving", Value: -1}, {Key: "_id", Value: 1}},
+	"score":       {{Key: "score", Value: -1}, {Key: "_id", Value: 1}},
+}
+
+func (q query) sortOrder() bson.D {
+	if q.Sort == nil {
+		return sortOrders["price"]
 	}
-	return postings
+	return sortOrders[*q.Sort]
 }
 
+// priceFilter returns the filter on a price within the given bounds, which is empty if neither bound is set.
 func priceFilter(priceMin *float64, priceMax *float64) bson.M {
-	if priceMin != nil && priceMax != nil {
-		return bson.M{"$gte": priceMin, "$lte": priceMax}
-	}
+	filter := bson.M{}
 	if priceMin != nil {
-		return bson.M{"$gte": priceMin}
+		filter["$gte"] = priceMin
 	}
 	if priceMax != nil {
-		return bson.M{"$lte": priceMax}
+		filter["$lte"] = priceMax
 	}
-	panic("priceFilter called without priceMin or priceMax set")
+	return filter
 }
 
-func SaveAllNewOrUpdated(postings []posting) *CrawlerStats {
+// efficiencyFilter matches energy labels with a class at least as good as max within the scale the label declares.
+func efficiencyFilter(max string) (bson.M, error) {
+	classes := efficiencyClassesUpTo(efficiencyClasses, max)
+	if classes == nil {
+		return nil, fmt.Errorf("unknown efficiency class '%s'", max)
+	}
+	scales := bson.A{bson.M{"eek.label_2017": bson.M{"$ne": true}, "eek.efficiency_class": bson.M{"$in": classes}}}
+	if classes2017 := efficiencyClassesUpTo(efficiencyClasses2017, max); classes2017 != nil {
+		scales = append(scales, bson.M{"eek.label_2017": true, "eek.efficiency_class": bson.M{"$in": classes2017}})
+	}
+	return bson.M{"$or": scales}, nil
+}
+
+func SaveAllNewOrUpdated(ctx context.Context, postings []posting) (*CrawlerStats, error) {
 	start := time.Now()
-	loadedPostings := loadAll(postings)
+	loadedPostings, err := loadAll(ctx, postings)
+	if err != nil {
+		return nil, err
+	}
 
 	postingsToUpsert := []posting{}
 
@@ -106,21 +248,44 @@ func SaveAllNewOrUpdated(postings []posting) *CrawlerStats {
 		} else {
 			posting.CreDat = existing.CreDat
 			posting.ModDat = existing.ModDat
+			posting.Score = existing.Score
 
-			if !reflect.DeepEqual(existing, posting) {
+			if !reflect.DeepEqual(withBackfilledFields(existing, posting), posting) {
 				posting.ModDat = &start
 				postingsToUpsert = append(postingsToUpsert, posting)
+			} else if !reflect.DeepEqual(existing, posting) {
+				postingsToUpsert = append(postingsToUpsert, posting)
 			}
 		}
 	}
 
-	insertedCount, updatedCount := insertOrUpdateAll(postingsToUpsert)
-	return &CrawlerStats{Inserted: insertedCount, Updated: updatedCount, TookDB: time.Since(start)}
+	insertedCount, updatedCount, err := insertOrUpdateAll(ctx, postingsToUpsert)
+	if err != nil {
+		return nil, err
+	}
+	err = updateScores(ctx, postingsToUpsert)
+	if err != nil {
+		return nil, err
+	}
+	return &CrawlerStats{Inserted: insertedCount, Updated: updatedCount, TookDB: time.Since(start)}, nil
+}
+
+// withBackfilledFields returns the stored posting with the fields stored postings may lack, since they were added
+// later, taken from the crawled posting p. A posting that only gains such fields is saved with its mod_dat, so it is not
+// reported as a new deal again.
+func withBackfilledFields(existing posting, p posting) posting {
+	if existing.CategoryName == "" {
+		existing.CategoryName = p.CategoryName
+	}
+	if existing.EnergyLabel == nil {
+		existing.EnergyLabel = p.EnergyLabel
+	}
+	return existing
 }
 
-func insertOrUpdateAll(postings []posting) (insertedCount int, updatedCount int) {
+func insertOrUpdateAll(ctx context.Context, postings []posting) (insertedCount int, updatedCount int, err error) {
 	if len(postings) == 0 {
-		return 0, 0
+		return 0, 0, nil
 	}
 
 	var operations []mongo.WriteModel
@@ -133,27 +298,34 @@ func insertOrUpdateAll(postings []posting) (insertedCount int, updatedCount int)
 		operations = append(operations, update)
 	}
 
-	write, err := postingsCollection().BulkWrite(context.TODO(), operations)
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, 0, err
+	}
+	write, err := collection.BulkWrite(ctx, operations)
 	if err != nil {
-		panic(err)
+		return 0, 0, storageError("bulk write", err)
 	}
-	return int(write.UpsertedCount), int(write.ModifiedCount)
+	return int(write.UpsertedCount), int(write.ModifiedCount), nil
 }
 
-func loadAll(postings []posting) map[string]posting {
+func loadAll(ctx context.Context, postings []posting) (map[string]posting, error) {
 	start := time.Now()
 
-	loadedPostings := FindAll(query{Ids: toIds(postings)}, nil, int64(len(postings)), 0)
+	loadedPostings, err := FindAll(ctx, query{Ids: toIds(postings)}, nil, int64(len(postings)), 0)
+	if err != nil {
+		return nil, err
+	}
 
 	ret := make(map[string]posting)
 	for _, loadedPosting := range loadedPostings {
 		ret[loadedPosting.PostingId] = loadedPosting
 	}
 	log.Debugf("Loaded %d existing postings for diff in %.2fs", len(ret), time.Since(start).Seconds())
-	return ret
+	return ret, nil
 }
 
-func SetRemainingPostingInactive(shop Shop, c category, outlets []outlet, postingIds []string) *CrawlerStats {
+func SetRemainingPostingInactive(ctx context.Context, shop Shop, c category, outlets []outlet, postingIds []string) (*CrawlerStats, error) {
 	start := time.Now()
 
 	filter := bson.M{"shop": shop, "category_id": c.CategoryId, "_id": bson.M{"$nin": postingIds}}
@@ -161,106 +333,904 @@ func SetRemainingPostingInactive(shop Shop, c category, outlets []outlet, postin
 		filter["outlet.id"] = bson.M{"$in": outletIds(outlets)}
 	}
 
-	many, err := postingsCollection().UpdateMany(
-		context.TODO(),
+	collection, err := postingsCollection()
+	if err != nil {
+		return nil, err
+	}
+	many, err := collection.UpdateMany(
+		ctx,
 		filter,
 		bson.M{"$set": bson.M{"active": false}},
 	)
 	if err != nil {
-		panic(err)
+		return nil, storageError("set inactive", err)
 	}
-	return &CrawlerStats{Inactive: int(many.ModifiedCount), TookDB: time.Since(start)}
+	return &CrawlerStats{Inactive: int(many.ModifiedCount), TookDB: time.Since(start)}, nil
 }
 
 func clearAll() {
-	_, err := postingsCollection().DeleteMany(context.TODO(), bson.M{})
-	if err != nil {
-		panic(err)
+	for _, collectionFunc := range []func() (*mongo.Collection, error){postingsCollection, queriesCollection, runsCollection} {
+		collection, err := collectionFunc()
+		if err != nil {
+			panic(err)
+		}
+		_, err = collection.DeleteMany(context.TODO(), bson.M{})
+		if err != nil {
+			panic(err)
+		}
 	}
 }
 
-func Migrate(filterString string, updateString string) int {
+func Migrate(ctx context.Context, filterString string, updateString string) (int, error) {
 	if !envBool("MIGRATE") {
-		return dryRunFilter(filterString)
+		return dryRunFilter(ctx, filterString)
 	}
 
-	manyResponse, err := postingsCollection().UpdateMany(context.TODO(), toBson(filterString), toBson(updateString))
+	collection, err := postingsCollection()
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	filter, err := toBson(filterString)
+	if err != nil {
+		return 0, err
+	}
+	update, err := toBson(updateString)
+	if err != nil {
+		return 0, err
+	}
+	manyResponse, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, storageError("migrate", err)
 	}
 	migratedCount := int(manyResponse.ModifiedCount)
 	log.Warnf("Migrated %d entries in posting collection filter: '%s' and update: '%s'", migratedCount, filterString, updateString)
-	return migratedCount
+	return migratedCount, nil
 }
 
-func CleanUp(filterString string) int {
+func CleanUp(ctx context.Context, filterString string) (int, error) {
 	if !envBool("CLEANUP") {
-		return dryRunFilter(filterString)
+		return dryRunFilter(ctx, filterString)
 	}
 
-	deleteMany, err := postingsCollection().DeleteMany(context.TODO(), toBson(filterString))
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	filter, err := toBson(filterString)
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	deleteMany, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, storageError("clean up", err)
 	}
 
 	deletedCount := int(deleteMany.DeletedCount)
 	log.Warnf("Deleted %d entries in posting collection with filter: '%s'", deletedCount, filterString)
-	return deletedCount
+	return deletedCount, nil
+}
+
+// ComputePrices sets total_price and saving of postings crawled before they were computed by preparePosting. The
+// mod_dat is kept, so the postings are not reported as new deals again.
+func ComputePrices(ctx context.Context) (int, error) {
+	filterString := `{"total_price": {"$exists": 0}}`
+	if !envBool("MIGRATE") {
+		return dryRunFilter(ctx, filterString)
+	}
+
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	update := bson.A{bson.M{"$set": bson.M{
+		"total_price": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$shipping_type", "shipping"}},
+			bson.M{"$round": bson.A{bson.M{"$add": bson.A{"$price", "$shipping_cost"}}, 2}},
+			"$price",
+		}},
+		"saving": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$price_old", 0}},
+			bson.M{"$round": bson.A{bson.M{"$subtract": bson.A{"$price_old", "$price"}}, 2}},
+			0.0,
+		}},
+	}}}
+	result, err := collection.UpdateMany(ctx, bson.M{"total_price": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return 0, storageError("compute prices", err)
+	}
+	log.Warnf("Computed total price and saving of %d postings.", result.ModifiedCount)
+	return int(result.ModifiedCount), nil
+}
+
+// rescoreBatchSize is the number of postings scored at once by RescorePostings.
+const rescoreBatchSize = 1000
+
+// RescorePostings sets the stored score of the active postings again, e.g. after the score changed. The mod_dat is
+// kept, so the postings are not reported as new deals again.
+func RescorePostings(ctx context.Context) (int, error) {
+	filterString := `{"active": true}`
+	if !envBool("MIGRATE") {
+		return dryRunFilter(ctx, filterString)
+	}
+
+	count := 0
+	batch := []posting{}
+	flush := func() error {
+		if err := updateScores(ctx, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = []posting{}
+		return nil
+	}
+	err := streamPostings(ctx, query{}, nil, options.Find().SetAllowDiskUse(true), func(p posting) error {
+		batch = append(batch, p)
+		if len(batch) < rescoreBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return count, err
+	}
+	log.Warnf("Rescored %d postings.", count)
+	return count, nil
+}
+
+// ClassifyConditions sets the condition of postings crawled before conditions were classified. The mod_dat is kept, so
+// the postings are not reported as new deals again.
+func ClassifyConditions(ctx context.Context) (int, error) {
+	filterString := `{"condition": {"$exists": 0}}`
+	if !envBool("MIGRATE") {
+		return dryRunFilter(ctx, filterString)
+	}
+
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	cur, err := collection.Find(ctx, bson.M{"condition": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"text": 1}))
+	if err != nil {
+		return 0, storageError("find unclassified postings", err)
+	}
+	var postings []posting
+	if err = cur.All(ctx, &postings); err != nil {
+		return 0, storageError("find unclassified postings", err)
+	}
+
+	writes := []mongo.WriteModel{}
+	for _, p := range postings {
+		c, flags := classifyCondition(p.Text, CONFIG.GlobalConfig.ConditionRules)
+		set := bson.M{"condition": c}
+		if flags != nil {
+			set["condition_flags"] = flags
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": p.PostingId}).SetUpdate(bson.M{"$set": set}))
+	}
+	if err = bulkWrite(ctx, postingsCollection, writes); err != nil {
+		return 0, err
+	}
+	log.Warnf("Classified the condition of %d postings.", len(writes))
+	return len(writes), nil
+}
+
+// FillCategoryNames sets the category name of postings crawled before category names were stored, taken from the
+// categories collection. The mod_dat is kept, so the postings are not reported as new deals again.
+func FillCategoryNames(ctx context.Context) (int, error) {
+	filterString := `{"category_name": {"$exists": 0}}`
+	if !envBool("MIGRATE") {
+		return dryRunFilter(ctx, filterString)
+	}
+
+	categories, err := findCategories(ctx)
+	if err != nil {
+		return 0, err
+	}
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, c := range categories {
+		result, err := collection.UpdateMany(ctx,
+			bson.M{"shop": c.Shop, "category_id": c.CategoryId, "category_name": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"category_name": c.Name}})
+		if err != nil {
+			return count, storageError("fill category names", err)
+		}
+		count += int(result.ModifiedCount)
+	}
+	log.Warnf("Filled the category name of %d postings.", count)
+	return count, nil
 }
 
-func dryRunFilter(filterString string) int {
-	cursor, err := postingsCollection().Find(context.TODO(), toBson(filterString))
+func dryRunFilter(ctx context.Context, filterString string) (int, error) {
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	filter, err := toBson(filterString)
+	if err != nil {
+		return 0, err
+	}
+	count, err := collection.CountDocuments(ctx, filter)
 	if err != nil {
-		panic(err)
+		return 0, storageError("dry run", err)
 	}
-	log.Warnf("[DRY_RUN] Filter '%s' matches %d elements.", filterString, cursor.RemainingBatchLength())
-	return 0
+	log.Warnf("[DRY_RUN] Filter '%s' matches %d elements.", filterString, count)
+	return 0, nil
 }
 
-func toBson(jsonString string) interface{} {
+func toBson(jsonString string) (interface{}, error) {
 	var bsonFilter interface{}
 	err := bson.UnmarshalExtJSON([]byte(jsonString), true, &bsonFilter)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid extended json '%s': %w", jsonString, err)
 	}
-	return bsonFilter
+	return bsonFilter, nil
 }
 
-func updateSearchOperation(query query, now *time.Time) *mongo.SingleResult {
-	md5Hex := hashQuery(query)
-	op := operation{md5Hex, query.Desc, query, now}
-	return operationsCollection().FindOneAndReplace(
-		context.TODO(),
-		bson.M{"_id": md5Hex},
+// updateSearchOperation stores the time of the last search of the query with the given id.
+func updateSearchOperation(ctx context.Context, id string, query query, now *time.Time) error {
+	collection, err := operationsCollection()
+	if err != nil {
+		return err
+	}
+	op := operation{id, query.Desc, query, now}
+	err = collection.FindOneAndReplace(
+		ctx,
+		bson.M{"_id": id},
 		op,
 		options.FindOneAndReplace().SetUpsert(true),
-	)
+	).Err()
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return storageError("update search operation", err)
+	}
+	return nil
 }
 
-func findSearchOperation(id string) *operation {
+// findSearchOperation returns the operation with the given id or nil if it does not exist.
+func findSearchOperation(ctx context.Context, id string) (*operation, error) {
+	collection, err := operationsCollection()
+	if err != nil {
+		return nil, err
+	}
 	op := operation{}
-	err := operationsCollection().FindOne(context.TODO(), bson.M{"_id": id}).Decode(&op)
+	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&op)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError("find search operation", err)
+	}
+	return &op, nil
+}
+
+// moveSearchOperation moves the operation with the id from to the id to, unless there is an operation with the id to
+// already. It returns whether the operation was moved.
+func moveSearchOperation(ctx context.Context, from string, to string) (bool, error) {
+	existing, err := findSearchOperation(ctx, to)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	op, err := findSearchOperation(ctx, from)
+	if err != nil || op == nil {
+		return false, err
+	}
+	if err := updateSearchOperation(ctx, to, op.Query, op.Timestamp); err != nil {
+		return false, err
+	}
+	collection, err := operationsCollection()
+	if err != nil {
+		return false, err
+	}
+	_, err = collection.DeleteOne(ctx, bson.M{"_id": from})
+	return true, storageError("delete search operation", err)
+}
+
+// findLastCrawls returns the time of the last successful crawl for each category id of the shop.
+func findLastCrawls(ctx context.Context, shop Shop) (map[string]time.Time, error) {
+	collection, err := crawlsCollection()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := collection.Find(ctx, bson.M{"shop": shop})
+	if err != nil {
+		return nil, storageError("find last crawls", err)
+	}
+	defer cur.Close(ctx)
+	lastCrawls := map[string]time.Time{}
+	for cur.Next(ctx) {
+		var op crawlOperation
+		if err := cur.Decode(&op); err != nil {
+			return nil, storageError("decode crawl operation", err)
+		}
+		if op.Timestamp != nil {
+			lastCrawls[op.CategoryId] = *op.Timestamp
+		}
+	}
+	return lastCrawls, storageError("find last crawls", cur.Err())
+}
+
+func updateLastCrawl(ctx context.Context, shop Shop, c category, timestamp *time.Time) error {
+	collection, err := crawlsCollection()
+	if err != nil {
+		return err
+	}
+	id := fmt.Sprintf("%s/%s", shop, c.CategoryId)
+	op := crawlOperation{id, shop, c.CategoryId, c.Name, timestamp}
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": id}, op, options.Replace().SetUpsert(true))
+	return storageError("update last crawl", err)
+}
+
+// findWatermark returns the watermark of the last fast crawl of the shop or nil if there is none.
+func findWatermark(ctx context.Context, shop Shop) (*watermark, error) {
+	collection, err := watermarksCollection()
+	if err != nil {
+		return nil, err
+	}
+	w := watermark{}
+	err = collection.FindOne(ctx, bson.M{"_id": shop}).Decode(&w)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError("find watermark", err)
+	}
+	return &w, nil
+}
+
+func updateWatermark(ctx context.Context, w watermark) error {
+	collection, err := watermarksCollection()
+	if err != nil {
+		return err
+	}
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": w.Shop}, w, options.Replace().SetUpsert(true))
+	return storageError("update watermark", err)
+}
+
+// countActivePostingsByCategory returns the number of active postings of the shop per category id.
+func countActivePostingsByCategory(ctx context.Context, shop Shop) (map[string]int, error) {
+	collection, err := postingsCollection()
+	if err != nil {
+		return nil, err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"shop": shop, "active": true}}},
+		{{Key: "$group", Value: bson.M{"_id": "$category_id", "count": bson.M{"$sum": 1}}}},
+	}
+	cur, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, storageError("count active postings", err)
+	}
+	defer cur.Close(ctx)
+	counts := map[string]int{}
+	for cur.Next(ctx) {
+		var elem struct {
+			CategoryId string `bson:"_id"`
+			Count      int    `bson:"count"`
+		}
+		if err := cur.Decode(&elem); err != nil {
+			return nil, storageError("decode posting count", err)
+		}
+		counts[elem.CategoryId] = elem.Count
+	}
+	return counts, storageError("count active postings", cur.Err())
+}
+
+// findPriceHistories returns the price history of the stored postings of each product, active and inactive, see
+// priceHistory.
+func findPriceHistories(ctx context.Context, pimIds []int) (map[int]priceHistory, error) {
+	histories := map[int]priceHistory{}
+	if len(pimIds) == 0 {
+		return histories, nil
+	}
+	collection, err := postingsCollection()
+	if err != nil {
+		return nil, err
+	}
+	// Each posting is numbered by price within its product. Only the cheapest postings and those in the middle, which
+	// make up the median, are grouped.
+	medianRank := bson.M{"$or": bson.A{
+		bson.M{"$eq": bson.A{"$rank", bson.M{"$floor": bson.M{"$divide": bson.A{bson.M{"$add": bson.A{"$count", 1}}, 2}}}}},
+		bson.M{"$eq": bson.A{"$rank", bson.M{"$ceil": bson.M{"$divide": bson.A{bson.M{"$add": bson.A{"$count", 1}}, 2}}}}},
+	}}
+	kept := bson.M{"$lte": bson.A{"$rank", maxHistoryPrices}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"pim_id": bson.M{"$in": pimIds}}}},
+		{{Key: "$setWindowFields", Value: bson.M{
+			"partitionBy": "$pim_id",
+			"sortBy":      bson.D{{Key: "price", Value: 1}, {Key: "cre_dat", Value: 1}},
+			"output": bson.M{
+				"rank":  bson.M{"$documentNumber": bson.M{}},
+				"count": bson.M{"$count": bson.M{}, "window": bson.M{"documents": bson.A{"unbounded", "unbounded"}}},
+			},
+		}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$or": bson.A{kept, medianRank}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$pim_id",
+			"count":  bson.M{"$first": "$count"},
+			"median": bson.M{"$avg": bson.M{"$cond": bson.A{medianRank, "$price", nil}}},
+			"prices": bson.M{"$push": bson.M{"$cond": bson.A{kept,
+				bson.M{"id": "$_id", "price": "$price", "date": "$cre_dat", "outlet": "$outlet.name"}, nil}}},
+		}}},
+		{{Key: "$project", Value: bson.M{"count": 1, "median": 1, "prices": bson.M{"$filter": bson.M{
+			"input": "$prices", "cond": bson.M{"$ne": bson.A{"$$this", nil}}}}}}},
+	}
+	cur, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
 	if err != nil {
+		return nil, storageError("find price histories", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var elem priceHistory
+		if err := cur.Decode(&elem); err != nil {
+			return nil, storageError("decode price history", err)
+		}
+		sort.SliceStable(elem.Prices, func(i, j int) bool {
+			return elem.Prices[i].Price < elem.Prices[j].Price
+		})
+		histories[elem.PimId] = elem
+	}
+	return histories, storageError("find price histories", cur.Err())
+}
+
+// updateScores scores the postings after they were saved, so their own prices are part of the price history.
+func updateScores(ctx context.Context, postings []posting) error {
+	if len(postings) == 0 {
 		return nil
 	}
-	return &op
+	histories, err := findPriceHistories(ctx, pimIds(postings))
+	if err != nil {
+		return err
+	}
+	scorePostings(postings, histories)
+
+	writes := []mongo.WriteModel{}
+	for _, p := range postings {
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": p.PostingId}).SetUpdate(bson.M{"$set": bson.M{"score": p.Score}}))
+	}
+	return bulkWrite(ctx, postingsCollection, writes)
 }
 
-func postingsCollection() *mongo.Collection {
-	if collectionPostings == nil {
-		collectionPostings = connect(env("MONGODB_COLLECTION_POSTINGS", "postings"))
+// refreshProducts aggregates the active postings by pim_id into the products collection. Products without active
+// postings keep their prices but are set to zero active postings.
+func refreshProducts(ctx context.Context, now *time.Time) (int, error) {
+	collection, err := postingsCollection()
+	if err != nil {
+		return 0, err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"active": true, "pim_id": bson.M{"$gt": 0}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        "$pim_id",
+			"name":       bson.M{"$first": "$name"},
+			"brand":      bson.M{"$first": "$brand.name"},
+			"prices":     bson.M{"$push": "$price"},
+			"outlets":    bson.M{"$addToSet": bson.M{"shop": "$shop", "id": "$outlet.id"}},
+			"first_seen": bson.M{"$min": "$cre_dat"},
+		}}},
+	}
+	cur, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, storageError("aggregate products", err)
 	}
-	return collectionPostings
+	defer cur.Close(ctx)
+
+	writes := []mongo.WriteModel{}
+	pimIds := bson.A{}
+	for cur.Next(ctx) {
+		var elem struct {
+			PimId     int        `bson:"_id"`
+			Name      string     `bson:"name"`
+			Brand     string     `bson:"brand"`
+			Prices    []float64  `bson:"prices"`
+			Outlets   []bson.M   `bson:"outlets"`
+			FirstSeen *time.Time `bson:"first_seen"`
+		}
+		if err := cur.Decode(&elem); err != nil {
+			return 0, storageError("decode product", err)
+		}
+		p := toProduct(elem.PimId, elem.Prices)
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": elem.PimId}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"name": elem.Name, "brand": elem.Brand, "min_price": p.MinPrice, "max_price": p.MaxPrice,
+					"median_price": p.MedianPrice, "active_postings": p.ActivePostings, "outlets": len(elem.Outlets)},
+				"$min": bson.M{"first_seen": elem.FirstSeen},
+				"$max": bson.M{"last_seen": now},
+			}).
+			SetUpsert(true))
+		pimIds = append(pimIds, elem.PimId)
+	}
+	if err := cur.Err(); err != nil {
+		return 0, storageError("aggregate products", err)
+	}
+	if err := bulkWrite(ctx, productsCollection, writes); err != nil {
+		return 0, err
+	}
+
+	products, err := productsCollection()
+	if err != nil {
+		return 0, err
+	}
+	_, err = products.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$nin": pimIds}, "active_postings": bson.M{"$gt": 0}},
+		bson.M{"$set": bson.M{"active_postings": 0, "outlets": 0}})
+	if err != nil {
+		return 0, storageError("deactivate products", err)
+	}
+	return len(writes), nil
 }
 
-func operationsCollection() *mongo.Collection {
-	if collectionOperations == nil {
-		collectionOperations = connect(env("MONGODB_COLLECTION_OPERATIONS", "operations"))
+// findProducts returns the products with the given pim ids.
+func findProducts(ctx context.Context, pimIds []int) (map[int]product, error) {
+	products := map[int]product{}
+	if len(pimIds) == 0 {
+		return products, nil
+	}
+	collection, err := productsCollection()
+	if err != nil {
+		return nil, err
 	}
-	return collectionOperations
+	cur, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": pimIds}})
+	if err != nil {
+		return nil, storageError("find products", err)
+	}
+	var found []product
+	if err = cur.All(ctx, &found); err != nil {
+		return nil, storageError("find products", err)
+	}
+	for _, p := range found {
+		products[p.PimId] = p
+	}
+	return products, nil
+}
+
+// saveReferenceData upserts the outlets and categories of the shop and records their posting counts of the day.
+func saveReferenceData(ctx context.Context, shop Shop, outlets []outlet, categories []category, now *time.Time) error {
+	day := now.Format("2006-01-02")
+
+	outletWrites := []mongo.WriteModel{}
+	outletCountWrites := []mongo.WriteModel{}
+	for _, o := range outlets {
+		id := fmt.Sprintf("%s/%d", shop, o.OutletId)
+		outletWrites = append(outletWrites, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"shop": shop, "outlet_id": o.OutletId, "name": o.Name, "name_full": o.NameFull,
+					"is_active": o.IsActive, "count": o.Count, "last_seen": now},
+				"$setOnInsert": bson.M{"first_seen": now},
+			}).
+			SetUpsert(true))
+		outletCountWrites = append(outletCountWrites, referenceCountWrite("outlet", shop, id, day, o.Count))
+	}
+
+	categoryWrites := []mongo.WriteModel{}
+	categoryCountWrites := []mongo.WriteModel{}
+	for _, c := range categories {
+		id := fmt.Sprintf("%s/%s", shop, c.CategoryId)
+		categoryWrites = append(categoryWrites, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{
+				"$set":         bson.M{"shop": shop, "category_id": c.CategoryId, "name": c.Name, "count": c.Count, "last_seen": now},
+				"$setOnInsert": bson.M{"first_seen": now},
+			}).
+			SetUpsert(true))
+		categoryCountWrites = append(categoryCountWrites, referenceCountWrite("category", shop, id, day, c.Count))
+	}
+
+	if err := bulkWrite(ctx, outletsCollection, outletWrites); err != nil {
+		return err
+	}
+	if err := bulkWrite(ctx, categoriesCollection, categoryWrites); err != nil {
+		return err
+	}
+	if err := bulkWrite(ctx, referenceCountsCollection, outletCountWrites); err != nil {
+		return err
+	}
+	return bulkWrite(ctx, referenceCountsCollection, categoryCountWrites)
+}
+
+func referenceCountWrite(kind string, shop Shop, refId string, day string, count int) mongo.WriteModel {
+	id := fmt.Sprintf("%s/%s/%s", kind, refId, day)
+	return mongo.NewReplaceOneModel().
+		SetFilter(bson.M{"_id": id}).
+		SetReplacement(referenceCount{id, kind, shop, refId, day, count}).
+		SetUpsert(true)
+}
+
+func bulkWrite(ctx context.Context, collectionFunc func() (*mongo.Collection, error), writes []mongo.WriteModel) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	collection, err := collectionFunc()
+	if err != nil {
+		return err
+	}
+	_, err = collection.BulkWrite(ctx, writes)
+	return storageError("bulk write "+collection.Name(), err)
+}
+
+func findOutlets(ctx context.Context) ([]outletReference, error) {
+	collection, err := outletsCollection()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "shop", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, storageError("find outlets", err)
+	}
+	outlets := []outletReference{}
+	err = cur.All(ctx, &outlets)
+	return outlets, storageError("decode outlets", err)
+}
+
+// outletsFilter matches postings of the given outlet ids per shop. Without outlets nothing matches.
+func outletsFilter(outletIdsByShop map[Shop][]int) bson.A {
+	filters := bson.A{}
+	for shop, ids := range outletIdsByShop {
+		filters = append(filters, bson.M{"shop": shop, "outlet.id": bson.M{"$in": ids}})
+	}
+	if len(filters) == 0 {
+		filters = append(filters, bson.M{"_id": bson.M{"$in": bson.A{}}})
+	}
+	return filters
 }
 
-func connect(collectionName string) *mongo.Collection {
+func findCategories(ctx context.Context) ([]categoryReference, error) {
+	collection, err := categoriesCollection()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "shop", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, storageError("find categories", err)
+	}
+	categories := []categoryReference{}
+	err = cur.All(ctx, &categories)
+	return categories, storageError("decode categories", err)
+}
+
+// findCategoryIdsByNames returns the ids of the categories of all shops with one of the given names, ignoring case.
+func findCategoryIdsByNames(ctx context.Context, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return []string{}, nil
+	}
+	collection, err := categoriesCollection()
+	if err != nil {
+		return nil, err
+	}
+	regexes := bson.A{}
+	for _, name := range names {
+		regexes = append(regexes, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(name) + "$", Options: "i"})
+	}
+	filter := bson.M{"name": bson.M{"$in": regexes}}
+	ids, err := collection.Distinct(ctx, "category_id", filter)
+	if err != nil {
+		return nil, storageError("find category ids", err)
+	}
+	categoryIds := []string{}
+	for _, id := range ids {
+		if categoryId, ok := id.(string); ok {
+			categoryIds = append(categoryIds, categoryId)
+		}
+	}
+	return categoryIds, nil
+}
+
+// findStoredQueries returns the stored queries sorted by creation.
+func findStoredQueries(ctx context.Context) ([]storedQuery, error) {
+	collection, err := queriesCollection()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "cre_dat", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, storageError("find queries", err)
+	}
+	queries := []storedQuery{}
+	err = cur.All(ctx, &queries)
+	return queries, storageError("decode queries", err)
+}
+
+// findStoredQuery returns the stored query with the given id or nil if it does not exist.
+func findStoredQuery(ctx context.Context, id string) (*storedQuery, error) {
+	collection, err := queriesCollection()
+	if err != nil {
+		return nil, err
+	}
+	sq := storedQuery{}
+	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&sq)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError("find query", err)
+	}
+	return &sq, nil
+}
+
+// insertStoredQuery stores the query unless there is a query with the same id and returns whether it was inserted.
+func insertStoredQuery(ctx context.Context, sq storedQuery) (bool, error) {
+	collection, err := queriesCollection()
+	if err != nil {
+		return false, err
+	}
+	_, err = collection.InsertOne(ctx, sq)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, storageError("insert query", err)
+	}
+	return true, nil
+}
+
+func replaceStoredQuery(ctx context.Context, sq storedQuery) error {
+	collection, err := queriesCollection()
+	if err != nil {
+		return err
+	}
+	result, err := collection.ReplaceOne(ctx, bson.M{"_id": sq.Id}, sq)
+	if err != nil {
+		return storageError("replace query", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%w: '%s'", ErrQueryNotFound, sq.Id)
+	}
+	return nil
+}
+
+// deleteStoredQuery deletes the query along with its last search time.
+func deleteStoredQuery(ctx context.Context, id string) error {
+	collection, err := queriesCollection()
+	if err != nil {
+		return err
+	}
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return storageError("delete query", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("%w: '%s'", ErrQueryNotFound, id)
+	}
+	operations, err := operationsCollection()
+	if err != nil {
+		return err
+	}
+	_, err = operations.DeleteOne(ctx, bson.M{"_id": id})
+	return storageError("delete search operation", err)
+}
+
+func insertRun(ctx context.Context, r run) error {
+	collection, err := runsCollection()
+	if err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(ctx, r)
+	return storageError("insert run", err)
+}
+
+// findRuns returns the runs of the mode, or of all modes if mode is empty, newest first.
+func findRuns(ctx context.Context, mode string, limit int64, offset int64) ([]run, error) {
+	collection, err := runsCollection()
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{}
+	if mode != "" {
+		filter["mode"] = mode
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "start", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit).SetSkip(offset)
+	cur, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, storageError("find runs", err)
+	}
+	runs := []run{}
+	err = cur.All(ctx, &runs)
+	return runs, storageError("decode runs", err)
+}
+
+// findRun returns the run with the given id or nil if it does not exist.
+func findRun(ctx context.Context, id string) (*run, error) {
+	collection, err := runsCollection()
+	if err != nil {
+		return nil, err
+	}
+	r := run{}
+	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError("find run", err)
+	}
+	return &r, nil
+}
+
+// postingsIndexes are created when the postings collection is first used. The index on pim_id and price serves the
+// price histories.
+var postingsIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "pim_id", Value: 1}, {Key: "price", Value: 1}}},
+}
+
+func postingsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionPostings, "MONGODB_COLLECTION_POSTINGS", "postings", postingsIndexes...)
+}
+
+func operationsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionOperations, "MONGODB_COLLECTION_OPERATIONS", "operations")
+}
+
+func crawlsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionCrawls, "MONGODB_COLLECTION_CRAWLS", "crawls")
+}
+
+func watermarksCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionWatermarks, "MONGODB_COLLECTION_WATERMARKS", "watermarks")
+}
+
+func outletsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionOutlets, "MONGODB_COLLECTION_OUTLETS", "outlets")
+}
+
+func categoriesCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionCategories, "MONGODB_COLLECTION_CATEGORIES", "categories")
+}
+
+func productsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionProducts, "MONGODB_COLLECTION_PRODUCTS", "products")
+}
+
+func queriesCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionQueries, "MONGODB_COLLECTION_QUERIES", "queries")
+}
+
+func runsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionRuns, "MONGODB_COLLECTION_RUNS", "runs")
+}
+
+func referenceCountsCollection() (*mongo.Collection, error) {
+	return lazyCollection(&collectionReferenceCounts, "MONGODB_COLLECTION_REFERENCE_COUNTS", "reference_counts")
+}
+
+// lazyCollection connects to the collection named by the env var on first use, creates the indexes if missing and
+// caches it in collection. A failed connection is not cached, so it is retried on the next use.
+func lazyCollection(collection **mongo.Collection, envKey string, defaultName string, indexes ...mongo.IndexModel) (*mongo.Collection, error) {
+	connectMutex.Lock()
+	defer connectMutex.Unlock()
+	if *collection == nil {
+		connected, err := connect(env(envKey, defaultName))
+		if err != nil {
+			return nil, err
+		}
+		if len(indexes) > 0 {
+			if _, err := connected.Indexes().CreateMany(context.TODO(), indexes); err != nil {
+				return nil, storageError("create indexes of "+connected.Name(), err)
+			}
+		}
+		*collection = connected
+	}
+	return *collection, nil
+}
+
+// connect returns the collection of the shared client, which is connected first if needed. connectMutex must be held.
+func connect(collectionName string) (*mongo.Collection, error) {
+	if mongoClient == nil {
+		client, err := connectClient()
+		if err != nil {
+			return nil, err
+		}
+		mongoClient = client
+	}
+	return mongoClient.Database(env("MONGODB_DB", "fundgrube")).Collection(collectionName), nil
+}
+
+func connectClient() (*mongo.Client, error) {
 	credential := options.Credential{
 		Username: env("MONGODB_USERNAME", "root"),
 		Password: env("MONGODB_PASSWORD", "example"),
@@ -274,16 +1244,15 @@ func connect(collectionName string) *mongo.Collection {
 	// Connect to MongoDB
 	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
-		panic(err)
+		return nil, storageError("connect", err)
 	}
 
 	// Check the connection
 	err = client.Ping(context.TODO(), nil)
 	if err != nil {
-		panic(err)
+		return nil, storageError("ping", err)
 	}
-
-	return client.Database(env("MONGODB_DB", "fundgrube")).Collection(collectionName)
+	return client, nil
 }
 
 func env(key string, defaultValue string) string {
@@ -14,6 +14,8 @@ type PersistenceSuite struct {
 	suite.Suite
 }
 
+var ctx = context.Background()
+
 const PID_NHL = "2822b32a-1057-4b21-ad2d-8d297a88d00c"
 const PID_CHEF_PARTY = "ffd51e3a-01e6-40fc-a6e3-c241fbd88a7a"
 const PID_NECRODANCER = "ffd23648-6353-4c18-93d5-78e0ac838da1"
@@ -38,7 +40,11 @@ func insertPostingsFromJson(err error) {
 	if err = bson.UnmarshalExtJSON(bytes, true, &postings); err != nil {
 		panic(err)
 	}
-	_, err = postingsCollection().InsertMany(context.TODO(), postings)
+	collection, err := postingsCollection()
+	if err != nil {
+		panic(err)
+	}
+	_, err = collection.InsertMany(context.TODO(), postings)
 	if err != nil {
 		panic(err)
 	}
@@ -48,12 +54,36 @@ func TestRunSuite(t *testing.T) {
 	suite.Run(t, new(PersistenceSuite))
 }
 
+func Test_priceFilter(t *testing.T) {
+	assert.Equal(t, bson.M{}, priceFilter(nil, nil))
+	assert.Equal(t, bson.M{"$gte": fPtr(10)}, priceFilter(fPtr(10), nil))
+	assert.Equal(t, bson.M{"$lte": fPtr(20)}, priceFilter(nil, fPtr(20)))
+	assert.Equal(t, bson.M{"$gte": fPtr(10), "$lte": fPtr(20)}, priceFilter(fPtr(10), fPtr(20)))
+}
+
+func Test_efficiencyFilter(t *testing.T) {
+	filter, err := efficiencyFilter("A+")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"eek.label_2017": bson.M{"$ne": true}, "eek.efficiency_class": bson.M{"$in": []string{"A+++", "A++", "A+"}}},
+	}}, filter)
+
+	filter, err = efficiencyFilter("B")
+	assert.NoError(t, err)
+	assert.Len(t, filter["$or"], 2)
+
+	_, err = efficiencyFilter("Z")
+	assert.Error(t, err)
+}
+
 func (suite *PersistenceSuite) Test_connect() {
-	postingsCollection()
+	_, err := postingsCollection()
+	assert.NoError(suite.T(), err)
 }
 
 func (suite *PersistenceSuite) Test_findOne_nonexistent() {
-	posting := FindOne("does-not-exist")
+	posting, err := FindOne(ctx, "does-not-exist")
+	assert.NoError(suite.T(), err)
 	assert.Nil(suite.T(), posting)
 }
 
@@ -64,6 +94,8 @@ func (suite *PersistenceSuite) Test_findOne() {
 		PriceOldString:    "",
 		Price:             10.0,
 		PriceOld:          27.99,
+		TotalPrice:        10.0,
+		Saving:            17.99,
 		DiscountInPercent: 64,
 		ShippingCost:      0,
 		ShippingType:      "shipping",
@@ -71,6 +103,8 @@ func (suite *PersistenceSuite) Test_findOne() {
 		Name:              "Instant Chef Party - [Nintendo Switch]",
 		Url:               []string{"https://assets.mmsrg.com/is/166325/12975367df8e182e57044734f5165e190/c3/-/05154e6b51204fa699e88d114dba9b6d?strip=yes&quality=75&backgroundsize=cover&x=640&y=640"},
 		Text:              "Neu, Verpackungsschaden / Folie kann beschädigt sein. OVP",
+		Condition:         conditionNew,
+		ConditionFlags:    []string{flagDamagedPackaging},
 		Outlet:            postingOutlet{111, "Lübeck"},
 		CategoryId:        "CAT_DE_SAT_786",
 		Brand:             brand{10312, "WILD RIVER"},
@@ -81,7 +115,7 @@ func (suite *PersistenceSuite) Test_findOne() {
 		Active:            true,
 	}
 
-	assert.Equal(suite.T(), expectedPosting, *FindOne(PID_CHEF_PARTY))
+	assert.Equal(suite.T(), expectedPosting, *mustFindOne(PID_CHEF_PARTY))
 }
 
 func (suite *PersistenceSuite) Test_findAll() {
@@ -140,6 +174,62 @@ func (suite *PersistenceSuite) Test_findAll() {
 			"outletId",
 			args{query{OutletId: iPtr(111)}, nil, 100, 0},
 			[]string{PID_CHEF_PARTY},
+		}, {
+			"outletIds",
+			args{query{OutletIds: []int{222, 333}}, nil, 100, 0},
+			[]string{PID_NECRODANCER, PID_ASUS},
+		}, {
+			"outletId and outletIds",
+			args{query{OutletId: iPtr(111), OutletIds: []int{333}}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_ASUS},
+		}, {
+			"categoryIds",
+			args{query{CategoryIds: []string{"CAT_DE_SAT_786"}}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS},
+		}, {
+			"categoryIds; other category",
+			args{query{CategoryIds: []string{"CAT_DE_MM_1"}}, nil, 100, 0},
+			nil,
+		}, {
+			"shipping type",
+			args{query{ShippingType: sPtr("shipping")}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS},
+		}, {
+			"shipping type pickup",
+			args{query{ShippingType: sPtr("pickup")}, nil, 100, 0},
+			nil,
+		}, {
+			"expr",
+			args{query{Expr: sPtr(`text ~ "verpackung" AND NOT brand ~ "nintendo" OR text ~ "ausstellung"`)}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_ASUS},
+		}, {
+			"condition",
+			args{query{Condition: []condition{conditionDisplay, conditionOpenBox}}, nil, 100, 0},
+			[]string{PID_ASUS},
+		}, {
+			"total price max",
+			args{query{TotalPriceMax: fPtr(20.5)}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY},
+		}, {
+			"total price min/max",
+			args{query{TotalPriceMin: fPtr(20.5), PriceMax: fPtr(20.5)}, nil, 100, 0},
+			[]string{PID_NECRODANCER},
+		}, {
+			"sort by total price",
+			args{query{Sort: sPtr("total_price")}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS},
+		}, {
+			"sort by discount",
+			args{query{Sort: sPtr("discount")}, nil, 100, 0},
+			[]string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS},
+		}, {
+			"sort by newest",
+			args{query{Sort: sPtr("newest")}, nil, 100, 0},
+			[]string{PID_NECRODANCER, PID_CHEF_PARTY, PID_ASUS},
+		}, {
+			"sort by saving",
+			args{query{Sort: sPtr("saving")}, nil, 100, 0},
+			[]string{PID_NECRODANCER, PID_CHEF_PARTY, PID_ASUS},
 		}, {
 			"after time",
 			args{query{}, parseDate("2022-10-30T00:00:00Z"), 100, 0},
@@ -157,7 +247,8 @@ func (suite *PersistenceSuite) Test_findAll() {
 
 	for _, tt := range tests {
 		suite.Run(tt.name, func() {
-			postings := FindAll(tt.args.q, tt.args.afterTime, tt.args.limit, tt.args.offset)
+			postings, err := FindAll(ctx, tt.args.q, tt.args.afterTime, tt.args.limit, tt.args.offset)
+			assert.NoError(suite.T(), err)
 			var postingIds []string
 			for _, p := range postings {
 				postingIds = append(postingIds, p.PostingId)
@@ -167,100 +258,262 @@ func (suite *PersistenceSuite) Test_findAll() {
 	}
 }
 
+func (suite *PersistenceSuite) Test_findAll_efficiencyClassMax() {
+	efficient := getExamplePosting("efficient")
+	efficient.EnergyLabel = &energyLabel{EfficiencyClass: "A"}
+	wasteful := getExamplePosting("wasteful")
+	wasteful.EnergyLabel = &energyLabel{EfficiencyClass: "F"}
+	rescaled := getExamplePosting("rescaled")
+	rescaled.EnergyLabel = &energyLabel{EfficiencyClass: "A", Label2017: true}
+	_, err := SaveAllNewOrUpdated(ctx, []posting{efficient, wasteful, rescaled})
+	assert.NoError(suite.T(), err)
+
+	postings, err := FindAll(ctx, query{EfficiencyClassMax: sPtr("B")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.ElementsMatch(suite.T(), []string{efficient.PostingId, rescaled.PostingId}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{EfficiencyClassMax: sPtr("A")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.ElementsMatch(suite.T(), []string{efficient.PostingId, rescaled.PostingId}, toIds(postings))
+
+	efficient.EnergyLabel.EfficiencyClass = "A++"
+	_, err = SaveAllNewOrUpdated(ctx, []posting{efficient})
+	assert.NoError(suite.T(), err)
+	postings, err = FindAll(ctx, query{EfficiencyClassMax: sPtr("A+")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{efficient.PostingId}, toIds(postings))
+}
+
+func (suite *PersistenceSuite) Test_saveReferenceData() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	outlets := []outlet{{OutletId: 111, Name: "Lübeck", NameFull: "MediaMarkt Lübeck", IsActive: true, Count: 42}}
+	categories := []category{{"CAT_DE_SAT_786", "Gaming", 1337}}
+
+	assert.NoError(suite.T(), saveReferenceData(ctx, MM, outlets, categories, &now))
+	later := now.Add(time.Hour)
+	assert.NoError(suite.T(), saveReferenceData(ctx, MM, outlets, categories, &later))
+
+	collection, err := outletsCollection()
+	assert.NoError(suite.T(), err)
+	outletRef := outletReference{}
+	assert.NoError(suite.T(), collection.FindOne(ctx, bson.M{"_id": "MM/111"}).Decode(&outletRef))
+	assert.Equal(suite.T(), "MediaMarkt Lübeck", outletRef.NameFull)
+	assert.Equal(suite.T(), 42, outletRef.Count)
+	assert.True(suite.T(), outletRef.LastSeen.Equal(later))
+	assert.False(suite.T(), outletRef.FirstSeen.After(now))
+
+	categoryIds, err := findCategoryIdsByNames(ctx, []string{"gaming"})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"CAT_DE_SAT_786"}, categoryIds)
+}
+
+func (suite *PersistenceSuite) Test_findAll_byNames() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	assert.NoError(suite.T(), saveReferenceData(ctx, MM, nil, []category{{"CAT_DE_SAT_786", "Gaming", 1}}, &now))
+
+	postings, err := FindAll(ctx, query{OutletName: sPtr("lübeck")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{PID_CHEF_PARTY, PID_NECRODANCER}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{OutletNames: []string{"^l", "marl"}}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{CategoryNames: []string{"Haushalt", "gaming"}}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{CategoryName: sPtr("Gaming")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{PID_CHEF_PARTY, PID_NECRODANCER, PID_ASUS}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{CategoryName: sPtr("Haushalt")}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), postings)
+}
+
+func (suite *PersistenceSuite) Test_findAll_near() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	outlets := []outlet{{OutletId: 111, Name: "Lübeck"}, {OutletId: 222, Name: "Hamburg"}}
+	assert.NoError(suite.T(), saveReferenceData(ctx, MM, outlets, nil, &now))
+
+	postings, err := FindAll(ctx, query{Near: &nearFilter{Outlet: "Lübeck", RadiusKm: 20}}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{PID_CHEF_PARTY}, toIds(postings))
+
+	postings, err = FindAll(ctx, query{Near: &nearFilter{Outlet: "München", RadiusKm: 20}}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), postings)
+}
+
 func (suite *PersistenceSuite) Test_findAll_findNew() {
 	foo := getExamplePosting("foo")
-	SaveAllNewOrUpdated([]posting{foo})
+	_, err := SaveAllNewOrUpdated(ctx, []posting{foo})
+	assert.NoError(suite.T(), err)
 
-	postings := FindAll(query{}, nil, 100, 3)
+	postings, err := FindAll(ctx, query{}, nil, 100, 3)
+	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), 1, len(postings))
-	assertPostingsContainIgnoringDates(suite.T(), postings, foo)
+	assertPostingsContainIgnoringDatesAndScores(suite.T(), postings, foo)
 }
 
 func (suite *PersistenceSuite) Test_saveAll_updateName() {
-	p := FindOne(PID_CHEF_PARTY)
+	p := mustFindOne(PID_CHEF_PARTY)
 
 	p.Name = "New Name"
-	stats := SaveAllNewOrUpdated([]posting{*p})
+	stats, err := SaveAllNewOrUpdated(ctx, []posting{*p})
+	assert.NoError(suite.T(), err)
 
-	assert.Equal(suite.T(), "New Name", FindOne(p.PostingId).Name)
+	assert.Equal(suite.T(), "New Name", mustFindOne(p.PostingId).Name)
 	assert.Equal(suite.T(), 0, stats.Inserted)
 	assert.Equal(suite.T(), 1, stats.Updated)
 }
 
+func (suite *PersistenceSuite) Test_saveAll_score() {
+	cheap := getExamplePosting("cheap")
+	cheap.PimId = 4242
+	cheap.Price = 100
+	expensive := getExamplePosting("expensive")
+	expensive.PimId = 4242
+	expensive.Price = 200
+
+	_, err := SaveAllNewOrUpdated(ctx, []posting{cheap, expensive})
+	assert.NoError(suite.T(), err)
+
+	histories, err := findPriceHistories(ctx, []int{4242, 1111111})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{cheap.PostingId, expensive.PostingId}, historyIds(histories[4242]))
+	assert.Equal(suite.T(), 200.0, histories[4242].Prices[1].Price)
+	assert.Equal(suite.T(), 2, histories[4242].Count)
+	assert.Equal(suite.T(), 150.0, histories[4242].Median)
+	assert.Equal(suite.T(), "Lübeck", histories[1111111].lowest().Outlet)
+	assert.True(suite.T(), histories[1111111].lowest().Date.Equal(*parseDate("2022-10-27T18:10:00.796Z")))
+	assert.Greater(suite.T(), mustFindOne(cheap.PostingId).Score, mustFindOne(expensive.PostingId).Score)
+
+	minScore := mustFindOne(cheap.PostingId).Score
+	found, err := FindAll(ctx, query{ScoreMin: &minScore, Ids: []string{cheap.PostingId, expensive.PostingId}}, nil, 10, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{cheap.PostingId}, toIds(found))
+
+	storedScore := mustFindOne(cheap.PostingId).Score
+	stats, err := SaveAllNewOrUpdated(ctx, []posting{cheap})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, stats.Updated)
+	assert.Equal(suite.T(), storedScore, mustFindOne(cheap.PostingId).Score)
+}
+
 func (suite *PersistenceSuite) Test_saveAll() {
 	alreadySaved := getExamplePosting("alreadySaved")
-	SaveAllNewOrUpdated([]posting{alreadySaved})
+	_, err := SaveAllNewOrUpdated(ctx, []posting{alreadySaved})
+	assert.NoError(suite.T(), err)
 	alreadySaved.Name = "New Name"
 	notSavedYet := getExamplePosting("notSavedYet")
 
-	stats := SaveAllNewOrUpdated([]posting{alreadySaved, notSavedYet})
+	stats, err := SaveAllNewOrUpdated(ctx, []posting{alreadySaved, notSavedYet})
+	assert.NoError(suite.T(), err)
 
-	all := FindAll(query{}, nil, 100, 0)
-	assertPostingsContainIgnoringDates(suite.T(), all, alreadySaved)
-	assertPostingsContainIgnoringDates(suite.T(), all, notSavedYet)
+	all, err := FindAll(ctx, query{}, nil, 100, 0)
+	assert.NoError(suite.T(), err)
+	assertPostingsContainIgnoringDatesAndScores(suite.T(), all, alreadySaved)
+	assertPostingsContainIgnoringDatesAndScores(suite.T(), all, notSavedYet)
 
 	assert.Equal(suite.T(), 1, stats.Inserted)
 	assert.Equal(suite.T(), 1, stats.Updated)
 }
 
 func (suite *PersistenceSuite) Test_insertOrUpdateAll_insertNew() {
-	insertedCount, updatedCount := insertOrUpdateAll([]posting{getExamplePosting("foo")})
+	insertedCount, updatedCount, err := insertOrUpdateAll(ctx, []posting{getExamplePosting("foo")})
+	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), 1, insertedCount)
 	assert.Equal(suite.T(), 0, updatedCount)
 }
 
 func (suite *PersistenceSuite) Test_insertOrUpdateAll_updateExisting() {
-	insertedCount, updatedCount := insertOrUpdateAll([]posting{*FindOne(PID_CHEF_PARTY)})
+	insertedCount, updatedCount, err := insertOrUpdateAll(ctx, []posting{*mustFindOne(PID_CHEF_PARTY)})
+	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), 0, insertedCount)
 	assert.Equal(suite.T(), 1, updatedCount)
 }
 
 func (suite *PersistenceSuite) Test_SetRemainingPostingInactive() {
-	assert.Equal(suite.T(), true, FindOne(PID_ASUS).Active)
-	assert.Equal(suite.T(), true, FindOne(PID_CHEF_PARTY).Active)
-	assert.Equal(suite.T(), true, FindOne(PID_NECRODANCER).Active)
-	SetRemainingPostingInactive(MM, category{"CAT_DE_SAT_786", "Cat1", 1}, []outlet{outl(111), outl(222)}, []string{PID_CHEF_PARTY})
-	assert.Equal(suite.T(), true, FindOne(PID_ASUS).Active) // saturn
-	assert.Equal(suite.T(), true, FindOne(PID_CHEF_PARTY).Active)
-	assert.Equal(suite.T(), false, FindOne(PID_NECRODANCER).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_ASUS).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_CHEF_PARTY).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_NECRODANCER).Active)
+	_, err := SetRemainingPostingInactive(ctx, MM, category{"CAT_DE_SAT_786", "Cat1", 1}, []outlet{outl(111), outl(222)}, []string{PID_CHEF_PARTY})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), true, mustFindOne(PID_ASUS).Active) // saturn
+	assert.Equal(suite.T(), true, mustFindOne(PID_CHEF_PARTY).Active)
+	assert.Equal(suite.T(), false, mustFindOne(PID_NECRODANCER).Active)
 }
 
 func (suite *PersistenceSuite) Test_SetRemainingPostingInactive_noActiveInCategoryAndOutlet() {
-	assert.Equal(suite.T(), true, FindOne(PID_ASUS).Active)
-	assert.Equal(suite.T(), true, FindOne(PID_CHEF_PARTY).Active)
-	assert.Equal(suite.T(), true, FindOne(PID_NECRODANCER).Active)
-	SetRemainingPostingInactive(MM, category{"CAT_DE_SAT_786", "Cat1", 1}, []outlet{outl(111)}, []string{})
-	assert.Equal(suite.T(), true, FindOne(PID_ASUS).Active)        // saturn
-	assert.Equal(suite.T(), false, FindOne(PID_CHEF_PARTY).Active) // outlet 111
-	assert.Equal(suite.T(), true, FindOne(PID_NECRODANCER).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_ASUS).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_CHEF_PARTY).Active)
+	assert.Equal(suite.T(), true, mustFindOne(PID_NECRODANCER).Active)
+	_, err := SetRemainingPostingInactive(ctx, MM, category{"CAT_DE_SAT_786", "Cat1", 1}, []outlet{outl(111)}, []string{})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), true, mustFindOne(PID_ASUS).Active)        // saturn
+	assert.Equal(suite.T(), false, mustFindOne(PID_CHEF_PARTY).Active) // outlet 111
+	assert.Equal(suite.T(), true, mustFindOne(PID_NECRODANCER).Active)
 }
 
 func (suite *PersistenceSuite) Test_saveOperation() {
 	now := time.Now().UTC().Round(time.Millisecond)
 	hash := getExampleHash()
 
-	updateSearchOperation(getExampleQuery(), &now)
-	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now}, *findSearchOperation(hash))
+	assert.NoError(suite.T(), updateSearchOperation(ctx, hash, getExampleQuery(), &now))
+	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now}, *mustFindSearchOperation(hash))
 }
 
 func (suite *PersistenceSuite) Test_updateOperation() {
 	now := time.Now().UTC().Round(time.Millisecond)
 	hash := getExampleHash()
-	updateSearchOperation(getExampleQuery(), &now)
-	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now}, *findSearchOperation(hash))
+	assert.NoError(suite.T(), updateSearchOperation(ctx, hash, getExampleQuery(), &now))
+	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now}, *mustFindSearchOperation(hash))
 
 	now2 := now.AddDate(0, 0, 1)
-	updateSearchOperation(getExampleQuery(), &now2)
-	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now2}, *findSearchOperation(hash))
+	assert.NoError(suite.T(), updateSearchOperation(ctx, hash, getExampleQuery(), &now2))
+	assert.Equal(suite.T(), operation{hash, "description", getExampleQuery(), &now2}, *mustFindSearchOperation(hash))
+}
+
+func (suite *PersistenceSuite) Test_updateLastCrawl() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	c := category{"CAT_DE_SAT_786", "Cat1", 1}
+
+	assert.NoError(suite.T(), updateLastCrawl(ctx, SATURN, c, &now))
+	lastCrawls, err := findLastCrawls(ctx, SATURN)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), now.Equal(lastCrawls[c.CategoryId]))
+
+	lastCrawls, err = findLastCrawls(ctx, MM)
+	assert.NoError(suite.T(), err)
+	assert.NotContains(suite.T(), lastCrawls, c.CategoryId)
+}
+
+func (suite *PersistenceSuite) Test_updateWatermark() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	w := watermark{Shop: MM, PostingIds: []string{PID_CHEF_PARTY, PID_NECRODANCER}, Timestamp: &now}
+
+	assert.NoError(suite.T(), updateWatermark(ctx, w))
+	found, err := findWatermark(ctx, MM)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), w, *found)
+}
+
+func (suite *PersistenceSuite) Test_countActivePostingsByCategory() {
+	counts, err := countActivePostingsByCategory(ctx, MM)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), map[string]int{"CAT_DE_SAT_786": 2}, counts)
 }
 
-func assertPostingsContainIgnoringDates(t *testing.T, postings []posting, contained posting) bool {
+func assertPostingsContainIgnoringDatesAndScores(t *testing.T, postings []posting, contained posting) bool {
 	postingsWithoutDates := []posting{}
 	for _, p := range postings {
 		assert.NotNil(t, p.CreDat)
 		assert.NotNil(t, p.ModDat)
 		p.CreDat = nil
 		p.ModDat = nil
+		p.Score = 0
 		postingsWithoutDates = append(postingsWithoutDates, p)
 	}
 	return assert.Contains(t, postingsWithoutDates, contained)
@@ -290,7 +543,27 @@ func getExamplePosting(prefix string) posting {
 }
 
 func getExampleHash() string {
-	return hashQuery(getExampleQuery())
+	hash, err := hashQuery(getExampleQuery())
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+func mustFindOne(postingId string) *posting {
+	p, err := FindOne(ctx, postingId)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func mustFindSearchOperation(id string) *operation {
+	op, err := findSearchOperation(ctx, id)
+	if err != nil {
+		panic(err)
+	}
+	return op
 }
 
 func getExampleQuery() query {
@@ -300,3 +573,119 @@ func getExampleQuery() query {
 func outl(id int) outlet {
 	return outlet{OutletId: id, Name: "Outlet" + string(rune(id)), Count: 100 + id}
 }
+
+func (suite *PersistenceSuite) Test_classifyConditions() {
+	collection, err := postingsCollection()
+	assert.NoError(suite.T(), err)
+	_, err = collection.UpdateMany(ctx, bson.M{"_id": PID_ASUS}, bson.M{"$unset": bson.M{"condition": "", "condition_flags": ""}})
+	assert.NoError(suite.T(), err)
+	modDat := mustFindOne(PID_ASUS).ModDat
+
+	suite.T().Setenv("MIGRATE", "true")
+	count, err := ClassifyConditions(ctx)
+
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, count)
+	asus := mustFindOne(PID_ASUS)
+	assert.Equal(suite.T(), conditionDisplay, asus.Condition)
+	assert.Equal(suite.T(), []string{flagDisplayUnit}, asus.ConditionFlags)
+	assert.Equal(suite.T(), modDat, asus.ModDat)
+}
+
+func (suite *PersistenceSuite) Test_saveAll_backfilledFieldsKeepModDat() {
+	stored := getExamplePosting("backfilled")
+	stored.CategoryName = ""
+	stored.EnergyLabel = nil
+	_, err := SaveAllNewOrUpdated(ctx, []posting{stored})
+	assert.NoError(suite.T(), err)
+	modDat := mustFindOne(stored.PostingId).ModDat
+
+	crawled := stored
+	crawled.CategoryName = "Gaming"
+	crawled.EnergyLabel = &energyLabel{EfficiencyClass: "B"}
+	stats, err := SaveAllNewOrUpdated(ctx, []posting{crawled})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, stats.Updated)
+	saved := mustFindOne(stored.PostingId)
+	assert.Equal(suite.T(), "Gaming", saved.CategoryName)
+	assert.Equal(suite.T(), "B", saved.EnergyLabel.EfficiencyClass)
+	assert.Equal(suite.T(), modDat, saved.ModDat)
+}
+
+func (suite *PersistenceSuite) Test_fillCategoryNames() {
+	unnamed := getExamplePosting("unnamed")
+	unnamed.Shop = MM
+	unnamed.CategoryId = "CAT_FILL"
+	unnamed.CategoryName = ""
+	_, err := SaveAllNewOrUpdated(ctx, []posting{unnamed})
+	assert.NoError(suite.T(), err)
+	now := time.Now().UTC().Round(time.Millisecond)
+	assert.NoError(suite.T(), saveReferenceData(ctx, MM, []outlet{}, []category{{"CAT_FILL", "Gaming", 1}}, &now))
+	modDat := mustFindOne(unnamed.PostingId).ModDat
+
+	suite.T().Setenv("MIGRATE", "true")
+	count, err := FillCategoryNames(ctx)
+
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, count)
+	filled := mustFindOne(unnamed.PostingId)
+	assert.Equal(suite.T(), "Gaming", filled.CategoryName)
+	assert.Equal(suite.T(), modDat, filled.ModDat)
+}
+
+func (suite *PersistenceSuite) Test_computePrices() {
+	collection, err := postingsCollection()
+	assert.NoError(suite.T(), err)
+	_, err = collection.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"total_price": "", "saving": ""}})
+	assert.NoError(suite.T(), err)
+
+	suite.T().Setenv("MIGRATE", "true")
+	count, err := ComputePrices(ctx)
+
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4, count)
+	necrodancer := mustFindOne(PID_NECRODANCER)
+	assert.Equal(suite.T(), 20.99, necrodancer.TotalPrice)
+	assert.Equal(suite.T(), 19.99, necrodancer.Saving)
+	assert.Equal(suite.T(), 0.0, mustFindOne(PID_ASUS).Saving)
+}
+
+func (suite *PersistenceSuite) Test_refreshProducts() {
+	collection, err := productsCollection()
+	assert.NoError(suite.T(), err)
+	_, err = collection.DeleteMany(ctx, bson.M{})
+	assert.NoError(suite.T(), err)
+	_, err = collection.InsertOne(ctx, product{PimId: 4242, ActivePostings: 3, Outlets: 2, MinPrice: 5})
+	assert.NoError(suite.T(), err)
+	cheap := getExamplePosting("cheap")
+	cheap.PimId = 1111111
+	cheap.Price = 5
+	cheap.Outlet = postingOutlet{222, "Lübeck"}
+	_, err = SaveAllNewOrUpdated(ctx, []posting{cheap})
+	assert.NoError(suite.T(), err)
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	count, err := refreshProducts(ctx, &now)
+
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, count)
+	products, err := findProducts(ctx, []int{1111111, 4242})
+	assert.NoError(suite.T(), err)
+	chefParty := products[1111111]
+	assert.Equal(suite.T(), 5.0, chefParty.MinPrice)
+	assert.Equal(suite.T(), 10.0, chefParty.MaxPrice)
+	assert.Equal(suite.T(), 7.5, chefParty.MedianPrice)
+	assert.Equal(suite.T(), 2, chefParty.ActivePostings)
+	assert.Equal(suite.T(), 2, chefParty.Outlets)
+	assert.True(suite.T(), chefParty.LastSeen.Equal(now))
+	assert.True(suite.T(), chefParty.FirstSeen.Equal(*parseDate("2022-10-27T18:10:00.796Z")))
+	assert.Equal(suite.T(), product{PimId: 4242, MinPrice: 5}, products[4242])
+}
+
+func historyIds(h priceHistory) []string {
+	ids := []string{}
+	for _, p := range h.Prices {
+		ids = append(ids, p.PostingId)
+	}
+	return ids
+}
@@ -1,11 +1,14 @@
 package crawler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -26,8 +29,16 @@ type pageRequest struct {
 	offset int
 }
 
-func RefreshPostingsForCategory(shop Shop, mockedPostings bool, c category) (*CrawlerStats, error) {
-	outlets, err := fetchOutlets(shop, c, mockedPostings)
+// RefreshPostingsForCategory crawls a category slice by slice of outlets. A failing slice is skipped, so its postings
+// are neither saved nor set inactive, and the remaining slices are still crawled. The returned stats cover the
+// successful slices even if an error is returned.
+//
+// Cancelling ctx stops the crawl before the next slice. A slice whose postings were fetched completely is always saved
+// and its remaining postings set inactive, so a category is never left partially deactivated.
+//
+// Storage errors are returned immediately since the remaining slices would fail the same way.
+func RefreshPostingsForCategory(ctx context.Context, shop Shop, mockedPostings bool, c category) (*CrawlerStats, error) {
+	outlets, err := fetchOutlets(ctx, shop, c, mockedPostings)
 	if err != nil {
 		return nil, err
 	}
@@ -37,16 +48,43 @@ func RefreshPostingsForCategory(shop Shop, mockedPostings bool, c category) (*Cr
 	}
 
 	stats := CrawlerStats{}
-	for _, outlets := range sliceOutlets(outlets) {
-		postings, crawlStats, err := refreshPostingsForCategoryAndOutlets(shop, mockedPostings, c, outlets)
+	outletSlices := sliceOutlets(outlets)
+	var firstErr error
+	failedSlices := 0
+	for _, outlets := range outletSlices {
+		if ctx.Err() != nil {
+			return &stats, ctx.Err()
+		}
+		postings, crawlStats, err := refreshPostingsForCategoryAndOutlets(ctx, shop, mockedPostings, c, outlets)
+		if ctx.Err() != nil {
+			return &stats, ctx.Err()
+		}
 		if err != nil {
-			return nil, err
+			log.Warnf("Skipping outlets %v of '%s' for %s: %s", outletIds(outlets), c.Name, shop, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failedSlices++
+			continue
 		}
 		stats.add(crawlStats)
-		stats.add(SaveAllNewOrUpdated(postings))
-		stats.add(SetRemainingPostingInactive(shop, c, outlets, toIds(postings)))
+		dbCtx := uncancelable{ctx}
+		saveStats, err := SaveAllNewOrUpdated(dbCtx, postings)
+		if err != nil {
+			return &stats, err
+		}
+		stats.add(saveStats)
+		inactiveStats, err := SetRemainingPostingInactive(dbCtx, shop, c, outlets, toIds(postings))
+		if err != nil {
+			return &stats, err
+		}
+		stats.add(inactiveStats)
 	}
 	log.Infof("Refreshed '%s' for %s. %s", c.Name, shop, stats.String())
+
+	if firstErr != nil {
+		return &stats, fmt.Errorf("%d of %d outlet slices failed: %w", failedSlices, len(outletSlices), firstErr)
+	}
 	return &stats, nil
 }
 
@@ -58,10 +96,49 @@ func toIds(postingsForCategory []posting) []string {
 	return ids
 }
 
-func filterCategories(categories []category, blacklist []string) []category {
+// filterCategories removes blacklisted categories and, if a whitelist is given, all categories not on it. Both lists
+// contain category ids or names.
+func filterCategories(categories []category, whitelist []string, blacklist []string) []category {
+	ret := []category{}
+	for _, c := range categories {
+		if matchesAny(c, blacklist) {
+			continue
+		}
+		if len(whitelist) > 0 && !matchesAny(c, whitelist) {
+			continue
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// filterPostingsByCategory removes the postings of categories filterCategories would remove.
+func filterPostingsByCategory(postings []posting, whitelist []string, blacklist []string) []posting {
+	ret := []posting{}
+	for _, p := range postings {
+		c := category{CategoryId: p.CategoryId, Name: p.CategoryName}
+		if len(filterCategories([]category{c}, whitelist, blacklist)) > 0 {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func matchesAny(c category, refs []string) bool {
+	for _, ref := range refs {
+		if c.matches(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterDueCategories returns the categories whose crawl interval has passed since their last crawl.
+func filterDueCategories(categories []category, lastCrawls map[string]time.Time, config globalConfig, now time.Time) []category {
 	ret := []category{}
 	for _, c := range categories {
-		if !Contains(blacklist, c.CategoryId) {
+		lastCrawl, ok := lastCrawls[c.CategoryId]
+		if !ok || !now.Before(lastCrawl.Add(config.crawlInterval(c))) {
 			ret = append(ret, c)
 		}
 	}
@@ -77,7 +154,7 @@ func Contains[T comparable](s []T, e T) bool {
 	return false
 }
 
-func refreshPostingsForCategoryAndOutlets(shop Shop, mockedPostings bool, c category, outlets []outlet) ([]posting, *CrawlerStats, error) {
+func refreshPostingsForCategoryAndOutlets(ctx context.Context, shop Shop, mockedPostings bool, c category, outlets []outlet) ([]posting, *CrawlerStats, error) {
 	start := time.Now()
 
 	postings := []posting{}
@@ -85,7 +162,7 @@ func refreshPostingsForCategoryAndOutlets(shop Shop, mockedPostings bool, c cate
 	limit := 90
 	offset := 0
 	for true {
-		postingsResponse, err := fetchSinglePageOfPostings(shop, outlets, []category{c}, nil, limit, offset, mockedPostings)
+		postingsResponse, err := fetchSinglePageOfPostings(ctx, shop, outlets, []category{c}, nil, limit, offset, mockedPostings)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -100,29 +177,105 @@ func refreshPostingsForCategoryAndOutlets(shop Shop, mockedPostings bool, c cate
 
 	stats := CrawlerStats{Postings: len(postings), TookApi: time.Since(start)}
 	log.Infof("Crawled %d outlets for category '%s'. %s", len(outlets), c.Name, stats.String())
-	return preparePostings(shop, postings), &stats, nil
+	postings, err := preparePostings(shop, postings)
+	if err != nil {
+		return nil, nil, err
+	}
+	return withCategoryNames(postings, []category{c}), &stats, nil
 }
 
-func refreshOnlyNewPostingsForShop(shop Shop) (*CrawlerStats, error) {
+// watermarkSize is the number of newest posting ids stored as watermark. Several ids are kept since single postings
+// disappear when they are sold.
+const watermarkSize = 30
+
+// refreshOnlyNewPostingsForShop pages through the newest postings of the shop until one of the postings stored in the
+// watermark of the previous run is found. It returns whether the watermark was reached or all postings were crawled.
+// The stats of the pages crawled so far are returned along with an error as well.
+func refreshOnlyNewPostingsForShop(ctx context.Context, shop Shop) (*CrawlerStats, bool, error) {
+	previous, err := findWatermark(ctx, shop)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dbCtx := uncancelable{ctx}
 	stats := CrawlerStats{}
+	var next *watermark
+	reached := false
+	// api always returns same page if limit >= 100 is requested
+	limit := 90
+	offset := 0
 	for true {
-		limit := 90
-		offset := 0
-		postingsResponse, err := fetchSinglePageOfPostings(shop, nil, nil, nil, limit, offset, false)
+		start := time.Now()
+		postingsResponse, err := fetchSinglePageOfPostings(ctx, shop, nil, nil, nil, limit, offset, false)
 		if err != nil {
-			return nil, err
+			return &stats, false, err
+		}
+		stats.add(&CrawlerStats{Postings: len(postingsResponse.Postings), TookApi: time.Since(start)})
+		postings, err := preparePostings(shop, postingsResponse.Postings)
+		if err != nil {
+			return &stats, false, err
+		}
+		postings = withCategoryNames(postings, postingsResponse.Categories)
+		if next == nil {
+			next = &watermark{Shop: shop, PostingIds: toIds(postings), Timestamp: now()}
+			if len(next.PostingIds) > watermarkSize {
+				next.PostingIds = next.PostingIds[:watermarkSize]
+			}
 		}
-		stats.add(&CrawlerStats{Postings: len(postingsResponse.Postings)})
-		saveStats := SaveAllNewOrUpdated(preparePostings(shop, postingsResponse.Postings))
 
+		postings, reached = cutAtWatermark(postings, previous)
+		postings = filterPostingsByCategory(postings, CONFIG.GlobalConfig.Categories, CONFIG.GlobalConfig.BlacklistedCategories)
+		saveStats, err := SaveAllNewOrUpdated(dbCtx, postings)
+		if err != nil {
+			return &stats, false, err
+		}
 		stats.add(saveStats)
+
+		// api cannot request offset > 990
 		offset = offset + limit
-		if saveStats.Inserted == 0 || offset+limit > 990 {
-			log.Warnf("Finish crawling %s because no new postings on page. %s", shop, stats.String())
+		if !postingsResponse.HasMorePages {
+			reached = true
+		}
+		if reached || offset > 990 {
 			break
 		}
 	}
-	return &stats, nil
+
+	if next != nil {
+		err = updateWatermark(dbCtx, *next)
+		if err != nil {
+			return &stats, false, err
+		}
+	}
+	log.Infof("Fetched new postings of %s, watermark reached: %t. %s", shop, reached, stats.String())
+	return &stats, reached, nil
+}
+
+// cutAtWatermark returns the postings before the first posting of the watermark and whether it was found.
+func cutAtWatermark(postings []posting, w *watermark) ([]posting, bool) {
+	if w == nil {
+		return postings, false
+	}
+	for i, p := range postings {
+		if Contains(w.PostingIds, p.PostingId) {
+			return postings[:i], true
+		}
+	}
+	return postings, false
+}
+
+// categoriesWithNewPostings returns the categories whose posting count in the api exceeds the number of active
+// postings in the db and the sum of the differences as estimate of missed postings.
+func categoriesWithNewPostings(categories []category, activeCounts map[string]int) ([]category, int) {
+	ret := []category{}
+	missed := 0
+	for _, c := range categories {
+		if diff := c.Count - activeCounts[c.CategoryId]; diff > 0 {
+			ret = append(ret, c)
+			missed = missed + diff
+		}
+	}
+	return ret, missed
 }
 
 func sliceOutlets(outlets []outlet) [][]outlet {
@@ -145,38 +298,94 @@ func sliceOutlets(outlets []outlet) [][]outlet {
 	return ret
 }
 
-func preparePostings(shop Shop, postings []posting) []posting {
+func preparePostings(shop Shop, postings []posting) ([]posting, error) {
 	for i, p := range postings {
-		postings[i] = preparePosting(shop, p)
+		prepared, err := preparePosting(shop, p)
+		if err != nil {
+			return nil, err
+		}
+		postings[i] = prepared
 	}
-	return postings
+	return postings, nil
 }
 
-func preparePosting(shop Shop, posting posting) posting {
+func preparePosting(shop Shop, posting posting) (posting, error) {
+	shopDefinition, err := CONFIG.shop(shop)
+	if err != nil {
+		return posting, err
+	}
+	shopUrl, err := buildUrl(shop, []outlet{{OutletId: posting.Outlet.OutletId}}, []category{{CategoryId: posting.CategoryId}}, &posting.Brand, nil)
+	if err != nil {
+		return posting, err
+	}
 	posting.Shop = shop
-	posting.ShopUrl = buildUrl(shop, []outlet{{OutletId: posting.Outlet.OutletId}}, []category{{CategoryId: posting.CategoryId}}, &posting.Brand, nil)
+	posting.ShopUrl = shopUrl
+	posting.Currency = shopDefinition.Currency
 	posting.Price, _ = strconv.ParseFloat(posting.PriceString, 64)
 	posting.PriceOld, _ = strconv.ParseFloat(posting.PriceOldString, 64)
 	posting.PriceString = ""
 	posting.PriceOldString = ""
+	posting.TotalPrice = posting.totalPrice()
+	posting.Saving = posting.saving()
 	posting.Active = true
+	posting.Condition, posting.ConditionFlags = classifyCondition(posting.Text, CONFIG.GlobalConfig.ConditionRules)
+	if posting.EnergyLabel != nil && posting.EnergyLabel.EfficiencyClass == "" {
+		posting.EnergyLabel = nil
+	}
 	for i := range posting.Url {
 		posting.Url[i] = fmt.Sprintf("%s?strip=yes&quality=75&backgroundsize=cover&x=640&y=640", posting.Url[i])
 	}
-	return posting
+	return posting, nil
+}
+
+func (p posting) totalPrice() float64 {
+	if p.ShippingType == "shipping" {
+		return roundCents(p.Price + p.ShippingCost)
+	}
+	return p.Price
+}
+
+func (p posting) saving() float64 {
+	if p.PriceOld == 0 {
+		return 0
+	}
+	return roundCents(p.PriceOld - p.Price)
 }
 
-func fetchCategories(shop Shop, mockedPostings bool) ([]category, error) {
-	postingsResponse, err := fetchSinglePageOfPostings(shop, nil, nil, nil, 1, 0, mockedPostings)
+func roundCents(price float64) float64 {
+	return math.Round(price*100) / 100
+}
+
+// withCategoryNames sets the name of the category of each posting if it is contained in categories.
+func withCategoryNames(postings []posting, categories []category) []posting {
+	for i, p := range postings {
+		for _, c := range categories {
+			if c.CategoryId == p.CategoryId {
+				postings[i].CategoryName = c.Name
+			}
+		}
+	}
+	return postings
+}
+
+// fetchCategories fetches the categories of the shop. The categories and outlets of the unfiltered response are saved
+// as reference data along with their total posting counts.
+func fetchCategories(ctx context.Context, shop Shop, mockedPostings bool) ([]category, error) {
+	postingsResponse, err := fetchSinglePageOfPostings(ctx, shop, nil, nil, nil, 1, 0, mockedPostings)
 	if err != nil {
 		return nil, err
 	}
 	log.Infof("Discovered %d Categories for %s", len(postingsResponse.Categories), shop)
-	return postingsResponse.Categories, err
+
+	err = saveReferenceData(uncancelable{ctx}, shop, postingsResponse.Outlets, postingsResponse.Categories, now())
+	if err != nil {
+		return nil, err
+	}
+	return postingsResponse.Categories, nil
 }
 
-func fetchOutlets(shop Shop, c category, mockedPostings bool) ([]outlet, error) {
-	postingsResponse, err := fetchSinglePageOfPostings(shop, nil, []category{c}, nil, 1, 0, mockedPostings)
+func fetchOutlets(ctx context.Context, shop Shop, c category, mockedPostings bool) ([]outlet, error) {
+	postingsResponse, err := fetchSinglePageOfPostings(ctx, shop, nil, []category{c}, nil, 1, 0, mockedPostings)
 	if err != nil {
 		return nil, err
 	}
@@ -184,9 +393,16 @@ func fetchOutlets(shop Shop, c category, mockedPostings bool) ([]outlet, error)
 	return postingsResponse.Outlets, err
 }
 
-func fetchSinglePageOfPostings(shop Shop, outlets []outlet, categories []category, brand *brand, limit int, offset int, mockedPostings bool) (*postingsResponse, error) {
-	urlString := buildUrl(shop, outlets, categories, brand, &pageRequest{limit, offset})
-	responseBodyReader, err := getResponseBody(urlString, mockedPostings)
+func fetchSinglePageOfPostings(ctx context.Context, shop Shop, outlets []outlet, categories []category, brand *brand, limit int, offset int, mockedPostings bool) (*postingsResponse, error) {
+	shopDefinition, err := CONFIG.shop(shop)
+	if err != nil {
+		return nil, err
+	}
+	urlString, err := buildUrl(shop, outlets, categories, brand, &pageRequest{limit, offset})
+	if err != nil {
+		return nil, err
+	}
+	responseBodyReader, err := getResponseBody(ctx, urlString, shopDefinition.Locale, apiLabels(shop, categories), mockedPostings)
 	if err != nil {
 		return nil, err
 	}
@@ -213,33 +429,43 @@ func fetchSinglePageOfPostings(shop Shop, outlets []outlet, categories []categor
 	return &postingResponse, nil
 }
 
-func getResponseBody(url string, mockedResponse bool) (io.ReadCloser, error) {
+func getResponseBody(ctx context.Context, url string, locale string, labels prometheus.Labels, mockedResponse bool) (io.ReadCloser, error) {
 	if mockedResponse {
 		return getResponseBodyFromMock()
 	}
-	return getResponseBodyFromServer(url, true)
+	return getResponseBodyFromServer(ctx, url, locale, labels, true)
 }
 
-func getResponseBodyFromServer(url string, retryable bool) (io.ReadCloser, error) {
+// getResponseBodyFromServer requests the url and records latency, status and retries in the metrics with labels.
+func getResponseBodyFromServer(ctx context.Context, url string, locale string, labels prometheus.Labels, retryable bool) (io.ReadCloser, error) {
 	client := getClientWithTimeout(retryable)
 
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/97.0.4692.71 Safari/537.36")
+	if locale != "" {
+		request.Header.Set("Accept-Language", locale)
+	}
 
 	log.Debugf("Querying: %s", url)
+	start := time.Now()
 	response, err := client.Do(request)
 	if err != nil {
-		if strings.Contains(err.Error(), "context deadline exceeded") && retryable {
+		observeApiResponse(labels, time.Since(start), 0)
+		// only retry client timeouts, not a cancelled or expired ctx
+		if strings.Contains(err.Error(), "context deadline exceeded") && retryable && ctx.Err() == nil {
 			log.Warnf("Retrying call failed with: %s", err.Error())
-			return getResponseBodyFromServer(url, false)
+			apiRetries.With(labels).Inc()
+			return getResponseBodyFromServer(ctx, url, locale, labels, false)
 		}
 		return nil, err
 	}
+	observeApiResponse(labels, time.Since(start), response.StatusCode)
 	if response.StatusCode > 200 {
-		return nil, errors.New(fmt.Sprintf("Http Status %d on call of '%s'", response.StatusCode, url))
+		response.Body.Close()
+		return nil, &ErrApiStatus{Code: response.StatusCode, URL: url}
 	}
 	responseBody := response.Body
 	return responseBody, err
@@ -252,11 +478,15 @@ func getClientWithTimeout(retryable bool) http.Client {
 	return http.Client{Timeout: 10 * time.Second}
 }
 
-func buildUrl(shop Shop, outlets []outlet, categories []category, brand *brand, pageRequest *pageRequest) string {
+func buildUrl(shop Shop, outlets []outlet, categories []category, brand *brand, pageRequest *pageRequest) (string, error) {
 	isApiRequest := pageRequest != nil
-	u, err := url.Parse(buildBaseUrl(shop, isApiRequest))
+	baseUrl, err := buildBaseUrl(shop, isApiRequest)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(baseUrl)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	q := u.Query()
@@ -275,7 +505,7 @@ func buildUrl(shop Shop, outlets []outlet, categories []category, brand *brand,
 	}
 
 	u.RawQuery = q.Encode()
-	return u.String()
+	return u.String(), nil
 }
 
 func commaSeparatedCategoryIds(categories []category) string {
@@ -302,21 +532,15 @@ func outletIds(outlets []outlet) []int {
 	return outletIds
 }
 
-func buildBaseUrl(shop Shop, isApiRequest bool) string {
-	if shop == SATURN {
-		if isApiRequest {
-			return "https://www.saturn.de/de/data/fundgrube/api/postings"
-		}
-		return "https://www.saturn.de/de/data/fundgrube"
+func buildBaseUrl(shop Shop, isApiRequest bool) (string, error) {
+	shopDefinition, err := CONFIG.shop(shop)
+	if err != nil {
+		return "", err
 	}
-	if shop == MM {
-		if isApiRequest {
-			return "https://www.mediamarkt.de/de/data/fundgrube/api/postings"
-		}
-		return "https://www.mediamarkt.de/de/data/fundgrube"
+	if isApiRequest {
+		return shopDefinition.ApiUrl, nil
 	}
-
-	panic(fmt.Sprintf("Unkown Shop %s", shop))
+	return shopDefinition.ShopUrl, nil
 }
 
 func getResponseBodyFromMock() (io.ReadCloser, error) {
@@ -328,6 +552,24 @@ func getResponseBodyFromMock() (io.ReadCloser, error) {
 	return io.NopCloser(file), nil
 }
 
+// uncancelable keeps the values of its parent context but not its cancellation. It is used to finish a unit of work
+// that must not be interrupted halfway, e.g. saving postings and setting the remaining ones inactive.
+type uncancelable struct {
+	context.Context
+}
+
+func (uncancelable) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (uncancelable) Done() <-chan struct{} {
+	return nil
+}
+
+func (uncancelable) Err() error {
+	return nil
+}
+
 func envBool(key string) bool {
 	return os.Getenv(key) == "true"
 }
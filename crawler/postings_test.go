@@ -1,8 +1,13 @@
 package crawler
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func Test_preparePosting(t *testing.T) {
@@ -38,10 +43,14 @@ func Test_preparePosting(t *testing.T) {
 				Price:             12.34,
 				PriceString:       "",
 				PriceOld:          24.68,
+				TotalPrice:        12.34,
+				Saving:            12.34,
 				PriceOldString:    "",
 				DiscountInPercent: 50,
 				Shop:              MM,
 				ShopUrl:           "https://www.mediamarkt.de/de/data/fundgrube?brands=Sony&categorieIds=CAT_ID&outletIds=100",
+				Currency:          "EUR",
+				Condition:         conditionUnknown,
 				Url: []string{
 					"https://foo.bar?strip=yes&quality=75&backgroundsize=cover&x=640&y=640",
 					"https://the.back?strip=yes&quality=75&backgroundsize=cover&x=640&y=640",
@@ -52,7 +61,9 @@ func Test_preparePosting(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equalf(t, tt.want, preparePosting(tt.args.shop, tt.args.p), "preparePosting(%v, %v)", tt.args.shop, tt.args.p)
+			prepared, err := preparePosting(tt.args.shop, tt.args.p)
+			assert.NoError(t, err)
+			assert.Equalf(t, tt.want, prepared, "preparePosting(%v, %v)", tt.args.shop, tt.args.p)
 		})
 	}
 }
@@ -96,10 +107,14 @@ func Test_preparePostings(t *testing.T) {
 				Price:             12.34,
 				PriceString:       "",
 				PriceOld:          24.68,
+				TotalPrice:        12.34,
+				Saving:            12.34,
 				PriceOldString:    "",
 				DiscountInPercent: 50,
 				Shop:              MM,
 				ShopUrl:           "https://www.mediamarkt.de/de/data/fundgrube?brands=Sony&categorieIds=CAT_ID&outletIds=100",
+				Currency:          "EUR",
+				Condition:         conditionUnknown,
 				Url: []string{
 					"https://foo.bar?strip=yes&quality=75&backgroundsize=cover&x=640&y=640",
 					"https://the.back?strip=yes&quality=75&backgroundsize=cover&x=640&y=640",
@@ -110,7 +125,8 @@ func Test_preparePostings(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			postings := preparePostings(tt.args.shop, tt.args.postings)
+			postings, err := preparePostings(tt.args.shop, tt.args.postings)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.want, postings)
 		})
 	}
@@ -125,34 +141,34 @@ func Test_sliceOutlets(t *testing.T) {
 		{
 			"three outlets",
 			[]outlet{
-				{1, "1", 500},
-				{2, "2", 400},
-				{3, "3", 300},
-				{4, "4", 300},
-				{5, "5", 400},
+				{OutletId: 1, Name: "1", Count: 500},
+				{OutletId: 2, Name: "2", Count: 400},
+				{OutletId: 3, Name: "3", Count: 300},
+				{OutletId: 4, Name: "4", Count: 300},
+				{OutletId: 5, Name: "5", Count: 400},
 			},
 			[][]outlet{
 				{
-					{1, "1", 500},
-					{2, "2", 400},
+					{OutletId: 1, Name: "1", Count: 500},
+					{OutletId: 2, Name: "2", Count: 400},
 				}, {
-					{3, "3", 300},
-					{4, "4", 300},
+					{OutletId: 3, Name: "3", Count: 300},
+					{OutletId: 4, Name: "4", Count: 300},
 				}, {
-					{5, "5", 400},
+					{OutletId: 5, Name: "5", Count: 400},
 				},
 			},
 		}, {
 			"huge outlet",
 			[]outlet{
-				{1, "1", 991},
-				{2, "2", 400},
+				{OutletId: 1, Name: "1", Count: 991},
+				{OutletId: 2, Name: "2", Count: 400},
 			},
 			[][]outlet{
 				{
-					{1, "1", 991},
+					{OutletId: 1, Name: "1", Count: 991},
 				}, {
-					{2, "2", 400},
+					{OutletId: 2, Name: "2", Count: 400},
 				},
 			},
 		}, {
@@ -186,8 +202,8 @@ func Test_buildUrl(t *testing.T) {
 			args{
 				MM,
 				[]outlet{
-					{23, "Duisburg", 17},
-					{24, "Düsseldorf", 18},
+					{OutletId: 23, Name: "Duisburg", Count: 17},
+					{OutletId: 24, Name: "Düsseldorf", Count: 18},
 				},
 				[]category{
 					category{CategoryId: "CAT_ID", Name: "Category", Count: 1234},
@@ -221,11 +237,18 @@ func Test_buildUrl(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equalf(t, tt.want, buildUrl(tt.args.shop, tt.args.outlets, tt.args.categories, tt.args.brand, tt.args.pageRequest), "buildUrl(%v, %v, %v, %v, %v)", tt.args.shop, tt.args.outlets, tt.args.categories, tt.args.brand, tt.args.pageRequest)
+			url, err := buildUrl(tt.args.shop, tt.args.outlets, tt.args.categories, tt.args.brand, tt.args.pageRequest)
+			assert.NoError(t, err)
+			assert.Equalf(t, tt.want, url, "buildUrl(%v, %v, %v, %v, %v)", tt.args.shop, tt.args.outlets, tt.args.categories, tt.args.brand, tt.args.pageRequest)
 		})
 	}
 }
 
+func Test_buildUrl_unknownShop(t *testing.T) {
+	_, err := buildUrl("UNKNOWN", nil, nil, nil, nil)
+	assert.ErrorIs(t, err, ErrUnknownShop)
+}
+
 func Test_commaSeparatedOutletIds(t *testing.T) {
 	type args struct {
 		outlets []outlet
@@ -265,6 +288,7 @@ func Test_commaSeparatedOutletIds(t *testing.T) {
 func Test_filterCategories(t *testing.T) {
 	type args struct {
 		categories []category
+		whitelist  []string
 		blacklist  []string
 	}
 	tests := []struct {
@@ -277,6 +301,7 @@ func Test_filterCategories(t *testing.T) {
 			args{
 				[]category{},
 				[]string{},
+				[]string{},
 			},
 			[]category{},
 		}, {
@@ -287,6 +312,7 @@ func Test_filterCategories(t *testing.T) {
 					{"CAT_2", "Cat2", 2},
 				},
 				[]string{},
+				[]string{},
 			},
 			[]category{
 				{"CAT_1", "Cat1", 1},
@@ -299,16 +325,45 @@ func Test_filterCategories(t *testing.T) {
 					{"CAT_1", "Cat1", 1},
 					{"CAT_2", "Cat2", 2},
 				},
+				nil,
 				[]string{"CAT_1"},
 			},
 			[]category{
 				{"CAT_2", "Cat2", 2},
 			},
+		}, {
+			"whitelist by id and name",
+			args{
+				[]category{
+					{"CAT_1", "Cat1", 1},
+					{"CAT_2", "Cat2", 2},
+					{"CAT_3", "Cat3", 3},
+				},
+				[]string{"CAT_1", "Cat2"},
+				nil,
+			},
+			[]category{
+				{"CAT_1", "Cat1", 1},
+				{"CAT_2", "Cat2", 2},
+			},
+		}, {
+			"blacklist wins over whitelist",
+			args{
+				[]category{
+					{"CAT_1", "Cat1", 1},
+					{"CAT_2", "Cat2", 2},
+				},
+				[]string{"CAT_1", "CAT_2"},
+				[]string{"Cat1"},
+			},
+			[]category{
+				{"CAT_2", "Cat2", 2},
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equalf(t, tt.want, filterCategories(tt.args.categories, tt.args.blacklist), "filterCategories(%v, %v)", tt.args.categories, tt.args.blacklist)
+			assert.Equalf(t, tt.want, filterCategories(tt.args.categories, tt.args.whitelist, tt.args.blacklist), "filterCategories(%v, %v, %v)", tt.args.categories, tt.args.whitelist, tt.args.blacklist)
 		})
 	}
 }
@@ -342,3 +397,204 @@ func Test_toIds(t *testing.T) {
 		})
 	}
 }
+
+func Test_getResponseBodyFromServer_apiStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	_, err := getResponseBodyFromServer(context.Background(), server.URL, "de-DE", apiLabels(SATURN, nil), true)
+
+	var statusErr *ErrApiStatus
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, &ErrApiStatus{Code: http.StatusUnprocessableEntity, URL: server.URL}, statusErr)
+}
+
+func Test_globalConfig_crawlInterval_idBeforeName(t *testing.T) {
+	config := globalConfig{CrawlInterval: time.Hour, CategoryIntervals: map[string]time.Duration{
+		"Gaming": 10 * time.Minute,
+		"CAT_1":  time.Minute,
+	}}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Minute, config.crawlInterval(category{"CAT_1", "Gaming", 1}))
+	}
+	assert.Equal(t, 10*time.Minute, config.crawlInterval(category{"CAT_2", "Gaming", 1}))
+	assert.Equal(t, time.Hour, config.crawlInterval(category{"CAT_3", "", 1}))
+}
+
+func Test_filterDueCategories(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	gaming := category{"CAT_1", "Gaming", 1}
+	household := category{"CAT_2", "Haushalt", 2}
+	other := category{"CAT_3", "Sonstige Produkte", 3}
+	config := globalConfig{CategoryIntervals: map[string]time.Duration{
+		"Gaming":   10 * time.Minute,
+		"Haushalt": time.Hour,
+	}}
+
+	tests := []struct {
+		name       string
+		lastCrawls map[string]time.Time
+		want       []category
+	}{
+		{
+			"never crawled",
+			map[string]time.Time{},
+			[]category{gaming, household, other},
+		}, {
+			"intervals passed",
+			map[string]time.Time{"CAT_1": now.Add(-10 * time.Minute), "CAT_2": now.Add(-2 * time.Hour), "CAT_3": now},
+			[]category{gaming, household, other},
+		}, {
+			"intervals not passed",
+			map[string]time.Time{"CAT_1": now.Add(-5 * time.Minute), "CAT_2": now.Add(-30 * time.Minute), "CAT_3": now},
+			[]category{other},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, filterDueCategories([]category{gaming, household, other}, tt.lastCrawls, config, now))
+		})
+	}
+}
+
+func Test_cutAtWatermark(t *testing.T) {
+	postings := []posting{{PostingId: "new1"}, {PostingId: "new2"}, {PostingId: "old1"}, {PostingId: "old2"}}
+	tests := []struct {
+		name        string
+		watermark   *watermark
+		want        []posting
+		wantReached bool
+	}{
+		{
+			"no watermark",
+			nil,
+			postings,
+			false,
+		}, {
+			"watermark not on page",
+			&watermark{PostingIds: []string{"older"}},
+			postings,
+			false,
+		}, {
+			"watermark on page",
+			&watermark{PostingIds: []string{"sold", "old1", "old2"}},
+			[]posting{{PostingId: "new1"}, {PostingId: "new2"}},
+			true,
+		}, {
+			"watermark is first posting",
+			&watermark{PostingIds: []string{"new1"}},
+			[]posting{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reached := cutAtWatermark(postings, tt.watermark)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantReached, reached)
+		})
+	}
+}
+
+func Test_categoriesWithNewPostings(t *testing.T) {
+	categories := []category{
+		{"CAT_1", "Cat1", 10},
+		{"CAT_2", "Cat2", 20},
+		{"CAT_3", "Cat3", 30},
+	}
+	activeCounts := map[string]int{"CAT_1": 10, "CAT_2": 15}
+
+	got, missed := categoriesWithNewPostings(categories, activeCounts)
+
+	assert.Equal(t, []category{{"CAT_2", "Cat2", 20}, {"CAT_3", "Cat3", 30}}, got)
+	assert.Equal(t, 35, missed)
+}
+
+func Test_preparePosting_energyLabel(t *testing.T) {
+	var postings []posting
+	err := json.Unmarshal([]byte(`[{
+		"posting_id": "with-label",
+		"eek": {
+			"classRange": {"from": "A+++", "to": "D"},
+			"energyEfficiencyLabelEu2017_1369": false,
+			"efficiencyClass": "C",
+			"colorCode": "rgb(236 102 8)",
+			"label": {"url": "https://assets.mmsrg.com/label", "mimetype": "image/pdf"},
+			"datasheet": {"url": "https://assets.mmsrg.com/datasheet", "mimetype": "image/pdf"}
+		}
+	}, {
+		"posting_id": "without-label",
+		"eek": {}
+	}]`), &postings)
+	assert.NoError(t, err)
+
+	postings, err = preparePostings(MM, postings)
+	assert.NoError(t, err)
+
+	assert.Equal(t, &energyLabel{
+		EfficiencyClass: "C",
+		ColorCode:       "rgb(236 102 8)",
+		ClassRange:      &classRange{"A+++", "D"},
+		Label:           &labelDocument{"https://assets.mmsrg.com/label", "image/pdf"},
+		Datasheet:       &labelDocument{"https://assets.mmsrg.com/datasheet", "image/pdf"},
+	}, postings[0].EnergyLabel)
+	assert.Equal(t, "Energy class C (A+++ to D), datasheet: https://assets.mmsrg.com/datasheet", postings[0].EnergyLabel.String())
+	assert.Nil(t, postings[1].EnergyLabel)
+}
+
+func Test_efficiencyClassesUpTo(t *testing.T) {
+	classes := efficiencyClassesUpTo(efficiencyClasses, "B")
+	assert.Equal(t, []string{"A+++", "A++", "A+", "A", "B"}, classes)
+	classes[0] = "changed"
+	assert.Equal(t, "A+++", efficiencyClasses[0])
+
+	assert.Equal(t, []string{"A", "B"}, efficiencyClassesUpTo(efficiencyClasses2017, "B"))
+	assert.Nil(t, efficiencyClassesUpTo(efficiencyClasses2017, "A+"))
+	assert.Nil(t, efficiencyClassesUpTo(efficiencyClasses, "Z"))
+}
+
+func Test_filterPostingsByCategory(t *testing.T) {
+	postings := []posting{
+		{PostingId: "1", CategoryId: "CAT_1", CategoryName: "Gaming"},
+		{PostingId: "2", CategoryId: "CAT_2", CategoryName: "Haushalt"},
+		{PostingId: "3", CategoryId: "CAT_3", CategoryName: "Foto"},
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, toIds(filterPostingsByCategory(postings, nil, nil)))
+	assert.Equal(t, []string{"1", "3"}, toIds(filterPostingsByCategory(postings, []string{"Gaming", "CAT_3"}, nil)))
+	assert.Equal(t, []string{"2", "3"}, toIds(filterPostingsByCategory(postings, nil, []string{"CAT_1"})))
+	assert.Equal(t, []string{"3"}, toIds(filterPostingsByCategory(postings, []string{"Gaming", "Foto"}, []string{"Gaming"})))
+}
+
+func Test_withCategoryNames(t *testing.T) {
+	postings := []posting{{PostingId: "1", CategoryId: "CAT_1"}, {PostingId: "2", CategoryId: "CAT_UNKNOWN"}}
+
+	got := withCategoryNames(postings, []category{{"CAT_1", "Gaming", 1}, {"CAT_2", "Haushalt", 2}})
+
+	assert.Equal(t, []posting{
+		{PostingId: "1", CategoryId: "CAT_1", CategoryName: "Gaming"},
+		{PostingId: "2", CategoryId: "CAT_UNKNOWN"},
+	}, got)
+}
+
+func Test_posting_totalPriceAndSaving(t *testing.T) {
+	tests := []struct {
+		name       string
+		p          posting
+		totalPrice float64
+		saving     float64
+	}{
+		{"shipping", posting{Price: 95, PriceOld: 129.99, ShippingCost: 9.99, ShippingType: "shipping"}, 104.99, 34.99},
+		{"collect", posting{Price: 95, PriceOld: 129.99, ShippingCost: 9.99, ShippingType: "collect"}, 95, 34.99},
+		{"without old price", posting{Price: 0.1, ShippingCost: 0.2, ShippingType: "shipping"}, 0.3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.totalPrice, tt.p.totalPrice())
+			assert.Equal(t, tt.saving, tt.p.saving())
+		})
+	}
+}
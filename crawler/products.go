@@ -0,0 +1,84 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxOutletsPerProduct limits the outlets listed for a product in an alert.
+const maxOutletsPerProduct = 5
+
+// productDeals are the deals of a query with the same pim_id. Postings without pim_id are a product of their own.
+type productDeals struct {
+	PimId    int
+	Postings []posting
+}
+
+// toProduct computes the price statistics of the prices of the active postings of a product.
+func toProduct(pimId int, prices []float64) product {
+	p := product{PimId: pimId, ActivePostings: len(prices)}
+	if len(prices) == 0 {
+		return p
+	}
+	sorted := append([]float64{}, prices...)
+	sort.Float64s(sorted)
+	p.MinPrice = sorted[0]
+	p.MaxPrice = sorted[len(sorted)-1]
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		p.MedianPrice = roundCents((sorted[middle-1] + sorted[middle]) / 2)
+	} else {
+		p.MedianPrice = sorted[middle]
+	}
+	return p
+}
+
+// groupByProduct groups the deals by pim_id in the order of their best deal. The postings of each product are sorted
+// by total price.
+func groupByProduct(deals []posting) []productDeals {
+	groups := []productDeals{}
+	index := map[int]int{}
+	for _, deal := range deals {
+		i, ok := index[deal.PimId]
+		if !ok || deal.PimId == 0 {
+			groups = append(groups, productDeals{PimId: deal.PimId})
+			i = len(groups) - 1
+			index[deal.PimId] = i
+		}
+		groups[i].Postings = append(groups[i].Postings, deal)
+	}
+	for _, g := range groups {
+		sort.SliceStable(g.Postings, func(i, j int) bool {
+			return g.Postings[i].TotalPrice < g.Postings[j].TotalPrice
+		})
+	}
+	return groups
+}
+
+func (pd productDeals) String(p *product) string {
+	cheapest := pd.Postings[0]
+	outlets := []string{}
+	for i, deal := range pd.Postings {
+		if i == maxOutletsPerProduct {
+			outlets = append(outlets, fmt.Sprintf("and %d more", len(pd.Postings)-maxOutletsPerProduct))
+			break
+		}
+		outlet := fmt.Sprintf("%s in %s", formatPrice(deal.Price, deal.Currency), deal.Outlet.Name)
+		if deal.DistanceKm != nil {
+			outlet = fmt.Sprintf("%s (%.0f km)", outlet, *deal.DistanceKm)
+		}
+		outlets = append(outlets, outlet)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("%s 👉%s👈 in %d outlet(s)", formatPrice(cheapest.Price, cheapest.Currency), cheapest.Name, len(pd.Postings)))
+	buffer.WriteString("\n\t🏬 " + strings.Join(outlets, ", "))
+	if p != nil && p.ActivePostings > 0 {
+		buffer.WriteString(fmt.Sprintf("\n\t📊 %s to %s, median %s in %d outlet(s) overall", formatPrice(p.MinPrice, cheapest.Currency),
+			formatPrice(p.MaxPrice, cheapest.Currency), formatPrice(p.MedianPrice, cheapest.Currency), p.Outlets))
+	}
+	buffer.WriteString(fmt.Sprintf("\n\t📸 %s\n\t🛒 %s", cheapest.Url[0], cheapest.ShopUrl))
+	return buffer.String()
+}
@@ -0,0 +1,55 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_toProduct(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []float64
+		want   product
+	}{
+		{"no prices", nil, product{PimId: 1}},
+		{"odd", []float64{30, 10, 20}, product{PimId: 1, MinPrice: 10, MaxPrice: 30, MedianPrice: 20, ActivePostings: 3}},
+		{"even", []float64{40, 10, 20.01, 30}, product{PimId: 1, MinPrice: 10, MaxPrice: 40, MedianPrice: 25.01, ActivePostings: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, toProduct(1, tt.prices))
+		})
+	}
+}
+
+func Test_groupByProduct(t *testing.T) {
+	deals := []posting{
+		{PostingId: "a1", PimId: 1, TotalPrice: 20},
+		{PostingId: "b1", PimId: 2, TotalPrice: 5},
+		{PostingId: "a2", PimId: 1, TotalPrice: 10},
+		{PostingId: "x", TotalPrice: 1},
+		{PostingId: "y", TotalPrice: 2},
+	}
+
+	groups := groupByProduct(deals)
+
+	assert.Len(t, groups, 4)
+	assert.Equal(t, []string{"a2", "a1"}, toIds(groups[0].Postings))
+	assert.Equal(t, []string{"b1"}, toIds(groups[1].Postings))
+	assert.Equal(t, []string{"x"}, toIds(groups[2].Postings))
+	assert.Equal(t, []string{"y"}, toIds(groups[3].Postings))
+}
+
+func Test_productDeals_String(t *testing.T) {
+	deals := productDeals{PimId: 1}
+	for _, outlet := range []string{"Lübeck", "Hamburg", "Kiel", "Bremen", "Berlin", "Köln", "Bonn"} {
+		deals.Postings = append(deals.Postings, posting{Name: "Switch", Price: 199, Outlet: postingOutlet{Name: outlet}, Url: []string{"https://image"}, ShopUrl: "https://shop"})
+	}
+	deals.Postings[0].DistanceKm = fPtr(12.3)
+	p := product{PimId: 1, MinPrice: 189, MaxPrice: 249, MedianPrice: 219, ActivePostings: 20, Outlets: 18}
+
+	assert.Equal(t, "199.00€ 👉Switch👈 in 7 outlet(s)"+
+		"\n\t🏬 199.00€ in Lübeck (12 km), 199.00€ in Hamburg, 199.00€ in Kiel, 199.00€ in Bremen, 199.00€ in Berlin, and 2 more"+
+		"\n\t📊 189.00€ to 249.00€, median 219.00€ in 18 outlet(s) overall"+
+		"\n\t📸 https://image\n\t🛒 https://shop", deals.String(&p))
+}
@@ -0,0 +1,278 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+	"io"
+	"text/tabwriter"
+)
+
+// configQueries returns the queries of the config file identified by their id, see configQueryId.
+func configQueries() ([]storedQuery, error) {
+	queries := []storedQuery{}
+	for _, q := range CONFIG.Queries {
+		id, err := configQueryId(q)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, storedQuery{Id: id, Enabled: true, Query: q, Config: true})
+	}
+	return queries, nil
+}
+
+// configQueryId returns the id of a query of the config file. Queries without explicit id fall back to the hash of
+// their fields like before queries had ids, so editing them resets their last search time.
+func configQueryId(q query) (string, error) {
+	if q.Id != "" {
+		return q.Id, nil
+	}
+	return hashQuery(q)
+}
+
+// allQueries returns the stored queries of owner, or of everyone if owner is empty, followed by the queries of the
+// config file that were not imported. A query of the config file counts as imported if it was stored with its id or,
+// before it had an id, with its hash.
+func allQueries(ctx context.Context, owner string) ([]storedQuery, error) {
+	stored, err := findStoredQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configured, err := configQueries()
+	if err != nil {
+		return nil, err
+	}
+	imported := map[string]bool{}
+	queries := []storedQuery{}
+	for _, sq := range stored {
+		imported[sq.Id] = true
+		if owner == "" || sq.Owner == owner {
+			queries = append(queries, sq)
+		}
+	}
+	for _, sq := range configured {
+		hash, err := hashQuery(sq.Query)
+		if err != nil {
+			return nil, err
+		}
+		if !imported[sq.Id] && !imported[hash] && owner == "" {
+			queries = append(queries, sq)
+		}
+	}
+	return queries, nil
+}
+
+// migrateConfigQueryIds moves the last search time of queries of the config file that were given an id from their
+// hash to their id, so adding the id does not find all postings again. The hash is not used afterwards. Queries that
+// were imported with their hash keep it, since the stored query is searched instead.
+func migrateConfigQueryIds(ctx context.Context) error {
+	for _, q := range CONFIG.Queries {
+		if q.Id == "" {
+			continue
+		}
+		hash, err := hashQuery(q)
+		if err != nil {
+			return err
+		}
+		imported, err := findStoredQuery(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if imported != nil {
+			continue
+		}
+		migrated, err := moveSearchOperation(ctx, hash, q.Id)
+		if err != nil {
+			return err
+		}
+		if migrated {
+			log.Infof("Moved last search time of query '%s' from its hash '%s' to its id '%s'.", q.Desc, hash, q.Id)
+		}
+	}
+	return nil
+}
+
+// searchableQueries returns the enabled queries. An imported query of the config file is searched as stored query
+// only, so it is not searched twice while it is still in the config file.
+func searchableQueries(ctx context.Context) ([]storedQuery, error) {
+	queries, err := allQueries(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	enabled := []storedQuery{}
+	for _, sq := range queries {
+		if sq.Enabled {
+			enabled = append(enabled, sq)
+		}
+	}
+	return enabled, nil
+}
+
+// findQuery returns the stored or configured query with the given id.
+func findQuery(ctx context.Context, id string) (*storedQuery, error) {
+	queries, err := allQueries(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, sq := range queries {
+		if sq.Id == id {
+			return &sq, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrQueryNotFound, id)
+}
+
+// createStoredQuery validates and stores a new query with a random id.
+func createStoredQuery(ctx context.Context, owner string, enabled bool, q query) (*storedQuery, error) {
+	if err := q.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueryInvalid, err)
+	}
+	sq := storedQuery{Id: primitive.NewObjectID().Hex(), Owner: owner, Enabled: enabled, Query: q, CreDat: now()}
+	sq.ModDat = sq.CreDat
+	if _, err := insertStoredQuery(ctx, sq); err != nil {
+		return nil, err
+	}
+	return &sq, nil
+}
+
+// editStoredQuery applies edit to the stored query with the given id and saves it if it is still valid. Queries of the
+// config file have to be imported before they can be edited.
+func editStoredQuery(ctx context.Context, id string, edit func(sq *storedQuery)) (*storedQuery, error) {
+	sq, err := findStoredQuery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if sq == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrQueryNotFound, id)
+	}
+	edit(sq)
+	if err := sq.Query.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrQueryInvalid, err)
+	}
+	sq.ModDat = now()
+	return sq, replaceStoredQuery(ctx, *sq)
+}
+
+func parseQueryYaml(yamlBytes []byte) (query, error) {
+	q := query{}
+	if err := yaml.Unmarshal(yamlBytes, &q); err != nil {
+		return q, fmt.Errorf("%w: %s", ErrQueryInvalid, err)
+	}
+	return q, nil
+}
+
+// ListQueries writes the stored queries and the queries of the config file as a table.
+func ListQueries(ctx context.Context, w io.Writer, owner string) error {
+	queries, err := allQueries(ctx, owner)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tOWNER\tENABLED\tLAST SEARCH\tDESC")
+	for _, sq := range queries {
+		op, err := findSearchOperation(ctx, sq.Id)
+		if err != nil {
+			return err
+		}
+		lastSearch := "-"
+		if op != nil && op.Timestamp != nil {
+			lastSearch = op.Timestamp.Format("2006-01-02 15:04")
+		}
+		owner := sq.Owner
+		if sq.Config {
+			owner = "(config file)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", sq.Id, owner, sq.Enabled, lastSearch, sq.Query.Desc)
+	}
+	return tw.Flush()
+}
+
+// ShowQuery writes the query with the given id as yaml, which can be edited and passed to UpdateQuery.
+func ShowQuery(ctx context.Context, w io.Writer, id string) error {
+	sq, err := findQuery(ctx, id)
+	if err != nil {
+		return err
+	}
+	yamlBytes, err := yaml.Marshal(sq.Query)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yamlBytes)
+	return err
+}
+
+// AddQuery stores the query given as yaml, written like a query of the config file, and returns its id.
+func AddQuery(ctx context.Context, owner string, enabled bool, yamlBytes []byte) (string, error) {
+	q, err := parseQueryYaml(yamlBytes)
+	if err != nil {
+		return "", err
+	}
+	sq, err := createStoredQuery(ctx, owner, enabled, q)
+	if err != nil {
+		return "", err
+	}
+	return sq.Id, nil
+}
+
+// UpdateQuery replaces the stored query with the given id by the query given as yaml. Its last search time is kept.
+func UpdateQuery(ctx context.Context, id string, yamlBytes []byte) error {
+	q, err := parseQueryYaml(yamlBytes)
+	if err != nil {
+		return err
+	}
+	_, err = editStoredQuery(ctx, id, func(sq *storedQuery) { sq.Query = q })
+	return err
+}
+
+// EnableQuery enables or disables the stored query with the given id. Disabled queries are not searched.
+func EnableQuery(ctx context.Context, id string, enabled bool) error {
+	_, err := editStoredQuery(ctx, id, func(sq *storedQuery) { sq.Enabled = enabled })
+	return err
+}
+
+// DeleteQuery deletes the stored query with the given id along with its last search time.
+func DeleteQuery(ctx context.Context, id string) error {
+	return deleteStoredQuery(ctx, id)
+}
+
+// ImportQueries stores the queries of the config file and returns the number of imported queries. A query keeps its
+// id, see configQueryId, so its last search time is kept, and queries imported before are skipped even if they were
+// edited since or imported with their hash before they had an id. Imported queries may be removed from the config file
+// afterwards.
+func ImportQueries(ctx context.Context, cf ConfigFile, owner string) (int, error) {
+	count := 0
+	for _, q := range cf.Queries {
+		if err := q.validate(); err != nil {
+			return count, fmt.Errorf("%w: %s", ErrQueryInvalid, err)
+		}
+		id, err := configQueryId(q)
+		if err != nil {
+			return count, err
+		}
+		hash, err := hashQuery(q)
+		if err != nil {
+			return count, err
+		}
+		if hash != id {
+			legacy, err := findStoredQuery(ctx, hash)
+			if err != nil {
+				return count, err
+			}
+			if legacy != nil {
+				continue
+			}
+		}
+		sq := storedQuery{Id: id, Owner: owner, Enabled: true, Query: q, CreDat: now()}
+		sq.ModDat = sq.CreDat
+		inserted, err := insertStoredQuery(ctx, sq)
+		if err != nil {
+			return count, err
+		}
+		if inserted {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,168 @@
+package crawler
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_parseQueryYaml(t *testing.T) {
+	q, err := parseQueryYaml([]byte("desc: switch\nname_regex: [ switch ]\nprice_max: 250\n"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, query{Desc: "switch", NameRegex: []string{"switch"}, PriceMax: fPtr(250)}, q)
+
+	_, err = parseQueryYaml([]byte("price_max: cheap"))
+	assert.ErrorIs(t, err, ErrQueryInvalid)
+}
+
+func Test_configQueries(t *testing.T) {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery()}}
+
+	queries, err := configQueries()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []storedQuery{{Id: getExampleHash(), Enabled: true, Query: getExampleQuery(), Config: true}}, queries)
+}
+
+func Test_configQueryId(t *testing.T) {
+	q := getExampleQuery()
+	id, err := configQueryId(q)
+	assert.NoError(t, err)
+	assert.Equal(t, getExampleHash(), id)
+
+	q.Id = "switch"
+	id, err = configQueryId(q)
+	assert.NoError(t, err)
+	assert.Equal(t, "switch", id)
+	hash, err := hashQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, getExampleHash(), hash, "the id is not part of the hash")
+}
+
+func TestConfigFile_validate_duplicateQueryId(t *testing.T) {
+	assert.NoError(t, (&ConfigFile{Queries: []query{{Id: "a"}, {Id: "b"}, {}, {}}}).validate())
+	assert.Error(t, (&ConfigFile{Queries: []query{{Id: "a"}, {Id: "a"}}}).validate())
+}
+
+func TestConfigFile_validate_queryIdPath(t *testing.T) {
+	assert.Error(t, (&ConfigFile{Queries: []query{{Id: "../x"}}}).validate())
+	_, err := createStoredQuery(ctx, "", true, query{Id: "a/b"})
+	assert.ErrorIs(t, err, ErrQueryInvalid, "rejected before it is stored")
+}
+
+func (suite *PersistenceSuite) Test_migrateConfigQueryIds() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	lastSearch := time.Now().UTC().Round(time.Millisecond)
+	assert.NoError(suite.T(), updateSearchOperation(ctx, getExampleHash(), getExampleQuery(), &lastSearch))
+	withId := getExampleQuery()
+	withId.Id = "example"
+	CONFIG = ConfigFile{Queries: []query{withId}}
+
+	assert.NoError(suite.T(), migrateConfigQueryIds(ctx))
+	assert.Equal(suite.T(), &lastSearch, mustFindSearchOperation("example").Timestamp)
+	assert.Nil(suite.T(), mustFindSearchOperation(getExampleHash()))
+
+	later := lastSearch.Add(time.Hour)
+	assert.NoError(suite.T(), updateSearchOperation(ctx, getExampleHash(), getExampleQuery(), &later))
+	assert.NoError(suite.T(), migrateConfigQueryIds(ctx))
+	assert.Equal(suite.T(), &lastSearch, mustFindSearchOperation("example").Timestamp, "migrated only once")
+}
+
+func (suite *PersistenceSuite) Test_migrateConfigQueryIds_importedWithHash() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	lastSearch := time.Now().UTC().Round(time.Millisecond)
+	assert.NoError(suite.T(), updateSearchOperation(ctx, getExampleHash(), getExampleQuery(), &lastSearch))
+	_, err := ImportQueries(ctx, ConfigFile{Queries: []query{getExampleQuery()}}, "")
+	assert.NoError(suite.T(), err)
+	withId := getExampleQuery()
+	withId.Id = "example"
+	CONFIG = ConfigFile{Queries: []query{withId}}
+
+	assert.NoError(suite.T(), migrateConfigQueryIds(ctx))
+	assert.Equal(suite.T(), &lastSearch, mustFindSearchOperation(getExampleHash()).Timestamp)
+	assert.Nil(suite.T(), mustFindSearchOperation("example"))
+
+	count, err := ImportQueries(ctx, CONFIG, "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, count)
+	queries, err := searchableQueries(ctx)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), queries, 1)
+	assert.Equal(suite.T(), getExampleHash(), queries[0].Id)
+}
+
+func (suite *PersistenceSuite) Test_importQueries() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery(), {Desc: "other"}}}
+
+	count, err := ImportQueries(ctx, CONFIG, "anna")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, count)
+	imported, err := findStoredQuery(ctx, getExampleHash())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "anna", imported.Owner)
+	assert.Equal(suite.T(), getExampleQuery(), imported.Query)
+
+	assert.NoError(suite.T(), UpdateQuery(ctx, getExampleHash(), []byte("desc: edited")))
+	count, err = ImportQueries(ctx, CONFIG, "anna")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, count)
+	edited, err := findStoredQuery(ctx, getExampleHash())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "edited", edited.Query.Desc)
+	assert.Equal(suite.T(), imported.CreDat, edited.CreDat)
+}
+
+func (suite *PersistenceSuite) Test_searchableQueries() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery(), {Desc: "config only"}}}
+	_, err := ImportQueries(ctx, ConfigFile{Queries: []query{getExampleQuery()}}, "")
+	assert.NoError(suite.T(), err)
+	disabled, err := AddQuery(ctx, "anna", false, []byte("desc: disabled"))
+	assert.NoError(suite.T(), err)
+	enabled, err := AddQuery(ctx, "anna", true, []byte("desc: enabled"))
+	assert.NoError(suite.T(), err)
+
+	queries, err := searchableQueries(ctx)
+	assert.NoError(suite.T(), err)
+	descs := []string{}
+	for _, sq := range queries {
+		descs = append(descs, sq.Query.Desc)
+	}
+	assert.Equal(suite.T(), []string{"description", "enabled", "config only"}, descs)
+	assert.False(suite.T(), queries[0].Config)
+	assert.Equal(suite.T(), enabled, queries[1].Id)
+
+	assert.NoError(suite.T(), EnableQuery(ctx, disabled, true))
+	queries, err = searchableQueries(ctx)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), queries, 4)
+}
+
+func (suite *PersistenceSuite) Test_deleteQuery() {
+	id, err := AddQuery(ctx, "", true, []byte("desc: switch"))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), updateSearchOperation(ctx, id, query{Desc: "switch"}, now()))
+
+	assert.NoError(suite.T(), DeleteQuery(ctx, id))
+
+	assert.Nil(suite.T(), mustFindSearchOperation(id))
+	assert.ErrorIs(suite.T(), DeleteQuery(ctx, id), ErrQueryNotFound)
+	assert.ErrorIs(suite.T(), EnableQuery(ctx, id, false), ErrQueryNotFound)
+}
+
+func (suite *PersistenceSuite) Test_listQueries() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{getExampleQuery()}}
+	_, err := AddQuery(ctx, "anna", true, []byte("desc: switch"))
+	assert.NoError(suite.T(), err)
+	var buffer bytes.Buffer
+
+	assert.NoError(suite.T(), ListQueries(ctx, &buffer, ""))
+
+	assert.Contains(suite.T(), buffer.String(), "anna")
+	assert.Contains(suite.T(), buffer.String(), "(config file)")
+}
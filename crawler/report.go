@@ -0,0 +1,222 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// reportSize is the number of postings on a page of the report.
+	reportSize = 100
+	// reportPriceDropCandidates is the number of newest postings searched for price drops.
+	reportPriceDropCandidates = 1000
+)
+
+var reportTemplates = map[string]*template.Template{
+	"index":    parseReportTemplate("index.html"),
+	"postings": parseReportTemplate("postings.html"),
+}
+
+func parseReportTemplate(page string) *template.Template {
+	return template.Must(template.New("layout.html").Funcs(webTemplateFuncs).
+		ParseFS(webFiles, "web/report/layout.html", "web/report/"+page))
+}
+
+// reportPage is shown on every page of the report. Root is the relative path to the top directory of the report.
+type reportPage struct {
+	Title     string
+	Root      string
+	Generated time.Time
+}
+
+type reportIndex struct {
+	reportPage
+	Queries []reportQuery
+}
+
+type reportQuery struct {
+	Id         string
+	Desc       string
+	Matches    int
+	LastSearch *time.Time
+}
+
+type reportPostings struct {
+	reportPage
+	Description string
+	Postings    []posting
+}
+
+// WriteReport renders a static html site into dir: an index of the queries, a page with the matches of each query,
+// the newest postings and the price drops. Each file is replaced atomically, so the site can be synced at any time.
+func WriteReport(ctx context.Context, dir string) error {
+	start := time.Now()
+	generated := time.Now()
+	if err := os.MkdirAll(filepath.Join(dir, "queries"), 0755); err != nil {
+		return err
+	}
+	style, err := webFiles.ReadFile("web/static/style.css")
+	if err != nil {
+		return err
+	}
+	if err := writeReportFile(dir, "style.css", style); err != nil {
+		return err
+	}
+
+	queries, err := searchableQueries(ctx)
+	if err != nil {
+		return err
+	}
+	index := reportIndex{reportPage: reportPage{Title: "Queries", Generated: generated}, Queries: []reportQuery{}}
+	queryPages := map[string]bool{}
+	for _, sq := range queries {
+		deals, err := findQueryMatches(ctx, sq.Query, generated)
+		if err != nil {
+			return err
+		}
+		op, err := findSearchOperation(ctx, sq.Id)
+		if err != nil {
+			return err
+		}
+		rq := reportQuery{Id: sq.Id, Desc: sq.Query.Desc, Matches: len(deals)}
+		if op != nil {
+			rq.LastSearch = op.Timestamp
+		}
+		index.Queries = append(index.Queries, rq)
+
+		page := reportPostings{reportPage: reportPage{Title: sq.Query.Desc, Root: "../", Generated: generated}, Postings: deals}
+		name := filepath.Join("queries", sq.Id+".html")
+		if err := writeReportPage(dir, name, "postings", page); err != nil {
+			return err
+		}
+		queryPages[sq.Id+".html"] = true
+	}
+	if err := removeStaleQueryPages(filepath.Join(dir, "queries"), queryPages); err != nil {
+		return err
+	}
+	if err := writeReportPage(dir, "index.html", "index", index); err != nil {
+		return err
+	}
+
+	newestSort := "newest"
+	newest, err := FindAll(ctx, query{Sort: &newestSort}, nil, reportSize, 0)
+	if err != nil {
+		return err
+	}
+	page := reportPostings{reportPage: reportPage{Title: "Newest postings", Generated: generated}, Postings: newest}
+	if err := writeReportPage(dir, "newest.html", "postings", page); err != nil {
+		return err
+	}
+
+	drops, err := findPriceDrops(ctx)
+	if err != nil {
+		return err
+	}
+	page = reportPostings{reportPage: reportPage{Title: "Price drops", Generated: generated}, Postings: drops,
+		Description: fmt.Sprintf("Postings among the %d newest that are cheaper than any other posting of their product seen before.", reportPriceDropCandidates)}
+	if err := writeReportPage(dir, "price-drops.html", "postings", page); err != nil {
+		return err
+	}
+	log.Infof("Wrote report of %d queries to '%s' in %.2fs.", len(queries), dir, time.Since(start).Seconds())
+	return nil
+}
+
+// findQueryMatches returns the best active postings matching the query, filtered and sorted like its alerts.
+func findQueryMatches(ctx context.Context, q query, now time.Time) ([]posting, error) {
+	postings, err := FindAll(ctx, q, nil, reportSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	postings = withDistances(q, postings)
+	histories, err := findPriceHistories(ctx, pimIds(postings))
+	if err != nil {
+		return nil, err
+	}
+	return rankDeals(q, postings, histories, now), nil
+}
+
+// findPriceDrops returns the newest postings cheaper than the lowest price of the other postings of their product,
+// sorted by the drop relative to that price.
+func findPriceDrops(ctx context.Context) ([]posting, error) {
+	newestSort := "newest"
+	postings, err := FindAll(ctx, query{Sort: &newestSort}, nil, reportPriceDropCandidates, 0)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := findPriceHistories(ctx, pimIds(postings))
+	if err != nil {
+		return nil, err
+	}
+	return priceDrops(postings, histories), nil
+}
+
+func priceDrops(postings []posting, histories map[int]priceHistory) []posting {
+	drops := []posting{}
+	for _, p := range postings {
+		p.History = historyOf(histories, p)
+		if p.History != nil && p.Price < p.History.lowest().Price {
+			drops = append(drops, p)
+		}
+	}
+	sort.SliceStable(drops, func(i, j int) bool {
+		return drops[i].Price/drops[i].History.lowest().Price < drops[j].Price/drops[j].History.lowest().Price
+	})
+	if len(drops) > reportSize {
+		drops = drops[:reportSize]
+	}
+	return drops
+}
+
+func writeReportPage(dir string, name string, templateName string, data interface{}) error {
+	var buffer bytes.Buffer
+	if err := reportTemplates[templateName].Execute(&buffer, data); err != nil {
+		return fmt.Errorf("could not render '%s': %w", name, err)
+	}
+	return writeReportFile(dir, name, buffer.Bytes())
+}
+
+// writeReportFile writes to a temporary file that replaces the file, so it is never synced half written.
+func writeReportFile(dir string, name string, content []byte) error {
+	path := filepath.Join(dir, name)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".report-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeStaleQueryPages removes the pages of queries that were deleted or disabled.
+func removeStaleQueryPages(dir string, written map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".html") || written[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_priceDrops(t *testing.T) {
+	drop := posting{PostingId: "drop", PimId: 1, Price: 90}
+	biggerDrop := posting{PostingId: "bigger", PimId: 2, Price: 50}
+	noDrop := posting{PostingId: "none", PimId: 1, Price: 120}
+	withoutHistory := posting{PostingId: "alone", PimId: 3, Price: 10}
+	histories := map[int]priceHistory{
+		1: {PimId: 1, Prices: []historicalPrice{{PostingId: "drop", Price: 90}, {PostingId: "old", Price: 100}, {PostingId: "none", Price: 120}}},
+		2: {PimId: 2, Prices: []historicalPrice{{PostingId: "bigger", Price: 50}, {PostingId: "old2", Price: 100}}},
+		3: {PimId: 3, Prices: []historicalPrice{{PostingId: "alone", Price: 10}}},
+	}
+
+	drops := priceDrops([]posting{drop, noDrop, biggerDrop, withoutHistory}, histories)
+
+	assert.Equal(t, []string{"bigger", "drop"}, toIds(drops))
+	assert.Equal(t, 100.0, drops[1].History.lowest().Price)
+}
+
+func Test_writeReportPage(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "queries"), 0755))
+	p := getExamplePosting("switch")
+	p.ShopUrl = "https://www.mediamarkt.de/switch"
+	p.History = &priceHistory{Prices: []historicalPrice{{PostingId: "old", Price: 1400, Outlet: "Lübeck"}}}
+	page := reportPostings{reportPage: reportPage{Title: "Switch <OLED>", Root: "../", Generated: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)},
+		Postings: []posting{p}}
+
+	assert.NoError(t, writeReportPage(dir, filepath.Join("queries", "abc.html"), "postings", page))
+
+	content, err := os.ReadFile(filepath.Join(dir, "queries", "abc.html"))
+	assert.NoError(t, err)
+	body := string(content)
+	assert.Contains(t, body, `<link rel="stylesheet" href="../style.css">`)
+	assert.Contains(t, body, `<a href="../index.html">`)
+	assert.Contains(t, body, "<h1>Switch &lt;OLED&gt;</h1>")
+	assert.Contains(t, body, `<a href="https://www.mediamarkt.de/switch">`)
+	assert.Contains(t, body, "📉 lowest seen: 1400.00€ (Lübeck)")
+	assert.Contains(t, body, "Generated 2022-05-01 12:00")
+	entries, err := os.ReadDir(filepath.Join(dir, "queries"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func Test_removeStaleQueryPages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"keep.html", "stale.html", "notes.txt"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{}, 0644))
+	}
+
+	assert.NoError(t, removeStaleQueryPages(dir, map[string]bool{"keep.html": true}))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"keep.html", "notes.txt"}, names)
+}
+
+func (suite *PersistenceSuite) Test_writeReport() {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Queries: []query{{Desc: "switch", NameRegex: []string{"nintendo switch"}}}}
+	id, err := hashQuery(CONFIG.Queries[0])
+	assert.NoError(suite.T(), err)
+	dir := suite.T().TempDir()
+
+	assert.NoError(suite.T(), WriteReport(ctx, dir))
+
+	for _, name := range []string{"index.html", "style.css", "newest.html", "price-drops.html", filepath.Join("queries", id+".html")} {
+		assert.FileExists(suite.T(), filepath.Join(dir, name))
+	}
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), string(index), `<a href="queries/`+id+`.html">switch</a></td><td>2</td>`)
+}
@@ -0,0 +1,184 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"runtime/debug"
+	"text/tabwriter"
+	"time"
+)
+
+// Modes of a run: a full crawl of all due categories, a fast crawl of the newest postings or only a search for deals.
+const (
+	RunModeFull   = "full"
+	RunModeFast   = "fast"
+	RunModeSearch = "search"
+)
+
+// Version is stored with each run. It is set at build time by
+// `-ldflags "-X fundgrube-crawler/crawler.Version=..."`, otherwise the vcs revision of the build is used if known.
+var Version = ""
+
+// RunReport summarizes a run of crawling and searching deals. Crawl is nil if crawling was skipped and Search is nil
+// if the run stopped before searching deals.
+type RunReport struct {
+	Start   time.Time
+	Mode    string
+	Crawl   *CrawlReport
+	Search  *SearchReport
+	Success bool
+	// Err is the error that stopped the run or its crawl early, if any. A run with Err is stored as failed, e.g. a
+	// crawl stopped by CRAWL_TIMEOUT, even if the search for deals succeeded afterwards.
+	Err error
+}
+
+// SaveRun records the run, which ends now, in the metrics and stores it in the runs collection. The run is stored even
+// if ctx is done, so interrupted runs are kept as well.
+func SaveRun(ctx context.Context, report RunReport) (string, error) {
+	end := time.Now()
+	r := toRun(report, end)
+	recordRunMetrics(report.Start, end, r.Success)
+	return r.Id, insertRun(uncancelable{ctx}, r)
+}
+
+func toRun(report RunReport, end time.Time) run {
+	start := report.Start.UTC().Round(time.Millisecond)
+	end = end.UTC().Round(time.Millisecond)
+	r := run{
+		Id:      primitive.NewObjectID().Hex(),
+		Start:   &start,
+		End:     &end,
+		Took:    end.Sub(start).Seconds(),
+		Mode:    report.Mode,
+		Version: version(),
+		Success: report.Success && report.Err == nil,
+		Search:  report.Search,
+	}
+	if report.Err != nil {
+		r.Error = report.Err.Error()
+	}
+	if report.Crawl != nil {
+		r.Crawl = toRunCrawl(*report.Crawl)
+	}
+	return r
+}
+
+func toRunCrawl(report CrawlReport) *runCrawl {
+	crawl := &runCrawl{
+		Categories: report.Categories,
+		Skipped:    report.Skipped,
+		Stats:      toRunStats(CategoryStats{Stats: report.Stats}),
+		ByCategory: []runStats{},
+		Errors:     []runError{},
+	}
+	for _, categoryStats := range report.ByCategory {
+		crawl.ByCategory = append(crawl.ByCategory, toRunStats(categoryStats))
+	}
+	for _, e := range report.Errors {
+		crawl.Errors = append(crawl.Errors, runError{Shop: e.Shop, CategoryId: e.CategoryId, CategoryName: e.CategoryName, Error: e.Err.Error()})
+	}
+	return crawl
+}
+
+func toRunStats(cs CategoryStats) runStats {
+	return runStats{
+		Shop:         cs.Shop,
+		CategoryId:   cs.CategoryId,
+		CategoryName: cs.CategoryName,
+		Postings:     cs.Stats.Postings,
+		Inserted:     cs.Stats.Inserted,
+		Updated:      cs.Stats.Updated,
+		Inactive:     cs.Stats.Inactive,
+		TookApi:      cs.Stats.TookApi.Seconds(),
+		TookDB:       cs.Stats.TookDB.Seconds(),
+	}
+}
+
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "dev"
+}
+
+// ListRuns writes the newest runs of the mode, or of all modes if mode is empty, as a table.
+func ListRuns(ctx context.Context, w io.Writer, mode string, limit int64) error {
+	runs, err := findRuns(ctx, mode, limit, 0)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTART\tMODE\tTOOK\tSUCCESS\tCATEGORIES\tFAILED\tPOSTINGS\tINSERTED\tUPDATED\tINACTIVE\tNOTIFICATIONS\tVERSION")
+	for _, r := range runs {
+		categories, failed, postings, inserted, updated, inactive := "-", "-", "-", "-", "-", "-"
+		if r.Crawl != nil {
+			categories = fmt.Sprint(r.Crawl.Categories)
+			failed = fmt.Sprint(len(r.Crawl.Errors))
+			postings = fmt.Sprint(r.Crawl.Stats.Postings)
+			inserted = fmt.Sprint(r.Crawl.Stats.Inserted)
+			updated = fmt.Sprint(r.Crawl.Stats.Updated)
+			inactive = fmt.Sprint(r.Crawl.Stats.Inactive)
+		}
+		notifications := "-"
+		if r.Search != nil {
+			notifications = fmt.Sprint(r.Search.Notifications)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1fs\t%t\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Id, r.Start.Local().Format("2006-01-02 15:04"),
+			r.Mode, r.Took, r.Success, categories, failed, postings, inserted, updated, inactive, notifications, r.Version)
+	}
+	return tw.Flush()
+}
+
+// ShowRun writes the run with the given id along with the stats of each category and its errors.
+func ShowRun(ctx context.Context, w io.Writer, id string) error {
+	r, err := findRun(ctx, id)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("%w: '%s'", ErrRunNotFound, id)
+	}
+	fmt.Fprintf(w, "Run %s (%s, version %s)\n", r.Id, r.Mode, r.Version)
+	fmt.Fprintf(w, "Started %s, took %.1fs, success: %t\n", r.Start.Local().Format(time.RFC3339), r.Took, r.Success)
+	if r.Error != "" {
+		fmt.Fprintf(w, "Error: %s\n", r.Error)
+	}
+	if r.Search != nil {
+		fmt.Fprintf(w, "Searched %d queries, %d failed, %d deals in %d notifications\n", r.Search.Queries, r.Search.Failed, r.Search.Matches, r.Search.Notifications)
+	}
+	if r.Crawl == nil {
+		return nil
+	}
+	fmt.Fprintf(w, "Crawled %d categories, skipped %d, failed %d\n\n", r.Crawl.Categories, r.Crawl.Skipped, len(r.Crawl.Errors))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHOP\tCATEGORY\tPOSTINGS\tINSERTED\tUPDATED\tINACTIVE\tTOOK API\tTOOK DB")
+	for _, s := range append(r.Crawl.ByCategory, r.Crawl.Stats) {
+		shop, categoryName := string(s.Shop), s.CategoryName
+		if s.Shop == "" {
+			shop, categoryName = "(total)", ""
+		} else if s.CategoryId == "" {
+			categoryName = "(new postings)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%.1fs\t%.1fs\n", shop, categoryName, s.Postings, s.Inserted, s.Updated, s.Inactive, s.TookApi, s.TookDB)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, e := range r.Crawl.Errors {
+		if e.CategoryId == "" {
+			fmt.Fprintf(w, "💥 %s: %s\n", e.Shop, e.Error)
+		} else {
+			fmt.Fprintf(w, "💥 %s '%s' (%s): %s\n", e.Shop, e.CategoryName, e.CategoryId, e.Error)
+		}
+	}
+	return nil
+}
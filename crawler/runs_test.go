@@ -0,0 +1,88 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_toRun(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3"
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	crawl := CrawlReport{Categories: 1, Skipped: 2}
+	crawl.addStats(MM, &category{CategoryId: "CAT_ID", Name: "Gaming"}, &CrawlerStats{Postings: 3, Inserted: 1, TookApi: 1500 * time.Millisecond, TookDB: 250 * time.Millisecond})
+	crawl.addError(SATURN, nil, errors.New("Http Status 500"))
+	search := SearchReport{Queries: 2, Matches: 4, Notifications: 1}
+
+	r := toRun(RunReport{Start: start, Mode: RunModeFull, Crawl: &crawl, Search: &search, Success: true}, start.Add(time.Minute))
+
+	assert.NotEmpty(t, r.Id)
+	assert.Equal(t, start, *r.Start)
+	assert.Equal(t, start.Add(time.Minute), *r.End)
+	assert.Equal(t, 60.0, r.Took)
+	assert.Equal(t, "v1.2.3", r.Version)
+	assert.Equal(t, "", r.Error)
+	assert.Equal(t, &search, r.Search)
+	assert.Equal(t, &runCrawl{
+		Categories: 1,
+		Skipped:    2,
+		Stats:      runStats{Postings: 3, Inserted: 1, TookApi: 1.5, TookDB: 0.25},
+		ByCategory: []runStats{{Shop: MM, CategoryId: "CAT_ID", CategoryName: "Gaming", Postings: 3, Inserted: 1, TookApi: 1.5, TookDB: 0.25}},
+		Errors:     []runError{{Shop: SATURN, Error: "Http Status 500"}},
+	}, r.Crawl)
+}
+
+func Test_toRun_interrupted(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	r := toRun(RunReport{Start: start, Mode: RunModeSearch, Err: context.Canceled}, start.Add(time.Second))
+
+	assert.False(t, r.Success)
+	assert.Equal(t, "context canceled", r.Error)
+	assert.Nil(t, r.Crawl)
+	assert.Nil(t, r.Search)
+}
+
+func Test_toRun_crawlTimeout(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	crawl := CrawlReport{Categories: 3}
+
+	r := toRun(RunReport{Start: start, Mode: RunModeFull, Crawl: &crawl, Search: &SearchReport{}, Success: true, Err: context.DeadlineExceeded}, start.Add(time.Minute))
+
+	assert.False(t, r.Success)
+	assert.Equal(t, "context deadline exceeded", r.Error)
+}
+
+func (suite *PersistenceSuite) Test_SaveRun() {
+	start := time.Now().Add(-time.Hour)
+	crawl := CrawlReport{Categories: 1}
+	crawl.addStats(MM, &category{CategoryId: "CAT_ID", Name: "Gaming"}, &CrawlerStats{Postings: 3, Inserted: 1})
+	fullId, err := SaveRun(ctx, RunReport{Start: start, Mode: RunModeFull, Crawl: &crawl, Search: &SearchReport{Queries: 1}, Success: true})
+	assert.NoError(suite.T(), err)
+	searchId, err := SaveRun(ctx, RunReport{Start: start.Add(time.Minute), Mode: RunModeSearch, Err: context.Canceled})
+	assert.NoError(suite.T(), err)
+
+	runs, err := findRuns(ctx, "", 10, 0)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{searchId, fullId}, []string{runs[0].Id, runs[1].Id})
+	assert.Equal(suite.T(), "context canceled", runs[0].Error)
+
+	runs, err = findRuns(ctx, RunModeFull, 10, 0)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), runs, 1)
+	assert.Equal(suite.T(), 3, runs[0].Crawl.ByCategory[0].Postings)
+
+	var buffer bytes.Buffer
+	assert.NoError(suite.T(), ListRuns(ctx, &buffer, "", 10))
+	assert.Contains(suite.T(), buffer.String(), fullId)
+	assert.Contains(suite.T(), buffer.String(), searchId)
+
+	buffer.Reset()
+	assert.NoError(suite.T(), ShowRun(ctx, &buffer, fullId))
+	assert.Contains(suite.T(), buffer.String(), "Gaming")
+	assert.ErrorIs(suite.T(), ShowRun(ctx, &buffer, "does-not-exist"), ErrRunNotFound)
+}
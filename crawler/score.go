@@ -0,0 +1,147 @@
+package crawler
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// defaultScoreWeights weight the components of the deal score. Configured weights in globalConfig.scoreWeights
+// override single components, a weight of zero disables a component.
+var defaultScoreWeights = map[string]float64{
+	"discount":      1,
+	"saving":        1,
+	"historicalLow": 1,
+	"condition":     1,
+	"distance":      0.5,
+	"age":           0.5,
+}
+
+// conditionScores rate the conditions from 0 to 1.
+var conditionScores = map[condition]float64{
+	conditionNew:       1,
+	conditionOpenBox:   0.8,
+	conditionDisplay:   0.6,
+	conditionUnknown:   0.5,
+	conditionUsed:      0.4,
+	conditionDefective: 0,
+}
+
+const (
+	// savingHalfScore is the absolute saving that scores 0.5, larger savings approach 1.
+	savingHalfScore = 100.0
+	// ageHalfScore is the age of a posting that scores 0.5, older postings approach 0.
+	ageHalfScore = 7 * 24 * time.Hour
+)
+
+// scoreInput is everything that is known about a posting when it is scored. The history of the other postings of the
+// product and the distance are nil if unknown. Without now the age is left out.
+type scoreInput struct {
+	history    *priceHistory
+	distanceKm *float64
+	radiusKm   float64
+	now        time.Time
+}
+
+func (g globalConfig) scoreWeights() map[string]float64 {
+	weights := map[string]float64{}
+	for component, weight := range defaultScoreWeights {
+		weights[component] = weight
+	}
+	for component, weight := range g.ScoreWeights {
+		weights[component] = weight
+	}
+	return weights
+}
+
+func (g globalConfig) validateScoreWeights() error {
+	for component, weight := range g.ScoreWeights {
+		if _, ok := defaultScoreWeights[component]; !ok {
+			return fmt.Errorf("unknown score weight '%s'", component)
+		}
+		if weight < 0 {
+			return fmt.Errorf("score weight '%s' must not be negative", component)
+		}
+	}
+	return nil
+}
+
+// dealScore rates a posting from 0 to 100 as the weighted average of its components, each rated from 0 to 1.
+// Components without data, like the distance of a query without near filter, are left out.
+func dealScore(p posting, in scoreInput, weights map[string]float64) float64 {
+	components := map[string]float64{
+		"discount": math.Min(float64(p.DiscountInPercent)/100, 1),
+		"saving":   p.Saving / (p.Saving + savingHalfScore),
+	}
+	if p.Saving <= 0 {
+		components["saving"] = 0
+	}
+	if in.history != nil && p.Price > 0 {
+		components["historicalLow"] = math.Min(in.history.lowest().Price/p.Price, 1)
+	}
+	if c, ok := conditionScores[p.Condition]; ok {
+		components["condition"] = c
+	}
+	if in.distanceKm != nil && in.radiusKm > 0 {
+		components["distance"] = math.Max(1-*in.distanceKm/in.radiusKm, 0)
+	}
+	if p.CreDat != nil && !in.now.IsZero() {
+		age := math.Max(float64(in.now.Sub(*p.CreDat)), 0)
+		components["age"] = float64(ageHalfScore) / (float64(ageHalfScore) + age)
+	}
+
+	weighted, weightSum := 0.0, 0.0
+	for component, value := range components {
+		weighted += weights[component] * value
+		weightSum += weights[component]
+	}
+	if weightSum == 0 {
+		return 0
+	}
+	return math.Round(weighted/weightSum*1000) / 10
+}
+
+// scorePostings sets the stored score of the postings. It leaves out query specific components like the distance and
+// the age, which changes over time, so the stored score used by sort and score_min stays valid.
+func scorePostings(postings []posting, histories map[int]priceHistory) {
+	weights := CONFIG.GlobalConfig.scoreWeights()
+	for i, p := range postings {
+		postings[i].Score = dealScore(p, scoreInput{history: historyOf(histories, p)}, weights)
+	}
+}
+
+// rankDeals scores the deals of a query including their distance and age and drops deals not passing the historical
+// price options. The rest is sorted by score unless the query has another sort order.
+func rankDeals(q query, deals []posting, histories map[int]priceHistory, now time.Time) []posting {
+	weights := CONFIG.GlobalConfig.scoreWeights()
+	ranked := []posting{}
+	for _, p := range deals {
+		p.History = historyOf(histories, p)
+		if !q.matchesHistory(p, p.History) {
+			continue
+		}
+		in := scoreInput{history: p.History, distanceKm: p.DistanceKm, now: now}
+		if q.Near != nil {
+			in.radiusKm = q.Near.RadiusKm
+		}
+		p.Score = dealScore(p, in, weights)
+		ranked = append(ranked, p)
+	}
+	if q.Sort == nil || *q.Sort == "score" {
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return ranked[i].Score > ranked[j].Score
+		})
+	}
+	return ranked
+}
+
+func pimIds(postings []posting) []int {
+	ids := []int{}
+	for _, p := range postings {
+		if p.PimId != 0 {
+			ids = append(ids, p.PimId)
+		}
+	}
+	return ids
+}
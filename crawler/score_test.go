@@ -0,0 +1,72 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_dealScore(t *testing.T) {
+	now := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	weekAgo := now.Add(-7 * 24 * time.Hour)
+	tests := []struct {
+		name    string
+		p       posting
+		in      scoreInput
+		weights map[string]float64
+		want    float64
+	}{
+		{"discount only", posting{DiscountInPercent: 40}, scoreInput{now: now}, map[string]float64{"discount": 1}, 40},
+		{"saving", posting{Saving: 100}, scoreInput{now: now}, map[string]float64{"saving": 1}, 50},
+		{"new and week old", posting{Condition: conditionNew, CreDat: &weekAgo}, scoreInput{now: now}, map[string]float64{"condition": 1, "age": 1}, 75},
+		{"stored without age", posting{Condition: conditionNew, CreDat: &weekAgo}, scoreInput{}, map[string]float64{"condition": 1, "age": 1}, 100},
+		{"historical low", posting{Price: 80}, scoreInput{history: &priceHistory{Prices: []historicalPrice{{Price: 60}, {Price: 90}}}, now: now}, map[string]float64{"historicalLow": 1}, 75},
+		{"below historical low", posting{Price: 50}, scoreInput{history: &priceHistory{Prices: []historicalPrice{{Price: 60}}}, now: now}, map[string]float64{"historicalLow": 1}, 100},
+		{"no history", posting{Price: 80, DiscountInPercent: 10}, scoreInput{now: now}, map[string]float64{"historicalLow": 1, "discount": 1}, 10},
+		{"distance", posting{}, scoreInput{distanceKm: fPtr(10), radiusKm: 40, now: now}, map[string]float64{"distance": 1}, 75},
+		{"outside radius", posting{}, scoreInput{distanceKm: fPtr(50), radiusKm: 40, now: now}, map[string]float64{"distance": 1}, 0},
+		{"weighted", posting{DiscountInPercent: 80, Condition: conditionDefective}, scoreInput{now: now}, map[string]float64{"discount": 3, "condition": 1}, 60},
+		{"no weights", posting{DiscountInPercent: 80}, scoreInput{now: now}, map[string]float64{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dealScore(tt.p, tt.in, tt.weights))
+		})
+	}
+}
+
+func Test_rankDeals(t *testing.T) {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{GlobalConfig: globalConfig{ScoreWeights: map[string]float64{"saving": 0, "historicalLow": 0, "condition": 0, "distance": 0, "age": 0}}}
+	deals := []posting{
+		{PostingId: "cheap", Price: 10, DiscountInPercent: 20},
+		{PostingId: "best", Price: 20, DiscountInPercent: 70},
+		{PostingId: "good", Price: 30, DiscountInPercent: 50},
+	}
+
+	ranked := rankDeals(query{}, deals, nil, time.Now())
+	assert.Equal(t, []string{"best", "good", "cheap"}, toIds(ranked))
+	assert.Equal(t, 70.0, ranked[0].Score)
+
+	ranked = rankDeals(query{Sort: sPtr("price")}, deals, nil, time.Now())
+	assert.Equal(t, []string{"cheap", "best", "good"}, toIds(ranked))
+
+	deals[0].PimId = 1
+	histories := map[int]priceHistory{1: {PimId: 1, Prices: []historicalPrice{{PostingId: "other", Price: 12}}}}
+	ranked = rankDeals(query{BelowHistoricalMin: true}, deals, histories, time.Now())
+	assert.Equal(t, []string{"cheap"}, toIds(ranked))
+	assert.Equal(t, 12.0, ranked[0].History.lowest().Price)
+}
+
+func Test_globalConfig_validateScoreWeights(t *testing.T) {
+	assert.NoError(t, globalConfig{ScoreWeights: map[string]float64{"age": 0, "discount": 2}}.validateScoreWeights())
+	assert.Error(t, globalConfig{ScoreWeights: map[string]float64{"popularity": 1}}.validateScoreWeights())
+	assert.Error(t, globalConfig{ScoreWeights: map[string]float64{"age": -1}}.validateScoreWeights())
+}
+
+func Test_globalConfig_scoreWeights(t *testing.T) {
+	weights := globalConfig{ScoreWeights: map[string]float64{"age": 0}}.scoreWeights()
+
+	assert.Equal(t, 0.0, weights["age"])
+	assert.Equal(t, 1.0, weights["discount"])
+}
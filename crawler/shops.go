@@ -0,0 +1,144 @@
+package crawler
+
+import (
+	"fmt"
+)
+
+// defaultShops are always known. Configured shops with the same id override their fields.
+var defaultShops = []shopDefinition{
+	{
+		Id:       SATURN,
+		Name:     "Saturn",
+		ApiUrl:   "https://www.saturn.de/de/data/fundgrube/api/postings",
+		ShopUrl:  "https://www.saturn.de/de/data/fundgrube",
+		Currency: "EUR",
+		Locale:   "de-DE",
+	},
+	{
+		Id:       MM,
+		Name:     "MediaMarkt",
+		ApiUrl:   "https://www.mediamarkt.de/de/data/fundgrube/api/postings",
+		ShopUrl:  "https://www.mediamarkt.de/de/data/fundgrube",
+		Currency: "EUR",
+		Locale:   "de-DE",
+	},
+}
+
+var currencySymbols = map[string]string{
+	"EUR": "€",
+}
+
+// shops returns the default shops merged with the configured ones. Fields of a configured shop that are not set are
+// taken from the default shop with the same id, so `{id: SATURN, disabled: true}` is enough to disable Saturn.
+func (cf *ConfigFile) shops() []shopDefinition {
+	shops := append([]shopDefinition{}, defaultShops...)
+	for _, configured := range cf.Shops {
+		merged := false
+		for i, s := range shops {
+			if s.Id == configured.Id {
+				shops[i] = configured.withDefaults(s)
+				merged = true
+			}
+		}
+		if !merged {
+			shops = append(shops, configured)
+		}
+	}
+	return shops
+}
+
+// shopIds returns the ids of all enabled shops.
+func (cf *ConfigFile) shopIds() []Shop {
+	ids := []Shop{}
+	for _, s := range cf.shops() {
+		if !s.Disabled {
+			ids = append(ids, s.Id)
+		}
+	}
+	return ids
+}
+
+func (s shopDefinition) withDefaults(defaults shopDefinition) shopDefinition {
+	if s.Name == "" {
+		s.Name = defaults.Name
+	}
+	if s.ApiUrl == "" {
+		s.ApiUrl = defaults.ApiUrl
+	}
+	if s.ShopUrl == "" {
+		s.ShopUrl = defaults.ShopUrl
+	}
+	if s.Currency == "" {
+		s.Currency = defaults.Currency
+	}
+	if s.Locale == "" {
+		s.Locale = defaults.Locale
+	}
+	return s
+}
+
+func (cf *ConfigFile) shop(id Shop) (*shopDefinition, error) {
+	for _, s := range cf.shops() {
+		if s.Id == id {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownShop, id)
+}
+
+func (cf *ConfigFile) validateShops() error {
+	seen := map[Shop]bool{}
+	for _, s := range cf.Shops {
+		if seen[s.Id] {
+			return fmt.Errorf("shop '%s' is defined twice", s.Id)
+		}
+		seen[s.Id] = true
+	}
+	for _, s := range cf.shops() {
+		if s.Id == "" || s.ApiUrl == "" || s.ShopUrl == "" {
+			return fmt.Errorf("shop '%s' needs an id, api_url and shop_url", s.Id)
+		}
+	}
+	for _, q := range cf.Queries {
+		for _, shop := range q.Shops {
+			if _, err := cf.shop(shop); err != nil {
+				return fmt.Errorf("query '%s': %w", q.Desc, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cf *ConfigFile) validate() error {
+	if err := cf.GlobalConfig.validateScoreWeights(); err != nil {
+		return err
+	}
+	for _, rule := range cf.GlobalConfig.ConditionRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	ids := map[string]bool{}
+	for _, q := range cf.Queries {
+		if err := q.validate(); err != nil {
+			return err
+		}
+		if q.Id != "" && ids[q.Id] {
+			return fmt.Errorf("query '%s': duplicate id '%s'", q.Desc, q.Id)
+		}
+		ids[q.Id] = true
+	}
+	return cf.validateShops()
+}
+
+// formatPrice formats a price with the symbol of the currency. Postings without currency were crawled before shops
+// were configurable and are in euro.
+func formatPrice(price float64, currency string) string {
+	if currency == "" {
+		currency = "EUR"
+	}
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%.2f%s", price, symbol)
+	}
+	return fmt.Sprintf("%.2f %s", price, currency)
+}
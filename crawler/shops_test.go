@@ -0,0 +1,74 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_buildBaseUrl_configuredShop(t *testing.T) {
+	defer func(config ConfigFile) { CONFIG = config }(CONFIG)
+	CONFIG = ConfigFile{Shops: []shopDefinition{{
+		Id:       "MM_AT",
+		Name:     "MediaMarkt Österreich",
+		ApiUrl:   "https://www.mediamarkt.at/de/data/fundgrube/api/postings",
+		ShopUrl:  "https://www.mediamarkt.at/de/data/fundgrube",
+		Currency: "EUR",
+		Locale:   "de-AT",
+	}}}
+
+	apiUrl, err := buildBaseUrl("MM_AT", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.mediamarkt.at/de/data/fundgrube/api/postings", apiUrl)
+
+	_, err = buildBaseUrl("MM_CH", false)
+	assert.ErrorIs(t, err, ErrUnknownShop)
+	assert.Equal(t, []Shop{SATURN, MM, "MM_AT"}, CONFIG.shopIds())
+}
+
+func TestConfigFile_shops_disableDefaultShop(t *testing.T) {
+	config := ConfigFile{Shops: []shopDefinition{{Id: SATURN, Disabled: true}}}
+
+	assert.Equal(t, []Shop{MM}, config.shopIds())
+	saturn, err := config.shop(SATURN)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.saturn.de/de/data/fundgrube", saturn.ShopUrl)
+	assert.NoError(t, config.validateShops())
+}
+
+func TestConfigFile_validateShops(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ConfigFile
+		wantErr bool
+	}{
+		{
+			"default shops",
+			ConfigFile{Queries: []query{{Shops: []Shop{SATURN, MM}}}},
+			false,
+		}, {
+			"missing api url",
+			ConfigFile{Shops: []shopDefinition{{Id: "MM_AT", ShopUrl: "https://www.mediamarkt.at"}}},
+			true,
+		}, {
+			"duplicate shop",
+			ConfigFile{Shops: []shopDefinition{defaultShops[0], defaultShops[0]}},
+			true,
+		}, {
+			"query with unknown shop",
+			ConfigFile{Queries: []query{{Shops: []Shop{"MM_AT"}}}},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validateShops()
+			assert.Equal(t, tt.wantErr, err != nil, "validateShops() = %v", err)
+		})
+	}
+}
+
+func Test_formatPrice(t *testing.T) {
+	assert.Equal(t, "12.34€", formatPrice(12.34, ""))
+	assert.Equal(t, "12.34€", formatPrice(12.34, "EUR"))
+	assert.Equal(t, "12.34 CHF", formatPrice(12.34, "CHF"))
+}
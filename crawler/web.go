@@ -0,0 +1,263 @@
+package crawler
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webPageSize is the number of postings on a page of the web ui.
+const webPageSize = 48
+
+//go:embed web/templates web/static web/report
+var webFiles embed.FS
+
+// webSorts are the sort orders offered by the web ui, a subset of sortOrders.
+var webSorts = []string{"price", "discount", "newest"}
+
+var webTemplateFuncs = template.FuncMap{
+	"price": formatPrice,
+	"date": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	},
+	"has": func(form url.Values, key string, value string) bool {
+		for _, v := range form[key] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+var webTemplates = map[string]*template.Template{
+	"postings": parseWebTemplate("postings.html"),
+	"posting":  parseWebTemplate("posting.html"),
+	"error":    parseWebTemplate("error.html"),
+}
+
+func parseWebTemplate(page string) *template.Template {
+	return template.Must(template.New("layout.html").Funcs(webTemplateFuncs).
+		ParseFS(webFiles, "web/templates/layout.html", "web/templates/"+page))
+}
+
+type postingsPage struct {
+	Postings   []posting
+	Form       url.Values
+	Error      string
+	Shops      []Shop
+	Conditions []condition
+	Sorts      []string
+	Outlets    []string
+	Categories []string
+	Page       int
+	PrevUrl    string
+	NextUrl    string
+}
+
+type postingPage struct {
+	Posting posting
+	History *priceHistory
+	Product *product
+}
+
+type errorPage struct {
+	Status int
+	Error  string
+}
+
+// NewWebHandler serves a web ui to browse the active postings. Its filters are named like the fields of a query, so a
+// filtered page can be turned into a query by copying its url parameters.
+func NewWebHandler() http.Handler {
+	static, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/postings/", allowPageMethod(handlePostingPage))
+	mux.HandleFunc("/", allowPageMethod(handlePostingsPage))
+	return mux
+}
+
+func allowPageMethod(handler func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			renderPage(w, http.StatusMethodNotAllowed, "error", errorPage{http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method)})
+			return
+		}
+		if err := handler(w, r); err != nil {
+			status := http.StatusInternalServerError
+			var storageErr *ErrStorageUnavailable
+			if errors.As(err, &storageErr) {
+				status = http.StatusServiceUnavailable
+			}
+			log.Errorf("%s %s failed: %s", r.Method, r.URL.Path, err)
+			renderPage(w, status, "error", errorPage{status, err.Error()})
+		}
+	}
+}
+
+// handlePostingsPage lists the active postings. Invalid filters are shown on the page instead of the postings.
+func handlePostingsPage(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/" {
+		renderPage(w, http.StatusNotFound, "error", errorPage{http.StatusNotFound, "Page not found"})
+		return nil
+	}
+	form := nonEmptyParams(r.URL.Query())
+	data := postingsPage{Form: form, Shops: CONFIG.shopIds(), Conditions: conditions, Sorts: webSorts, Postings: []posting{}, Page: 1}
+	if err := data.fillChoices(r); err != nil {
+		return err
+	}
+
+	page, err := strconv.Atoi(form.Get("page"))
+	if form.Get("page") != "" && (err != nil || page < 1) {
+		data.Error = "page must be a positive number"
+		renderPage(w, http.StatusBadRequest, "postings", data)
+		return nil
+	}
+	if page > 1 {
+		data.Page = page
+	}
+	filters := url.Values{}
+	for key, values := range form {
+		if key != "page" {
+			filters[key] = values
+		}
+	}
+	q, err := queryFromParams(filters)
+	if err == nil {
+		err = validateListQuery(q)
+	}
+	if err != nil {
+		data.Error = strings.TrimPrefix(err.Error(), errInvalidRequest.Error()+": ")
+		renderPage(w, http.StatusBadRequest, "postings", data)
+		return nil
+	}
+
+	// fetch one more posting to know whether there is a next page
+	postings, err := FindAll(r.Context(), q, nil, webPageSize+1, int64((data.Page-1)*webPageSize))
+	if err != nil {
+		return err
+	}
+	if len(postings) > webPageSize {
+		postings = postings[:webPageSize]
+		data.NextUrl = pageUrl(filters, data.Page+1)
+	}
+	if data.Page > 1 {
+		data.PrevUrl = pageUrl(filters, data.Page-1)
+	}
+	data.Postings = withDistances(q, postings)
+	renderPage(w, http.StatusOK, "postings", data)
+	return nil
+}
+
+// fillChoices sets the outlet and category names offered as filters.
+func (data *postingsPage) fillChoices(r *http.Request) error {
+	outlets, err := findOutlets(r.Context())
+	if err != nil {
+		return err
+	}
+	categories, err := findCategories(r.Context())
+	if err != nil {
+		return err
+	}
+	outletNames := []string{}
+	for _, o := range outlets {
+		outletNames = append(outletNames, o.Name)
+	}
+	categoryNames := []string{}
+	for _, c := range categories {
+		categoryNames = append(categoryNames, c.Name)
+	}
+	data.Outlets = distinctSorted(outletNames)
+	data.Categories = distinctSorted(categoryNames)
+	return nil
+}
+
+// handlePostingPage shows a posting with the prices of the other postings of its product.
+func handlePostingPage(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/postings/")
+	p, err := FindOne(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		renderPage(w, http.StatusNotFound, "error", errorPage{http.StatusNotFound, fmt.Sprintf("Posting '%s' not found", id)})
+		return nil
+	}
+
+	data := postingPage{Posting: *p}
+	if p.PimId != 0 {
+		histories, err := findPriceHistories(r.Context(), []int{p.PimId})
+		if err != nil {
+			return err
+		}
+		data.History = historyOf(histories, *p)
+		products, err := findProducts(r.Context(), []int{p.PimId})
+		if err != nil {
+			return err
+		}
+		if found, ok := products[p.PimId]; ok {
+			data.Product = &found
+		}
+	}
+	renderPage(w, http.StatusOK, "posting", data)
+	return nil
+}
+
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := webTemplates[name].Execute(w, data); err != nil {
+		log.Errorf("Could not render page '%s': %s", name, err)
+	}
+}
+
+// nonEmptyParams drops the empty values a html form submits for unused inputs.
+func nonEmptyParams(params url.Values) url.Values {
+	ret := url.Values{}
+	for key, values := range params {
+		for _, value := range values {
+			if strings.TrimSpace(value) != "" {
+				ret.Add(key, strings.TrimSpace(value))
+			}
+		}
+	}
+	return ret
+}
+
+func pageUrl(filters url.Values, page int) string {
+	params := url.Values{}
+	for key, values := range filters {
+		params[key] = values
+	}
+	params.Set("page", strconv.Itoa(page))
+	return "/?" + params.Encode()
+}
+
+func distinctSorted(values []string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			ret = append(ret, v)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,92 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func Test_renderPage_postings(t *testing.T) {
+	form, _ := url.ParseQuery("name_regex=switch&shops=MM&condition=open_box&sort=discount&outlet_name=Hannover")
+	p := getExamplePosting("switch")
+	p.Name = "Nintendo Switch <OLED>"
+	recorder := httptest.NewRecorder()
+
+	renderPage(recorder, http.StatusOK, "postings", postingsPage{
+		Postings: []posting{p}, Form: form, Shops: []Shop{MM, SATURN}, Conditions: conditions, Sorts: webSorts,
+		Outlets: []string{"Berlin", "Hannover"}, Page: 2, PrevUrl: "/?page=1",
+	})
+
+	body := recorder.Body.String()
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, body, `value="switch"`)
+	assert.Contains(t, body, `<input type="checkbox" name="shops" value="MM" checked>`)
+	assert.Contains(t, body, `<input type="checkbox" name="shops" value="SATURN" >`)
+	assert.Contains(t, body, `<input type="checkbox" name="condition" value="open_box" checked>`)
+	assert.Contains(t, body, `<option selected>discount</option>`)
+	assert.Contains(t, body, `<option selected>Hannover</option>`)
+	assert.Contains(t, body, `<a href="/postings/`+p.PostingId+`">`)
+	assert.Contains(t, body, "Nintendo Switch &lt;OLED&gt;")
+	assert.Contains(t, body, `<img src="`+p.Url[0]+`"`)
+	assert.Contains(t, body, `<a href="/?page=1">`)
+	assert.NotContains(t, body, "next &raquo;")
+}
+
+func Test_renderPage_postingsError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+
+	renderPage(recorder, http.StatusBadRequest, "postings", postingsPage{Form: url.Values{}, Error: "invalid expr", Page: 1})
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `<p class="error">invalid expr</p>`)
+}
+
+func Test_renderPage_posting(t *testing.T) {
+	p := getExamplePosting("switch")
+	p.ShopUrl = "https://www.mediamarkt.de/switch"
+	history := &priceHistory{PimId: p.PimId, Prices: []historicalPrice{
+		{PostingId: "other", Price: 12.34, Date: parseDate("2022-04-01T00:00:00Z"), Outlet: "Lübeck"},
+	}}
+	recorder := httptest.NewRecorder()
+
+	renderPage(recorder, http.StatusOK, "posting", postingPage{Posting: p, History: history,
+		Product: &product{PimId: p.PimId, MinPrice: 10, MaxPrice: 20, MedianPrice: 15, Outlets: 3}})
+
+	body := recorder.Body.String()
+	assert.Contains(t, body, `<a class="shop" href="`+p.ShopUrl+`">`)
+	assert.Contains(t, body, "<tr><td>12.34€</td><td>2022-04-01</td><td>Lübeck</td></tr>")
+	assert.Contains(t, body, "median\n    15.00€ in 3 outlet(s)")
+}
+
+func Test_webHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"static file", http.MethodGet, "/static/style.css", http.StatusOK, ".postings"},
+		{"unknown page", http.MethodGet, "/foo", http.StatusNotFound, "Page not found"},
+		{"wrong method", http.MethodPost, "/", http.StatusMethodNotAllowed, "Method POST not allowed"},
+	}
+	handler := NewWebHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), tt.wantBody)
+		})
+	}
+}
+
+func Test_nonEmptyParams(t *testing.T) {
+	params, _ := url.ParseQuery("name_regex=&price_max=+100+&shops=MM&shops=")
+
+	assert.Equal(t, url.Values{"price_max": {"100"}, "shops": {"MM"}}, nonEmptyParams(params))
+}